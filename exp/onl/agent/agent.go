@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/advanderveer/27067dd17/onl"
@@ -21,6 +22,8 @@ type Agent struct {
 	clean     func()
 	chain     *onl.Chain
 	engine    *engine.Engine
+	metrics   *http.Server
+	mln       net.Listener
 }
 
 //New allocates the agent
@@ -32,14 +35,37 @@ func New(cfg *Conf) (a *Agent, err error) {
 	}
 
 	a.clock = clock.NewWallClock(cfg.RoundTime)
-	a.store, a.clean = onl.TempBadgerStore()
+	a.store, a.clean = cfg.Store()
 
 	a.chain, _, err = onl.NewChain(a.store, a.clock.Round(), cfg.genf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initalize chain: %v", err)
 	}
 
+	if cfg.StateDir != "" {
+		err = a.chain.OpenState(cfg.StateDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open state: %v", err)
+		}
+	}
+
 	a.engine = engine.New(cfg.LogWriter, a.broadcast, a.clock, cfg.Identity, a.chain)
+	a.engine.AutoPrune(cfg.PruneFinality)
+
+	//serve metrics, if configured
+	if cfg.MetricsBind != "" {
+		a.mln, err = net.Listen("tcp", cfg.MetricsBind)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to listen for metrics: %v", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", a.MetricsHandler())
+		a.metrics = &http.Server{Handler: mux}
+		go a.metrics.Serve(a.mln)
+	}
+
 	return
 }
 
@@ -51,16 +77,38 @@ func (a *Agent) Addr() net.Addr {
 	return a.broadcast.Addr()
 }
 
+//MetricsAddr returns the address metrics are served on, or nil if the agent
+//doesn't serve metrics
+func (a *Agent) MetricsAddr() net.Addr {
+	if a.mln == nil {
+		return nil
+	}
+
+	return a.mln.Addr()
+}
+
 func (a *Agent) Draw(w io.Writer) (err error) {
 	return a.engine.Draw(w)
 }
 
 func (a *Agent) Close() (err error) {
+	if a.metrics != nil {
+		err = a.metrics.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close metrics server: %v", err)
+		}
+	}
+
 	err = a.engine.Shutdown(context.Background())
 	if err != nil {
 		return err
 	}
 
+	err = a.chain.CloseState()
+	if err != nil {
+		return fmt.Errorf("failed to close state: %v", err)
+	}
+
 	a.clean()
 
 	return
@@ -0,0 +1,66 @@
+package agent_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl/agent"
+	"github.com/advanderveer/go-test"
+)
+
+func TestAgentMetrics(t *testing.T) {
+	cfg := agent.DefaultConf()
+	cfg.MetricsBind = "127.0.0.1:0"
+	test.Ok(t, cfg.StartWithStake(1, cfg.Identity))
+
+	a, err := agent.New(cfg)
+	test.Ok(t, err)
+	defer a.Close()
+
+	resp, err := http.Get("http://" + a.MetricsAddr().String() + "/metrics")
+	test.Ok(t, err)
+	defer resp.Body.Close()
+	test.Equals(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	test.Ok(t, err)
+
+	for _, line := range []string{
+		"# TYPE onl_round gauge",
+		"# TYPE onl_tip_round gauge",
+		"onl_blocks_appended_total 0",
+		"onl_mempool_writes 0",
+		"onl_orphans 0",
+		"# TYPE onl_blocks_rejected_total counter",
+		"# TYPE onl_block_append_seconds summary",
+		"# TYPE onl_broadcast_sent_bytes_total counter",
+	} {
+		test.Assert(t, strings.Contains(string(body), line+"\n"), "metrics should contain %q, got: %s", line, body)
+	}
+}
+
+func TestAgentMetricsListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Ok(t, err)
+	defer taken.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Ok(t, err)
+	test.Ok(t, free.Close())
+
+	cfg := agent.DefaultConf()
+	cfg.Bind = free.Addr().String()
+	cfg.MetricsBind = taken.Addr().String()
+	test.Ok(t, cfg.StartWithStake(1, cfg.Identity))
+
+	_, err = agent.New(cfg)
+	test.Assert(t, err != nil, "should fail to listen for metrics")
+
+	//the engine was shut down, which closed the broadcast
+	ln, err := net.Listen("tcp", cfg.Bind)
+	test.Ok(t, err)
+	test.Ok(t, ln.Close())
+}
@@ -16,6 +16,10 @@ type Conf struct {
 	//The tcp address the agent will bind on
 	Bind string
 
+	//The tcp address metrics are served on over http at /metrics, empty
+	//disables serving metrics
+	MetricsBind string
+
 	//Maximum incoming broadcast connections
 	MaxIncomingConn int
 
@@ -28,6 +32,18 @@ type Conf struct {
 	//The identity this agent will assume
 	Identity *onl.Identity
 
+	//PruneFinality configures the finalization at which abandoned forks are
+	//removed from the store, zero disables pruning
+	PruneFinality float64
+
+	//Store creates the store that holds the chain and a function that cleans
+	//it up when the agent is closed
+	Store func() (s onl.Store, clean func())
+
+	//StateDir is the directory the state of the finalized block is kept in,
+	//empty keeps all state in memory
+	StateDir string
+
 	//genf is configured through StartWithStake
 	genf func(kv *onl.KV)
 }
@@ -54,5 +70,8 @@ func DefaultConf() *Conf {
 		MaxMessageBuf:   100,
 		RoundTime:       time.Second,
 		Identity:        onl.NewIdentity(nil),
+		Store: func() (onl.Store, func()) {
+			return onl.TempBadgerStore()
+		},
 	}
 }
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//WriteMetrics writes metrics of the engine, chain and broadcast in the
+//Prometheus text format
+func (a *Agent) WriteMetrics(w io.Writer) (err error) {
+	es, err := a.engine.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to collect engine stats: %v", err)
+	}
+
+	m := &metricsWriter{w: w}
+	m.metric("onl_round", "gauge", "Round the clock is in.", float64(es.Round))
+	m.metric("onl_tip_round", "gauge", "Round of the block on the tip.", float64(es.TipRound))
+	m.metric("onl_tip_finalization", "gauge", "Finalization of the block on the tip.", es.TipFinalization)
+	m.metric("onl_mempool_writes", "gauge", "Writes in the mempool.", float64(es.PoolWrites))
+	m.metric("onl_mempool_bytes", "gauge", "Encoded size of the writes in the mempool.", float64(es.PoolBytes))
+	m.metric("onl_orphans", "gauge", "Messages waiting on a block or round.", float64(es.Orphans))
+	m.metric("onl_orphan_bytes", "gauge", "Encoded size of the blocks waiting on a block or round.", float64(es.OrphanBytes))
+	m.metric("onl_blocks_appended_total", "counter", "Blocks appended to the chain.", float64(es.Chain.Appended))
+
+	appends := es.Chain.Appended
+	m.help("onl_blocks_rejected_total", "counter", "Blocks rejected by the chain, by reason.")
+	for _, reason := range sortedKeys(es.Chain.Rejected) {
+		m.value("onl_blocks_rejected_total", []string{"reason", reason}, float64(es.Chain.Rejected[reason]))
+		appends += es.Chain.Rejected[reason]
+	}
+
+	m.help("onl_block_append_seconds", "summary", "Time spent appending blocks, including rejected ones.")
+	m.value("onl_block_append_seconds_sum", nil, es.Chain.AppendSeconds)
+	m.value("onl_block_append_seconds_count", nil, float64(appends))
+
+	peers := a.broadcast.Stats()
+	addrs := make([]string, 0, len(peers))
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+	m.help("onl_broadcast_received_bytes_total", "counter", "Bytes received from each peer.")
+	for _, addr := range addrs {
+		m.value("onl_broadcast_received_bytes_total", []string{"peer", addr}, float64(peers[addr].BytesIn))
+	}
+
+	m.help("onl_broadcast_sent_bytes_total", "counter", "Bytes sent to each peer.")
+	for _, addr := range addrs {
+		m.value("onl_broadcast_sent_bytes_total", []string{"peer", addr}, float64(peers[addr].BytesOut))
+	}
+
+	return m.err
+}
+
+//MetricsHandler returns a http handler that serves the metrics
+func (a *Agent) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := a.WriteMetrics(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+//metricsWriter writes the Prometheus text format, it keeps the first error
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+//labelEscaper escapes label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) help(name, typ, help string) {
+	if m.err != nil {
+		return
+	}
+
+	_, m.err = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//value writes a sample, labels are given as name and value pairs
+func (m *metricsWriter) value(name string, labels []string, v float64) {
+	if m.err != nil {
+		return
+	}
+
+	var lbls []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		lbls = append(lbls, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+
+	if len(lbls) > 0 {
+		name += "{" + strings.Join(lbls, ",") + "}"
+	}
+
+	_, m.err = fmt.Fprintf(m.w, "%s %s\n", name, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+//metric writes the help and type of an unlabeled metric with its sample
+func (m *metricsWriter) metric(name, typ, help string, v float64) {
+	m.help(name, typ, help)
+	m.value(name, nil, v)
+}
+
+func sortedKeys(m map[string]uint64) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return
+}
@@ -1,13 +1,13 @@
 package onl
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"math/big"
 
+	"github.com/advanderveer/27067dd17/onl/enc"
 	"github.com/advanderveer/27067dd17/vrf"
 	"github.com/advanderveer/27067dd17/vrf/ed25519"
 )
@@ -79,48 +79,124 @@ type Block struct {
 	//other identities will vote on this block by referencing it and strenghen
 	//the networks believe.
 	Writes []*Write
+
+	//legacy is set for blocks of the first release, see legacy.go
+	legacy bool
+
+	//hash of the encoded writes, it is taken from the bytes the writes were
+	//decoded from such that hashing the header doesn't encode them again
+	whash *[sha256.Size]byte
 }
 
-// Hash the block returning an unique identifier
+// MaxBlockSize is the maximum number of bytes of an encoded block
+const MaxBlockSize = 1024 * 1024
+
+// Size returns the number of bytes of the encoded block
+func (b *Block) Size() int {
+	d, err := b.MarshalBinary()
+	if err != nil {
+		panic("failed to encode block: " + err.Error())
+	}
+
+	return len(d)
+}
+
+const blockVersion = 2
+
+//MarshalBinary encodes the block in its canonical format, the signature is
+//always the last part of the encoding
+func (b *Block) MarshalBinary() (d []byte, err error) {
+	if b.legacy {
+		return b.marshalLegacy()
+	}
+
+	e := enc.NewWriter(blockVersion)
+	e.Uint64(b.Round)
+	e.Uint64(b.Timestamp)
+	e.Bytes(b.Token)
+	e.Bytes(b.Proof)
+	e.Fixed(b.PK[:])
+	e.Fixed(b.Prev[:])
+
+	e.Len(len(b.Writes))
+	for _, w := range b.Writes {
+		wd, err := w.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode write: %v", err)
+		}
+
+		e.Bytes(wd)
+	}
+
+	e.Fixed(b.Signature[:])
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes a block that was encoded by MarshalBinary
+func (b *Block) UnmarshalBinary(d []byte) (err error) {
+	if len(d) > 0 && d[0] == legacyBlockVersion {
+		return b.unmarshalLegacy(d[1:])
+	}
+
+	r, _ := enc.NewReader(d, blockVersion)
+	b.legacy = false
+	b.Round = r.Uint64()
+	b.Timestamp = r.Uint64()
+	b.Token = r.Bytes()
+	b.Proof = r.Bytes()
+	r.Fixed(b.PK[:])
+	r.Fixed(b.Prev[:])
+
+	n := r.Len()
+	b.Writes = nil
+	we := enc.NewWriter(headerVersion)
+	we.Len(n)
+	for i := 0; i < n && r.Err() == nil; i++ {
+		w := &Write{}
+		wd := r.Bytes()
+		if r.Err() == nil {
+			r.Fail(w.UnmarshalBinary(wd))
+		}
+
+		we.Bytes(wd)
+		b.Writes = append(b.Writes, w)
+	}
+
+	r.Fixed(b.Signature[:])
+	b.whash = nil
+	err = r.Done()
+	if err != nil || n < 1 {
+		return err //without writes the hash is cheap to take
+	}
+
+	wh := sha256.Sum256(we.Data())
+	b.whash = &wh
+	return nil
+}
+
+// Hash the block returning an unique identifier. It is the hash of the block's
+// header, which commits to the writes. Blocks of the first release keep the
+// identifier they were stored and signed with.
 func (b *Block) Hash() (id ID) {
-	tsb := make([]byte, 8)
-	binary.BigEndian.PutUint64(tsb, b.Timestamp)
-	roundb := make([]byte, 8)
-	binary.BigEndian.PutUint64(roundb, math.MaxUint64-b.Round)
-
-	//encode transaction hashes in the id
-	var wrshs [][]byte
-	for _, wr := range b.Writes {
-		wrsh := wr.Hash()
-		wrshs = append(wrshs, wrsh[:])
-		wrshs = append(wrshs, wr.Signature[:])
+	if b.legacy {
+		return b.legacyHash()
 	}
 
-	//hash the fields and the ops
-	id = ID(sha256.Sum256(bytes.Join([][]byte{
-		b.Prev.Bytes(),
-		b.PK[:],
-		b.Proof,
-		b.Token,
-		tsb,
-		roundb,
-		bytes.Join(wrshs, nil),
-	}, nil)))
-
-	//prefix the ID with the round, allows round based sorting in the store
-	//@TODO (security) what does this the collission resistance 4,7e21 do to security
-	copy(id[:8], roundb)
-	return
+	return b.Header().Hash()
 }
 
 //Seed returns the input for the verifiable random token. The token (and the thus
 //the blocks ranking) is dependant on this seed.
 func (b *Block) Seed(stable ID) []byte {
-	seed := stable[:]               //is stable and unknown when the identity commits to a pk
-	seed = append(seed, b.PK[:]...) //the pk of the proposer
+	return seed(stable, b.PK, b.Round)
+}
+
+func seed(stable ID, pk PK, round uint64) []byte {
+	seed := stable[:]             //is stable and unknown when the identity commits to a pk
+	seed = append(seed, pk[:]...) //the pk of the proposer
 
 	roundb := make([]byte, 8) //round nr as the epoc dividd by the round time
-	binary.BigEndian.PutUint64(roundb, b.Round)
+	binary.BigEndian.PutUint64(roundb, round)
 	seed = append(seed, roundb...)
 	return seed
 }
@@ -150,6 +226,17 @@ func (b *Block) AppendWrite(ws ...*Write) {
 			continue
 		}
 
+		b.whash = nil
 		b.Writes = append(b.Writes, w)
 	}
 }
+
+//seal keeps the hash of the writes like decoding does, the block must not be
+//changed afterwards
+func (b *Block) seal() {
+	b.whash = nil
+	if len(b.Writes) > 0 {
+		wh := b.writesHash()
+		b.whash = &wh
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/27067dd17/onl/enc"
 	"github.com/advanderveer/27067dd17/onl/ssi"
 	"github.com/advanderveer/go-test"
 )
@@ -29,37 +30,37 @@ func TestBlockHashing(t *testing.T) {
 
 	b1 := idn1.Mint(1, bid1, bid2, 1)
 	b1.AppendWrite(&onl.Write{TxData: &ssi.TxData{}})
-	test.Equals(t, "fffffffffffffffee6969879", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffedd5b372f", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 	test.Equals(t, uint64(1), b1.Hash().Round())
-	test.Equals(t, "e6969879-1", b1.Hash().String())
+	test.Equals(t, "dd5b372f-1", b1.Hash().String())
 
 	b1.Prev[0] = 0x02
-	test.Equals(t, "fffffffffffffffe7a72e8c8", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffe28dcdaf6", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.PK[0] = 0x01
-	test.Equals(t, "fffffffffffffffebfb5c20d", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffe51811a5f", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.Proof[0] = 0x01
-	test.Equals(t, "fffffffffffffffea5e1f3f7", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffea1ddc4b5", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.Token[0] = 0x01
-	test.Equals(t, "fffffffffffffffe7bcd69b4", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffe0ff6a092", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.Timestamp += 1
-	test.Equals(t, "fffffffffffffffecdeb6f7c", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "fffffffffffffffe8b4d5509", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.Round = 100
-	test.Equals(t, "ffffffffffffff9b57e50a97", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "ffffffffffffff9b34c82e56", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 	test.Equals(t, uint64(100), b1.Hash().Round())
 
 	b1.AppendWrite(&onl.Write{TxData: &ssi.TxData{}})
-	test.Equals(t, "ffffffffffffff9baed4488b", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "ffffffffffffff9b7106c0fe", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.AppendWrite(nil) //shouldn't do anything
-	test.Equals(t, "ffffffffffffff9baed4488b", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "ffffffffffffff9b7106c0fe", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 	b1.Writes[0].Signature[0] = 0x01
-	test.Equals(t, "ffffffffffffff9b7d34286f", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
+	test.Equals(t, "ffffffffffffff9b6431abaa", fmt.Sprintf("%.12x", b1.Hash().Bytes()))
 
 }
 
@@ -67,10 +68,11 @@ func TestConsistentWritesHashing(t *testing.T) {
 	idn1 := onl.NewIdentity([]byte{0x01})
 	st1, err := onl.NewState(nil)
 	test.Ok(t, err)
-	w1 := st1.Update(func(kv *onl.KV) {
-		kv.CoinbaseTransfer(idn1.PK(), 1)             //mint 1 current
-		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK()) //then deposit it
+	w1, err := st1.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(idn1.PK(), 1)                    //mint 1 current
+		return kv.DepositStake(idn1.PK(), 1, idn1.TokenPK()) //then deposit it
 	})
+	test.Ok(t, err)
 
 	b1 := idn1.Mint(1, bid1, bid1, 1)
 	b1.AppendWrite(w1)
@@ -85,7 +87,7 @@ func TestBlockMintingSigningVerification(t *testing.T) {
 	test.Equals(t, false, b1.VerifySignature())
 
 	idn1.Sign(b1)
-	test.Equals(t, "b21d2e12", fmt.Sprintf("%.4x", b1.Signature))
+	test.Equals(t, "293fd616", fmt.Sprintf("%.4x", b1.Signature))
 	test.Equals(t, true, b1.VerifySignature())
 
 	//crypto should verify
@@ -108,3 +110,46 @@ func TestBlockRanking(t *testing.T) {
 	test.Equals(t, "97552841951904930067318056973531093736152646717171940036091344696617083484138", b1.Rank(1).Text(10))
 	test.Equals(t, "195105683903809860134636113947062187472305293434343880072182689393234166968276", b1.Rank(2).Text(10))
 }
+
+func TestBlockEncoding(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	st1, err := onl.NewState(nil)
+	test.Ok(t, err)
+	w1, err := st1.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		return kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	})
+	test.Ok(t, err)
+
+	test.Ok(t, w1.GenerateNonce())
+	w1.PK = idn1.PK()
+	idn1.SignWrite(w1)
+
+	b1 := idn1.Mint(1, bid1, bid2, 1)
+	b1.AppendWrite(w1)
+	idn1.Sign(b1)
+
+	d1, err := b1.MarshalBinary()
+	test.Ok(t, err)
+
+	b2 := &onl.Block{}
+	test.Ok(t, b2.UnmarshalBinary(d1))
+	test.Equals(t, b1.Hash(), b2.Hash())
+	test.Equals(t, true, b2.VerifySignature())
+	test.Equals(t, true, b2.Writes[0].VerifySignature())
+	test.Equals(t, w1.WriteRows, b2.Writes[0].WriteRows)
+
+	d2, err := b2.MarshalBinary()
+	test.Ok(t, err)
+	test.Equals(t, d1, d2)
+
+	t.Run("trailing data", func(t *testing.T) {
+		test.Equals(t, enc.ErrTrailingData, (&onl.Block{}).UnmarshalBinary(append(d1, 0x00)))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		d3 := append([]byte{}, d1...)
+		d3[0] = 0xff
+		test.Equals(t, enc.ErrUnsupportedVersion, (&onl.Block{}).UnmarshalBinary(d3))
+	})
+}
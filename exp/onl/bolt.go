@@ -0,0 +1,244 @@
+package onl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	boltBucketBlocks  = []byte{0x00}
+	boltBucketWeights = []byte{0x01}
+	boltBucketMeta    = []byte{0x02}
+)
+
+//BoltStore is a store implementation that keeps blocks in a single bolt file.
+//It uses less memory then the badger store but writable transactions are
+//serialized: a second writable transaction blocks until the first one is
+//committed or discarded.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+//BoltTx is a transaction on the bolt store
+type BoltTx struct {
+	btx *bolt.Tx
+}
+
+//NewBoltStore creates a bolt powered store in the provided directory, the
+//directory must exist
+func NewBoltStore(dir string) (s *BoltStore, err error) {
+	s = &BoltStore{}
+	s.db, err = bolt.Open(filepath.Join(dir, "onl.bolt"), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %v", err)
+	}
+
+	if err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlocks, boltBucketWeights, boltBucketMeta} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %v", err)
+	}
+
+	return
+}
+
+//TempBoltStore will return a temporary store that will be fully cleaned up when
+//the 'clean' func is called. The database is not closed prior to removal and it
+//panics if any of the operations fails so this function is mostly used for testing
+//purposes
+func TempBoltStore() (s *BoltStore, clean func()) {
+	dir, err := ioutil.TempDir("", "onl_")
+	if err != nil {
+		panic("failed to create tempdir: " + err.Error())
+	}
+
+	s, err = NewBoltStore(dir)
+	if err != nil {
+		panic("failed to create store: " + err.Error())
+	}
+
+	return s, func() {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			panic("faild to remove dir: " + err.Error())
+		}
+	}
+}
+
+//CreateTx sets up the transaction
+func (s *BoltStore) CreateTx(writable bool) (tx Tx) {
+	btx, err := s.db.Begin(writable)
+	if err != nil {
+		panic("failed to begin bolt tx: " + err.Error())
+	}
+
+	return &BoltTx{btx: btx}
+}
+
+//Close the store, removing any open resources
+func (s *BoltStore) Close() (err error) {
+	return s.db.Close()
+}
+
+//ReadTip reads the currently stored tip
+func (tx *BoltTx) ReadTip() (tip ID, tipw uint64, err error) {
+	val := tx.btx.Bucket(boltBucketMeta).Get([]byte("tip"))
+	if val == nil {
+		return
+	}
+
+	copy(tip[:], val) //first part is id
+	tipw = binary.BigEndian.Uint64(val[IDLen:])
+	return
+}
+
+//WriteTip persists the tip information
+func (tx *BoltTx) WriteTip(tip ID, tipw uint64) (err error) {
+	val := make([]byte, IDLen+8)
+	copy(val, tip[:])
+	binary.BigEndian.PutUint64(val[IDLen:], tipw)
+
+	err = tx.btx.Bucket(boltBucketMeta).Put([]byte("tip"), val)
+	if err != nil {
+		return fmt.Errorf("failed to put tip key: %v", err)
+	}
+
+	return
+}
+
+//ReadWeight reads the sum weight of the block with the provided id
+func (tx *BoltTx) ReadWeight(id ID) (w uint64, err error) {
+	val := tx.btx.Bucket(boltBucketWeights).Get(id[:])
+	if val == nil {
+		return 0, ErrNotWeighted
+	}
+
+	return binary.BigEndian.Uint64(val), nil
+}
+
+//WriteWeight persists the sum weight of the block with the provided id
+func (tx *BoltTx) WriteWeight(id ID, w uint64) (err error) {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, w)
+
+	err = tx.btx.Bucket(boltBucketWeights).Put(id[:], val)
+	if err != nil {
+		return fmt.Errorf("failed to put weight key: %v", err)
+	}
+
+	return
+}
+
+//Write block info and replace any existing info
+func (tx *BoltTx) Write(b *Block, stk *Stakes, rank *big.Int) (err error) {
+	d, err := encode(b, stk, rank)
+	if err != nil {
+		return err
+	}
+
+	id := b.Hash()
+	err = tx.btx.Bucket(boltBucketBlocks).Put(id[:], d)
+	if err != nil {
+		return fmt.Errorf("failed to put block data: %v", err)
+	}
+
+	return
+}
+
+//Read block data from the store and any finalization info
+func (tx *BoltTx) Read(id ID) (b *Block, stk *Stakes, rank *big.Int, err error) {
+	d := tx.btx.Bucket(boltBucketBlocks).Get(id[:])
+	if d == nil {
+		return nil, nil, nil, ErrBlockNotExist
+	}
+
+	return decode(d)
+}
+
+// Round calls f in lexicographically order of the id for each block in round 'nr'.
+func (tx *BoltTx) Round(nr uint64, f func(id ID, b *Block, stk *Stakes, rank *big.Int) error) (err error) {
+	prefix := roundPrefix(nr)[len(blockBucket):]
+	c := tx.btx.Bucket(boltBucketBlocks).Cursor()
+	for k, d := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, d = c.Next() {
+		b, stk, rank, err := decode(d)
+		if err != nil {
+			return fmt.Errorf("failed to decode block data: %v", err)
+		}
+
+		var id ID
+		copy(id[:], k)
+		err = f(id, b, stk, rank)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Delete a block and its weight from the store
+func (tx *BoltTx) Delete(id ID) (err error) {
+	err = tx.btx.Bucket(boltBucketBlocks).Delete(id[:])
+	if err != nil {
+		return fmt.Errorf("failed to delete block key: %v", err)
+	}
+
+	err = tx.btx.Bucket(boltBucketWeights).Delete(id[:])
+	if err != nil {
+		return fmt.Errorf("failed to delete weight key: %v", err)
+	}
+
+	return
+}
+
+//MinRound returns the minimum round stored in the chain, rounds are stored
+//inverted so this is the last key
+func (tx *BoltTx) MinRound() (nr uint64) {
+	k, _ := tx.btx.Bucket(boltBucketBlocks).Cursor().Last()
+	if k == nil {
+		return 0
+	}
+
+	var id ID
+	copy(id[:], k)
+	return id.Round()
+}
+
+//MaxRound returns the max round that is currently stored
+func (tx *BoltTx) MaxRound() (nr uint64) {
+	k, _ := tx.btx.Bucket(boltBucketBlocks).Cursor().First()
+	if k == nil {
+		return 0
+	}
+
+	var id ID
+	copy(id[:], k)
+	return id.Round()
+}
+
+//Discard any tx resources, it is safe to call after commit
+func (tx *BoltTx) Discard() { tx.btx.Rollback() }
+
+//Commit the transaction, for read-only transactions this releases the
+//resources. Writes are serialized by bolt so it never returns ErrTxConflict.
+func (tx *BoltTx) Commit() (err error) {
+	if !tx.btx.Writable() {
+		return tx.btx.Rollback()
+	}
+
+	return tx.btx.Commit()
+}
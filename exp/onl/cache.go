@@ -0,0 +1,89 @@
+package onl
+
+import "sync"
+
+// stateCache keeps snapshots of the state at specific blocks. The state of a
+// block that descends from a snapshot can then be build by only replaying the
+// writes of the blocks in between.
+type stateCache struct {
+	max   int
+	snaps map[ID]*State
+	final ID     //most recent snapshot of a finalized block, never evicted
+	gen   uint64 //incremented when the cache is purged
+	mu    sync.RWMutex
+}
+
+func newStateCache(max int) *stateCache {
+	return &stateCache{max: max, snaps: make(map[ID]*State)}
+}
+
+// Get a snapshot of the state at block 'id'. Snapshots are shared so the caller
+// should clone it before applying any writes.
+func (sc *stateCache) Get(id ID) (s *State, ok bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	s, ok = sc.snaps[id]
+	return
+}
+
+// Gen returns the generation of the cache, it changes when it is purged
+func (sc *stateCache) Gen() uint64 {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.gen
+}
+
+// Put a snapshot of the state at block 'id'. Snapshots of finalized blocks are
+// kept until a finalized block in a later round is put. If the cache is full
+// the snapshot of the lowest round is evicted first. The snapshot is ignored
+// if the cache was purged since generation 'gen', when it was build.
+func (sc *stateCache) Put(id ID, s *State, final bool, gen uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if gen != sc.gen {
+		return
+	}
+
+	sc.snaps[id] = s
+	if final && (sc.final == NilID || id.Round() > sc.final.Round()) {
+		sc.final = id
+	}
+
+	for len(sc.snaps) > sc.max {
+		var oldest ID
+		for id := range sc.snaps {
+			if id == sc.final {
+				continue
+			}
+
+			if oldest == NilID || id.Round() < oldest.Round() {
+				oldest = id
+			}
+		}
+
+		if oldest == NilID {
+			break //only the finalized snapshot is left
+		}
+
+		delete(sc.snaps, oldest)
+	}
+}
+
+// Delete the snapshot of block 'id', if any
+func (sc *stateCache) Delete(id ID) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.snaps, id)
+	if sc.final == id {
+		sc.final = NilID
+	}
+}
+
+// Purge all snapshots, including that of the finalized block
+func (sc *stateCache) Purge() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.snaps = make(map[ID]*State)
+	sc.final = NilID
+	sc.gen++
+}
@@ -1,45 +1,63 @@
 package onl
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"sort"
 	"sync"
 	"sync/atomic"
-	"unsafe"
-
-	"github.com/dgraph-io/badger"
+	"time"
 )
 
 //Chain links blocks together and reaches consensus by keeping the chain with
 //the most weight
 type Chain struct {
 	points  uint64
+	final   float64
+	depth   uint64 //rounds between a block and its stable block
 	store   Store
+	cache   *stateCache
+	pruned  uint64 //round of the last finalized block we pruned for
 	genesis struct {
 		*Block
 		*Stakes
 		id ID
+
+		//when started from a checkpoint the genesis is the checkpoint block
+		//with its state, the recent blocks before it and the blocks that
+		//committed the token pk of each member before it
+		state    *State
+		ancestry []ID
+		tpks     map[PK]ID
+	}
+
+	//state of the tip we're on, it is build when it is first used after the
+	//tip changed
+	tstate struct {
+		*State
+		tip ID
+		mu  sync.Mutex
+	}
+
+	//state of a finalized block that is kept on disk, if any. States are build
+	//from it and it is advanced as later blocks are finalized.
+	base struct {
+		*State
+		mu sync.Mutex
 	}
 
-	//@TODO move weights to badger store
-	weights map[ID]uint64
-	wmu     sync.RWMutex
+	//subscribers to chain events
+	subs map[*Subscription]struct{}
+	smu  sync.Mutex
 
-	//state of the tip we're on
-	tstate unsafe.Pointer //*State
+	//statistics about appending blocks
+	stats *chainStats
 }
 
 //NewChain creates a new Chain
 func NewChain(s Store, genr uint64, genfs ...func(kv *KV)) (c *Chain, gen ID, err error) {
-	c = &Chain{
-		points:  1000, //@TODO make this configurable?
-		store:   s,
-		weights: make(map[ID]uint64),
-	}
-
-	//genesis prev weight is 0
-	c.weights[NilID] = 0
+	c = newChain(s)
 
 	//try to read genesis block and state
 	tx := c.store.CreateTx(true)
@@ -76,11 +94,16 @@ func NewChain(s Store, genr uint64, genfs ...func(kv *KV)) (c *Chain, gen ID, er
 
 		var deposits uint64
 		for _, genf := range genfs {
-			w := st.Update(genf)
+			w, err := st.Update(func(kv *KV) error { genf(kv); return nil })
+			if err != nil {
+				return nil, gen, fmt.Errorf("failed to apply genesis update: %v", err)
+			}
+
 			deposits += w.TotalDeposit()
 			c.genesis.Block.AppendWrite(w)
 		}
 
+		c.genesis.Block.seal()
 		c.genesis.Stakes = NewStakes(deposits) //@TODO finalize block
 
 		//write the genesis block
@@ -93,13 +116,25 @@ func NewChain(s Store, genr uint64, genfs ...func(kv *KV)) (c *Chain, gen ID, er
 		if err := tx.WriteTip(c.genesis.id, 0); err != nil {
 			return nil, gen, fmt.Errorf("failed to write genesis tip weight: %v", err)
 		}
-	}
 
-	//re-run weight calculations for the whole chain
-	//@TODO (optimization) we don't want to do this every time the system boots up
-	err = c.weigh(tx, genr)
-	if err != nil {
-		return nil, gen, fmt.Errorf("failed to weigh chain blocks: %v", err)
+		//weigh the genesis round, weights of all other blocks are persisted as
+		//they are appended so we only need to do this once.
+		err = c.weigh(tx, genr)
+		if err != nil {
+			return nil, gen, fmt.Errorf("failed to weigh genesis block: %v", err)
+		}
+	} else {
+
+		//weights are read from the store, except for stores that were written
+		//before weights were persisted. Those are weighed once, from the genesis.
+		_, err = tx.ReadWeight(c.genesis.id)
+		if err == ErrNotWeighted {
+			err = c.migrateWeights(tx)
+		}
+
+		if err != nil {
+			return nil, gen, fmt.Errorf("failed to read genesis weight: %v", err)
+		}
 	}
 
 	//commit the genesis block and tip
@@ -110,16 +145,41 @@ func NewChain(s Store, genr uint64, genfs ...func(kv *KV)) (c *Chain, gen ID, er
 	return c, c.genesis.id, nil
 }
 
+//migrateWeights weighs every round of a store that has no persisted weights,
+//the heaviest block becomes the tip again
+func (c *Chain) migrateWeights(tx Tx) (err error) {
+	err = tx.WriteTip(c.genesis.id, 0)
+	if err != nil {
+		return fmt.Errorf("failed to reset tip: %v", err)
+	}
+
+	err = c.weigh(tx, c.genesis.Round)
+	if err != nil {
+		return fmt.Errorf("failed to weigh rounds: %v", err)
+	}
+
+	return
+}
+
+func newChain(s Store) *Chain {
+	return &Chain{
+		points: 1000, //@TODO make this configurable?
+		final:  0.5,  //@TODO make this configurable?
+		depth:  10,   //@TODO make this configurable?
+		store:  s,
+		cache:  newStateCache(64),
+		subs:   make(map[*Subscription]struct{}),
+		stats:  newChainStats(),
+	}
+}
+
 //Genesis returns the genesis block
 func (c *Chain) Genesis() (b *Block) { return c.genesis.Block }
 
-// State returns the state represented by the chain walking back to the genesis.
-// If the provided id is the NilID it will create a state from the current tip.
+// State returns the state represented by the chain walking back to the nearest
+// snapshot or the genesis. If the provided id is the NilID it will create a
+// state from the current tip.
 func (c *Chain) State(id ID) (tip ID, s *State, err error) {
-
-	//@TODO (optimization) we would like to keep a cache of the state on the longest
-	//finalized chain
-
 	tx := c.store.CreateTx(false)
 	defer tx.Discard()
 	return c.state(tx, id)
@@ -139,18 +199,232 @@ func (c *Chain) state(tx Tx, id ID) (tip ID, s *State, err error) {
 		id = tip
 	}
 
-	var log [][]*Write
+	//walk back until we find a snapshot to start from, remember the most recent
+	//finalized block as a good place to take a new snapshot
+	var (
+		gen   = c.cache.Gen()
+		base  *State
+		log   []*Block
+		ids   []ID
+		final = -1
+	)
+
 	if err = c.walk(tx, id, func(id ID, bb *Block, stk *Stakes, rank *big.Int) error {
-		log = append([][]*Write{bb.Writes}, log...)
+		if snap, ok := c.cache.Get(id); ok {
+			base = snap
+			return errStopWalk
+		}
+
+		if base = c.baseState(id); base != nil {
+			return errStopWalk
+		}
+
+		if id == c.genesis.id && c.genesis.state != nil {
+			base = c.genesis.state
+			return errStopWalk
+		}
+
+		if final < 0 && stk.Sum > 0 && stk.Finalization() >= c.final {
+			final = len(log)
+		}
+
+		log = append(log, bb)
+		ids = append(ids, id)
 		return nil
-	}); err != nil {
+	}); err != nil && err != errStopWalk {
 		return NilID, nil, err
 	}
 
-	s, err = NewState(log)
-	return tip, s, err
+	if base == nil {
+		s, err = NewState(nil)
+		if err != nil {
+			return NilID, nil, err
+		}
+	} else {
+		s = base.Clone()
+	}
+
+	//replay the writes since the snapshot in chain order, they were authorized
+	//when their block was appended
+	for i := len(log) - 1; i >= 0; i-- {
+		err = replay(s, log[i])
+		if err != nil {
+			return NilID, nil, err
+		}
+
+		//the finalized state is a good place to start replaying from later on
+		if i == final {
+			c.cache.Put(ids[i], s.Clone(), true, gen)
+		}
+	}
+
+	return tip, s, nil
+}
+
+// replay the writes and the reward of block 'b' onto state 's', the writes were
+// authorized when the block was appended
+func replay(s *State, b *Block) (err error) {
+	s.Raise(b.Round)
+	for _, w := range b.Writes {
+		err = s.apply(w, false, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.reward(b)
+	if err != nil {
+		return err
+	}
+
+	s.mark(b.Round)
+	return
 }
 
+// OpenState keeps the state of a finalized block on disk in directory 'dir' such
+// that it survives restarts and can exceed memory. States are build from it and
+// it is advanced to the finalized block when the chain is pruned. A new state,
+// or one that was not closed, starts at the genesis.
+func (c *Chain) OpenState(dir string) (err error) {
+	s, err := OpenState(dir)
+	if err == ErrStateNotClosed {
+		err = removeState(dir)
+		if err != nil {
+			return fmt.Errorf("failed to remove state that was not closed: %v", err)
+		}
+
+		s, err = OpenState(dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.block == NilID && c.genesis.state != nil:
+
+		//started from a checkpoint, the disk state starts from its state
+		err = s.db.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close empty state: %v", err)
+		}
+
+		err = removeState(dir)
+		if err != nil {
+			return fmt.Errorf("failed to remove empty state: %v", err)
+		}
+
+		time, entries, nonces, err := c.genesis.state.Snapshot()
+		if err != nil {
+			return fmt.Errorf("failed to snapshot checkpoint state: %v", err)
+		}
+
+		s, err = OpenStateFromSnapshot(dir, time, entries, nonces)
+		if err != nil {
+			return err
+		}
+
+		s.restoreWatermark(c.genesis.state.watermark())
+	case s.block == NilID:
+		err = replay(s, c.genesis.Block)
+	case !c.Has(s.block):
+		err = fmt.Errorf("state is at block %s that is not in the chain", s.block)
+	}
+
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+
+	if s.block == NilID {
+		s.block = c.genesis.id
+	}
+
+	c.base.mu.Lock()
+	c.base.State = s
+	c.base.mu.Unlock()
+	c.reset()
+	return
+}
+
+// CloseState closes the state that is kept on disk, if any, such that it can be
+// opened again
+func (c *Chain) CloseState() (err error) {
+	c.base.mu.Lock()
+	defer c.base.mu.Unlock()
+	if c.base.State == nil {
+		return nil
+	}
+
+	err = c.base.Close()
+	c.base.State = nil
+	return
+}
+
+// baseState returns a copy of the state that is kept on disk if it is at block
+// 'id', or nil otherwise
+func (c *Chain) baseState(id ID) (s *State) {
+	c.base.mu.Lock()
+	defer c.base.mu.Unlock()
+	if c.base.State == nil || c.base.block != id {
+		return nil
+	}
+
+	return c.base.Clone()
+}
+
+// advance the state that is kept on disk to finalized block 'fin' by applying
+// the blocks in between, ok is true if it was advanced. If that fails the state
+// is closed without storing what it needs to be opened again, it is rebuild the
+// next time.
+func (c *Chain) advance(tx Tx, fin ID) (ok bool, err error) {
+	c.base.mu.Lock()
+	defer c.base.mu.Unlock()
+	if c.base.State == nil || fin.Round() <= c.base.block.Round() {
+		return false, nil
+	}
+
+	var log []*Block
+	if err = c.walk(tx, fin, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if id == c.base.block {
+			return errStopWalk
+		}
+
+		if id.Round() <= c.base.block.Round() {
+			return ErrTipNotFinalized //doesn't descend from the state's block
+		}
+
+		log = append(log, b)
+		return nil
+	}); err != errStopWalk {
+		return false, fmt.Errorf("failed to walk to the block of the state: %v", err)
+	}
+
+	for i := len(log) - 1; i >= 0; i-- {
+		err = replay(c.base.State, log[i])
+		if err != nil {
+			c.base.db.Close()
+			c.base.State = nil
+			return false, fmt.Errorf("failed to advance state: %v", err)
+		}
+	}
+
+	c.base.block = fin
+	return true, nil
+}
+
+// reset forgets the states that were build before, the state that is kept on
+// disk changed such that their view of it would become too old to read
+func (c *Chain) reset() {
+	c.cache.Purge()
+	c.tstate.mu.Lock()
+	c.tstate.State = nil
+	c.tstate.mu.Unlock()
+}
+
+// errStopWalk can be returned from a walk func to stop walking without error
+var errStopWalk = errors.New("stop walk")
+
 // Walk a chain from 'id' towards the genesis.
 func (c *Chain) Walk(id ID, f func(id ID, b *Block, stk *Stakes, rank *big.Int) error) (err error) {
 	tx := c.store.CreateTx(false)
@@ -181,14 +455,212 @@ func (c *Chain) walk(tx Tx, id ID, f func(id ID, b *Block, stk *Stakes, rank *bi
 	}
 }
 
+// Stable returns the block that provides the randomness for the tokens of a
+// block in round 'round' that builds on 'prev'. It is the closest ancestor of
+// prev that is at least 'depth' rounds before the round, or the genesis if
+// there is none.
+func (c *Chain) Stable(prev ID, round uint64) (stable ID, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+	return c.stable(tx, prev, round)
+}
+
+func (c *Chain) stable(tx Tx, prev ID, round uint64) (stable ID, err error) {
+	var max uint64
+	if round > c.depth {
+		max = round - c.depth
+	}
+
+	if err = c.walk(tx, prev, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		stable = id
+		if b.Round <= max {
+			return errStopWalk
+		}
+
+		return nil
+	}); err == errStopWalk {
+		return stable, nil
+	} else if err != nil {
+		return NilID, fmt.Errorf("failed to walk prev chain: %v", err)
+	}
+
+	//we started from a checkpoint, continue with the blocks before it
+	for _, id := range c.genesis.ancestry {
+		stable = id
+		if id.Round() <= max {
+			break
+		}
+	}
+
+	return stable, nil
+}
+
+// tokenPKBlock returns the last block in the chain ending at 'prev' that
+// committed the token pk of 'pk', or NilID if there is none
+func (c *Chain) tokenPKBlock(tx Tx, prev ID, pk PK) (tpkb ID, err error) {
+	if err = c.walk(tx, prev, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		for _, w := range b.Writes {
+			if w.CommitsTokenPK(pk) {
+				tpkb = id
+				return errStopWalk
+			}
+		}
+
+		return nil
+	}); err == errStopWalk {
+		return tpkb, nil
+	} else if err != nil {
+		return NilID, fmt.Errorf("failed to walk prev chain: %v", err)
+	}
+
+	return c.genesis.tpks[pk], nil
+}
+
+// checkMembership checks the leaves and releases in write 'w' of block 'b'
+// against the state before the write is applied. The stake of members that
+// are leaving is added to 'leaving', by leave round.
+func (c *Chain) checkMembership(state *State, b *Block, w *Write, leaving map[uint64]uint64) (err error) {
+	leaves := w.StakeLeaves()
+	deposits := w.StakeDeposits()
+
+	verr := state.View(func(kv *KV) {
+		for pk, round := range leaves {
+			if round < b.Round {
+				err = ErrLeaveBeforeBlock
+				return
+			}
+
+			if round-b.Round > MaxLeaveRounds {
+				err = ErrLeaveTooFarAhead
+				return
+			}
+
+			stake, _ := kv.ReadStake(pk)
+			leaving[round] += stake
+		}
+
+		for pk, amount := range deposits {
+			if amount > 0 {
+				continue //not a release
+			}
+
+			left, ok := kv.ReadLeave(pk)
+			if !ok || b.Round < left+UnbondingRounds {
+				err = ErrStakeLocked
+				return
+			}
+		}
+	})
+
+	if verr != nil {
+		return verr
+	}
+
+	return err
+}
+
 // View values from the key-value state of the current tip
-func (c *Chain) View(f func(kv *KV)) {
-	(*State)(atomic.LoadPointer(&c.tstate)).View(f)
+func (c *Chain) View(f func(kv *KV)) (err error) {
+	s, err := c.tipState()
+	if err != nil {
+		return err
+	}
+
+	return s.View(f)
 }
 
-// Update values on the key-value state of the current tip and return a new write
-func (c *Chain) Update(f func(kv *KV)) (w *Write) {
-	return (*State)(atomic.LoadPointer(&c.tstate)).Update(f)
+// tipState returns the state of the current tip. It is build when the tip
+// changed since it was last used, starting from the nearest snapshot.
+func (c *Chain) tipState() (s *State, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	c.tstate.mu.Lock()
+	defer c.tstate.mu.Unlock()
+	if c.tstate.State != nil && c.tstate.tip == tip {
+		return c.tstate.State, nil
+	}
+
+	gen := c.cache.Gen()
+	_, s, err = c.state(tx, tip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build state of tip: %v", err)
+	}
+
+	//only keep it if it wasn't build before the state on disk advanced
+	if gen == c.cache.Gen() {
+		c.tstate.State, c.tstate.tip = s, tip
+	}
+
+	return s, nil
+}
+
+// ViewAt views the key-value state as it was right after block 'id'. The
+// state is kept in the state cache, viewing nearby blocks is cheaper after.
+func (c *Chain) ViewAt(id ID, f func(kv *KV)) (err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+	return c.viewAt(tx, id, f)
+}
+
+func (c *Chain) viewAt(tx Tx, id ID, f func(kv *KV)) (err error) {
+	gen := c.cache.Gen()
+	_, s, err := c.state(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if id != NilID {
+		c.cache.Put(id, s, false, gen)
+	}
+
+	return s.View(f)
+}
+
+// ViewAtRound views the key-value state as it was in round 'round' on the
+// ancestry of the current tip. That is the state right after the latest
+// ancestor in or before the round, its id is returned.
+func (c *Chain) ViewAtRound(round uint64, f func(kv *KV)) (id ID, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return NilID, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	if err = c.walk(tx, tip, func(bid ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if b.Round <= round {
+			id = bid
+			return errStopWalk
+		}
+
+		return nil
+	}); err != nil && err != errStopWalk {
+		return NilID, fmt.Errorf("failed to walk from tip: %v", err)
+	}
+
+	if id == NilID {
+		return NilID, ErrRoundNotInChain
+	}
+
+	return id, c.viewAt(tx, id, f)
+}
+
+// Update values on the key-value state of the current tip and return a new write,
+// the error that 'f' returns is returned as is
+func (c *Chain) Update(f func(kv *KV) error) (w *Write, err error) {
+	s, err := c.tipState()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Update(f)
 }
 
 // Append a block to the chain. If an error is returned the block could not be
@@ -198,6 +670,10 @@ func (c *Chain) Update(f func(kv *KV)) (w *Write) {
 // delivered via another channel to sync up the this chain.
 func (c *Chain) Append(b *Block) (err error) {
 
+	//count and time appends for the chain statistics
+	start := time.Now()
+	defer func() { c.stats.append(err, time.Since(start)) }()
+
 	// check signature, make sure it hasn't been tampered with since signed
 	if !b.VerifySignature() {
 		return ErrInvalidSignature
@@ -208,6 +684,18 @@ func (c *Chain) Append(b *Block) (err error) {
 		return ErrZeroRound
 	}
 
+	// large blocks would bloat the store of every member
+	if b.Size() > MaxBlockSize {
+		return ErrBlockTooLarge
+	}
+
+	// writes cannot be included after the round they were valid until
+	for _, w := range b.Writes {
+		if w.Expired(b.Round) {
+			return ErrWriteExpired
+		}
+	}
+
 	// open our store tx
 	tx := c.store.CreateTx(true)
 	defer tx.Discard()
@@ -219,37 +707,33 @@ func (c *Chain) Append(b *Block) (err error) {
 		return ErrBlockExist
 	}
 
-	// prev/stable blocks
-	var (
-		stable  *Block
-		prev    *Block
-		prevStk *Stakes
-	)
-
-	// walk prev chain while storing all blocks up to the genesis a log
-	if err = c.walk(tx, b.Prev, func(id ID, bb *Block, stk *Stakes, rank *big.Int) error {
-		if b.Prev == id {
-			prev = bb
-			prevStk = stk
-		}
+	// remember the tip so we can tell subscribers if it changed
+	otip, _, err := tx.ReadTip()
+	if err != nil {
+		return fmt.Errorf("failed to read tip: %v", err)
+	}
 
-		for _, w := range bb.Writes {
-			//@TODO make sure the prev block is before the deposit block
-			if w.HasDepositFor(b.PK) {
-				stable = bb
-			}
-		}
+	// prev block must exist
+	prev, prevStk, _, err := tx.Read(b.Prev)
+	if err != nil {
+		return ErrStableNotInChain
+	}
 
-		//@TODO if both pref and deposit have been found, stop walk early
+	// stable randomness block is determined by the prev and the round
+	stable, err := c.stable(tx, b.Prev, b.Round)
+	if err != nil {
+		return ErrStableNotInChain
+	}
 
-		return nil
-	}); err != nil {
-		return fmt.Errorf("failed to walk prev chain: %v", err)
+	// the token pk must be committed at or before the stable block, else a
+	// member could pick a token pk after learning the seed
+	tpkb, err := c.tokenPKBlock(tx, b.Prev, b.PK)
+	if err != nil {
+		return fmt.Errorf("failed to find token pk commit: %v", err)
 	}
 
-	// stable randomness block must exist
-	if stable == nil {
-		return ErrStableNotInChain
+	if tpkb != NilID && tpkb.Round() > stable.Round() {
+		return ErrTokenPKNotStable
 	}
 
 	// prev timestamp must be before blocks timestamp, due to the chaining logic
@@ -276,19 +760,28 @@ func (c *Chain) Append(b *Block) (err error) {
 	}
 
 	//reconstruct the state to validate the writes in the new block
-	//@TODO we're walking again here but we would like to re-use our code also
+	gen := c.cache.Gen()
 	_, state, err := c.state(tx, b.Prev)
 	if err != nil {
 		return ErrStateReconstruction
 	}
 
 	//read dynamic data from rebuild state
-	var stake uint64
+	var stake, left uint64
 	var tpk []byte
-	state.View(func(kv *KV) {
+	var leaving bool
+	if err = state.View(func(kv *KV) {
 		stake, tpk = kv.ReadStake(b.PK)
+		left, leaving = kv.ReadLeave(b.PK)
 		// @TODO read the vrf threshold (if any)
-	})
+	}); err != nil {
+		return ErrStateReconstruction
+	}
+
+	//members that left are no longer allowed to propose
+	if leaving && b.Round >= left {
+		return ErrMemberLeft
+	}
 
 	//check if there was any token pk comitted
 	if tpk == nil {
@@ -298,7 +791,7 @@ func (c *Chain) Append(b *Block) (err error) {
 	//validate the token
 	//@TODO it takes a lot of effort to get to this validation point, can members
 	//mis-use this to ddos the network?
-	if !b.VerifyToken(tpk, stable.Hash()) {
+	if !b.VerifyToken(tpk, stable) {
 		return ErrInvalidToken
 	}
 
@@ -308,10 +801,20 @@ func (c *Chain) Append(b *Block) (err error) {
 		return ErrZeroRank
 	}
 
-	//validate each write in the block by applying them to the new state
+	//validate each write in the block by applying them to the new state, writes
+	//that read from a state too far before the block are rejected as too old
 	var deposit uint64
+	leaves := make(map[uint64]uint64)
+	state.Raise(b.Round)
 	for _, w := range b.Writes {
 
+		//members cannot leave in the past, and cannot release their stake before
+		//the unbonding period passed
+		err = c.checkMembership(state, b, w, leaves)
+		if err != nil {
+			return err
+		}
+
 		//apply the writes so we can check their validity
 		err = state.Apply(w, false)
 		if err != nil {
@@ -322,8 +825,38 @@ func (c *Chain) Append(b *Block) (err error) {
 		deposit += w.TotalDeposit()
 	}
 
-	//add the prev's total deposit to this block's deposit
-	stk := NewStakes(prevStk.Sum + deposit)
+	//the proposer is rewarded for the block and the fees of its writes
+	err = state.reward(b)
+	if err != nil {
+		return err
+	}
+
+	state.mark(b.Round)
+
+	//add the prev's total deposit to this block's deposit. Stake of members
+	//that left no longer counts towards finalization, members that leave in a
+	//later round count until then.
+	for round, stake := range prevStk.Leaving {
+		leaves[round] += stake
+	}
+
+	stk := NewStakes(0)
+	var withdrawn uint64
+	for round, stake := range leaves {
+		if round > b.Round {
+			stk.Leaving[round] = stake
+			continue
+		}
+
+		withdrawn += stake
+	}
+
+	sum := prevStk.Sum + deposit
+	if withdrawn > sum {
+		withdrawn = sum
+	}
+
+	stk.Sum = sum - withdrawn
 
 	// all is well, write the actual block with its rank
 	err = tx.Write(b, stk, rank)
@@ -338,28 +871,37 @@ func (c *Chain) Append(b *Block) (err error) {
 	//      the total points we hand out per round it it not really effective to rank them anymore
 	//@TODO (optimization) we would like to add this limit using a vrf threshold so
 	//      honest members know they don't even need to send it
-	//@TODO (optimization) we would rather not calculate the whole state again
 	err = c.weigh(tx, b.Round)
 	if err != nil {
 		return fmt.Errorf("failed to weigh rounds: %v", err)
 	}
 
 	//vote the proposer's stake on this blocks ancestory, starting with the prev
-	err = c.vote(tx, b.Prev, b.PK, stake)
+	evs, err := c.vote(tx, b.Prev, b.PK, stake)
 	if err != nil {
 		return fmt.Errorf("failed to vote on ancestory: %v", err)
 	}
 
+	tevs, err := c.tipEvents(tx, otip)
+	if err != nil {
+		return err
+	}
+
 	//finally, attempt to commit
 	err = tx.Commit()
 	if err != nil {
-		if err == badger.ErrConflict {
+		if err == ErrTxConflict {
 			return ErrAppendConflict
 		}
 
 		return fmt.Errorf("failed to commit append tx: %v", err)
 	}
 
+	//the state now represents this block, keep it so its descendants don't
+	//have to replay it
+	c.cache.Put(id, state, false, gen)
+
+	c.publish(append(tevs, evs...)...)
 	return
 }
 
@@ -371,6 +913,14 @@ func (c *Chain) Tip() (tip ID) {
 	return
 }
 
+//Has returns whether block 'id' was appended to the chain
+func (c *Chain) Has(id ID) (ok bool) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+	_, _, _, err := tx.Read(id)
+	return err == nil
+}
+
 //Read a block from the chain
 func (c *Chain) Read(id ID) (b *Block, weight uint64, f float64, err error) {
 	tx := c.store.CreateTx(false)
@@ -380,11 +930,9 @@ func (c *Chain) Read(id ID) (b *Block, weight uint64, f float64, err error) {
 		return nil, 0, 0, err
 	}
 
-	c.wmu.RLock()
-	defer c.wmu.RUnlock()
-	w, ok := c.weights[id]
-	if !ok {
-		return nil, 0, 0, ErrNotWeighted
+	w, err := tx.ReadWeight(id)
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
 	return b, w, stk.Finalization(), nil
@@ -415,12 +963,168 @@ func (c *Chain) forEach(tx Tx, start uint64, f func(id ID, b *Block, stk *Stakes
 	return
 }
 
-func (c *Chain) vote(tx Tx, id ID, pk PK, stake uint64) (err error) {
+//Range calls f for each block in the rounds from up to and including to, in
+//round order. It stops at the first error that f returns.
+func (c *Chain) Range(from, to uint64, f func(id ID, b *Block) (err error)) (err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	if max := tx.MaxRound(); to > max {
+		to = max
+	}
+
+	for rn := from; rn <= to; rn++ {
+		if err = tx.Round(rn, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+			return f(id, b)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+// Prune finds the block in the highest round that reached the provided
+// finalization and deletes all blocks in earlier rounds that are not its
+// ancestors, together with any blocks that build on them. It returns the
+// finalized block and the blocks that were pruned.
+func (c *Chain) Prune(finality float64) (fin ID, pruned []ID, err error) {
+	tx := c.store.CreateTx(true)
+	defer tx.Discard()
+
+	//earlier prunes left only ancestors of their finalized block in the rounds
+	//before it, there is no need to look at them again
+	start := atomic.LoadUint64(&c.pruned)
+	if min := tx.MinRound(); start < min {
+		start = min
+	}
+
+	//find the finalized block in the highest round
+	for rn := tx.MaxRound(); fin == NilID; rn-- {
+		if err = tx.Round(rn, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+			if stk.Sum > 0 && stk.Finalization() >= finality {
+				fin = id
+				return errStopWalk
+			}
+
+			return nil
+		}); err != nil && err != errStopWalk {
+			return NilID, nil, fmt.Errorf("failed to read blocks from round %d: %v", rn, err)
+		}
+
+		if rn <= start {
+			break
+		}
+	}
+
+	if fin == NilID || fin == c.genesis.id {
+		return fin, nil, nil //nothing finalized beyond the genesis
+	}
+
+	//pruning is only safe if the tip we're building on descends from the block
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return NilID, nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	var descends bool
+	if err = c.walk(tx, tip, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if id == fin {
+			descends = true
+		}
+
+		if id.Round() <= fin.Round() {
+			return errStopWalk
+		}
+
+		return nil
+	}); err != nil && err != errStopWalk {
+		return NilID, nil, fmt.Errorf("failed to walk from tip: %v", err)
+	}
+
+	if !descends {
+		return fin, nil, ErrTipNotFinalized
+	}
+
+	//the ancestors of the finalized block are kept
+	keep := make(map[ID]struct{})
+	if err = c.walk(tx, fin, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		keep[id] = struct{}{}
+		if id.Round() < start {
+			return errStopWalk
+		}
+
+		return nil
+	}); err != nil && err != errStopWalk {
+		return NilID, nil, fmt.Errorf("failed to walk finalized ancestors: %v", err)
+	}
+
+	//blocks in later rounds that build on pruned blocks can no longer be
+	//weighed, so they are pruned as well
+	gone := make(map[ID]struct{})
+	for rn := start; rn <= tx.MaxRound(); rn++ {
+		if err = tx.Round(rn, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+			_, kept := keep[id]
+			_, prevGone := gone[b.Prev]
+			if (rn < fin.Round() && !kept) || prevGone {
+				gone[id] = struct{}{}
+				pruned = append(pruned, id)
+			}
+
+			return nil
+		}); err != nil {
+			return NilID, nil, fmt.Errorf("failed to read blocks from round %d: %v", rn, err)
+		}
+	}
+
+	for _, id := range pruned {
+		err = tx.Delete(id)
+		if err != nil {
+			return NilID, nil, fmt.Errorf("failed to delete block %s: %v", id, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return NilID, nil, fmt.Errorf("failed to commit prune tx: %v", err)
+	}
+
+	for _, id := range pruned {
+		c.cache.Delete(id)
+	}
+
+	atomic.StoreUint64(&c.pruned, fin.Round())
+
+	//the state that is kept on disk follows the finalized block
+	rtx := c.store.CreateTx(false)
+	defer rtx.Discard()
+
+	advanced, err := c.advance(rtx, fin)
+	if err != nil {
+		return fin, pruned, err
+	}
+
+	if advanced {
+		c.reset()
+	}
+
+	return fin, pruned, nil
+}
+
+func (c *Chain) vote(tx Tx, id ID, pk PK, stake uint64) (evs []Event, err error) {
 	if err = c.walk(tx, id, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if stk.Sum == 0 {
+			stk.Votes[pk] = stake
+			return tx.Write(b, stk, rank)
+		}
+
+		//keep track of the finalization levels this vote pushes the block past
+		before := stk.Finalization()
 		stk.Votes[pk] = stake
+		evs = append(evs, finalized(id, before, stk.Finalization())...)
 		return tx.Write(b, stk, rank)
 	}); err != nil {
-		return fmt.Errorf("failed to walk: %v", err)
+		return nil, fmt.Errorf("failed to walk: %v", err)
 	}
 
 	return
@@ -431,12 +1135,29 @@ func (c *Chain) vote(tx Tx, id ID, pk PK, stake uint64) (err error) {
 func (c *Chain) Weigh(nr uint64) (err error) {
 	tx := c.store.CreateTx(true)
 	defer tx.Discard()
+
+	otip, _, err := tx.ReadTip()
+	if err != nil {
+		return fmt.Errorf("failed to read tip: %v", err)
+	}
+
 	err = c.weigh(tx, nr)
 	if err != nil {
 		return
 	}
 
-	return tx.Commit()
+	evs, err := c.tipEvents(tx, otip)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	c.publish(evs...)
+	return
 }
 
 func (c *Chain) weigh(tx Tx, nr uint64) (err error) {
@@ -467,42 +1188,42 @@ func (c *Chain) weigh(tx Tx, nr uint64) (err error) {
 		})
 
 		//now with the new pos, determine weight
-		c.wmu.Lock()
 		for i, b := range blocks {
 			w := c.points / uint64(i+1)
-			prevw, ok := c.weights[b.prev]
-			if !ok {
-				c.wmu.Unlock()
-				return fmt.Errorf("encountered a prev block '%.10x' without a weight", b.prev)
+			prevw, err := c.weight(tx, b.prev)
+			if err != nil {
+				return fmt.Errorf("encountered a prev block '%.10x' without a weight: %v", b.prev, err)
 			}
 
 			sumw := prevw + w
-			c.weights[b.id] = sumw
+			err = tx.WriteWeight(b.id, sumw)
+			if err != nil {
+				return fmt.Errorf("failed to write block weight: %v", err)
+			}
 
 			//if sum-weight heigher or equal the the current tip sum-weight use that
 			//as the new tip. By also replacing on equal we prefer newly calculated
 			//weights over the old maximum
 			if sumw >= tipw {
 
-				//write the new tip
+				//write the new tip, its state is build when it is first used
 				err = tx.WriteTip(b.id, sumw)
 				if err != nil {
 					return fmt.Errorf("failed to write new tip: %v", err)
 				}
-
-				//build state for new tip
-				_, tstate, err := c.state(tx, NilID)
-				if err != nil {
-					return fmt.Errorf("failed to re-build state from tip: %v", err)
-				}
-
-				//atomically assign the state
-				atomic.StorePointer(&c.tstate, unsafe.Pointer(tstate))
 			}
 		}
-
-		c.wmu.Unlock()
 	}
 
 	return
 }
+
+// weight returns the sum weight of a block, the (non-existing) block before the
+// genesis always has a weight of zero.
+func (c *Chain) weight(tx Tx, id ID) (w uint64, err error) {
+	if id == NilID || id == c.genesis.Prev {
+		return 0, nil
+	}
+
+	return tx.ReadWeight(id)
+}
@@ -3,7 +3,9 @@ package onl_test
 import (
 	"encoding/binary"
 	"errors"
+	"io/ioutil"
 	"math/big"
+	"os"
 	"testing"
 	"time"
 
@@ -22,7 +24,6 @@ func TestChainCreationAndGenesis(t *testing.T) {
 	c1, gen1, err := onl.NewChain(s1, 0, func(kv *onl.KV) {
 		kv.Tx.Set([]byte{0x01}, []byte{0x02})
 	})
-
 	test.Ok(t, err)
 
 	g1 := c1.Genesis()
@@ -114,6 +115,159 @@ func TestChainAppendingAndWalking(t *testing.T) {
 		_, _, _, err := c1.Read(bid4)
 		test.Equals(t, onl.ErrBlockNotExist, err)
 	})
+
+	t.Run("should not append blocks that are too large", func(t *testing.T) {
+		b3 := idn1.Mint(3, b2.Hash(), g1, 3)
+		for b3.Size() <= onl.MaxBlockSize {
+			w, err := c1.Update(func(kv *onl.KV) error {
+				kv.Set(append(gbid[:], byte(len(b3.Writes))), make([]byte, onl.MaxValueLen))
+				return nil
+			})
+
+			test.Ok(t, err)
+			b3.AppendWrite(w)
+		}
+
+		idn1.Sign(b3)
+		test.Equals(t, onl.ErrBlockTooLarge, c1.Append(b3))
+	})
+
+	t.Run("should not append blocks with expired writes", func(t *testing.T) {
+		w, err := c1.Update(func(kv *onl.KV) error { kv.Set(append(gbid[:], 0x01), []byte{0x01}); return nil })
+		test.Ok(t, err)
+		w.ValidUntil = 2
+
+		b3 := idn1.Mint(3, b2.Hash(), g1, 3)
+		b3.AppendWrite(w)
+		idn1.Sign(b3)
+		test.Equals(t, onl.ErrWriteExpired, c1.Append(b3))
+	})
+
+	t.Run("should count appended and rejected blocks", func(t *testing.T) {
+		test.Equals(t, onl.ErrBlockExist, c1.Append(b2))
+
+		stats := c1.Stats()
+		test.Equals(t, uint64(2), stats.Appended)
+		test.Equals(t, map[string]uint64{"size": 1, "writes": 1}, stats.Rejected)
+		test.Assert(t, stats.AppendSeconds > 0, "should have timed the appends")
+	})
+}
+
+func TestChainRewards(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk1 := idn1.PK()
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(pk1, 10)
+		kv.DepositStake(pk1, 1, idn1.TokenPK())
+	})
+	test.Ok(t, err)
+
+	w, err := chain.Update(func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x01), []byte{0x01}); return nil })
+	test.Ok(t, err)
+	w.PK, w.Fee = pk1, 9
+	test.Ok(t, w.GenerateNonce())
+	idn1.SignWrite(w)
+
+	//the proposer pays the fee but is credited with it and the block reward,
+	//minus the share of the treasury
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	b1.AppendWrite(w)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+
+	chain.View(func(kv *onl.KV) {
+		test.Equals(t, uint64(9), kv.AccountBalance(pk1))
+		test.Equals(t, uint64(1), kv.AccountBalance(onl.Treasury))
+	})
+
+	//supply is the genesis currency plus the block reward of every block, the
+	//fees are only moved
+	supply := func(id onl.ID) (total uint64) {
+		test.Ok(t, chain.ViewAt(id, func(kv *onl.KV) {
+			stake, _ := kv.ReadStake(pk1)
+			total = kv.AccountBalance(pk1) + stake + kv.AccountBalance(onl.Treasury)
+		}))
+
+		return
+	}
+
+	test.Equals(t, uint64(10), supply(gen))
+	test.Equals(t, 10+onl.BlockReward, supply(b1.Hash()))
+
+	t.Run("should only mint the block reward", func(t *testing.T) {
+		b2 := idn1.Mint(ts(), b1.Hash(), gen, 2)
+		idn1.Sign(b2)
+		test.Ok(t, chain.Append(b2))
+		test.Equals(t, 10+2*onl.BlockReward, supply(b2.Hash()))
+	})
+
+	t.Run("should not pay fees that exceed the balance", func(t *testing.T) {
+		w, err := chain.Update(func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x02), []byte{0x01}); return nil })
+		test.Ok(t, err)
+		w.PK, w.Fee = pk1, 10
+		test.Ok(t, w.GenerateNonce())
+		idn1.SignWrite(w)
+
+		b3 := idn1.Mint(ts(), b1.Hash(), gen, 3)
+		b3.AppendWrite(w)
+		idn1.Sign(b3)
+		test.Equals(t, onl.ErrInsufficientFunds, chain.Append(b3))
+	})
+}
+
+func TestChainWatermark(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk1 := idn1.PK()
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(pk1, 1)
+		kv.DepositStake(pk1, 1, idn1.TokenPK())
+	})
+	test.Ok(t, err)
+
+	//a write that read from the genesis state
+	w, err := chain.Update(func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x01), []byte{0x01}); return nil })
+	test.Ok(t, err)
+	w.PK = pk1
+	test.Ok(t, w.GenerateNonce())
+	idn1.SignWrite(w)
+
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+
+	mint := func(round uint64) *onl.Block {
+		stable, err := chain.Stable(b1.Hash(), round)
+		test.Ok(t, err)
+		b := idn1.Mint(ts(), b1.Hash(), stable, round)
+		b.AppendWrite(w)
+		idn1.Sign(b)
+		return b
+	}
+
+	//the watermark follows from the rounds of the blocks, not from what each
+	//member considers finalized
+	test.Equals(t, onl.ErrWriteTooOld, chain.Append(mint(1+onl.WatermarkRounds)))
+	test.Ok(t, chain.Append(mint(onl.WatermarkRounds)))
+
+	t.Run("checkpoints keep the watermark", func(t *testing.T) {
+		cp, err := chain.Checkpoint(b1.Hash())
+		test.Ok(t, err)
+		test.Equals(t, map[uint64]uint64{0: cp.Marks[0], 1: cp.Time}, cp.Marks)
+
+		d, err := cp.MarshalBinary()
+		test.Ok(t, err)
+		cp2 := &onl.Checkpoint{}
+		test.Ok(t, cp2.UnmarshalBinary(d))
+		test.Equals(t, cp.Marks, cp2.Marks)
+		test.Equals(t, cp.Low, cp2.Low)
+		test.OkEquals(t, cp.Commitment)(cp2.Hash())
+	})
 }
 
 func TestRoundWeigh(t *testing.T) {
@@ -121,7 +275,7 @@ func TestRoundWeigh(t *testing.T) {
 	defer clean()
 
 	idn1 := onl.NewIdentity([]byte{0x01})
-	idn2 := onl.NewIdentity([]byte{0x04})
+	idn2 := onl.NewIdentity([]byte{0x05})
 
 	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
 		kv.CoinbaseTransfer(idn1.PK(), 1)
@@ -166,6 +320,21 @@ func TestRoundWeigh(t *testing.T) {
 
 	test.Equals(t, b2.Hash(), chain.Tip())
 
+	t.Run("re-opened chain should read persisted weights", func(t *testing.T) {
+		chain2, gen2, err := onl.NewChain(store, 0)
+		test.Ok(t, err)
+		test.Equals(t, gen, gen2)
+		test.Equals(t, b2.Hash(), chain2.Tip())
+
+		_, w1, _, err := chain2.Read(b1.Hash())
+		test.Ok(t, err)
+		test.Equals(t, uint64(1500), w1)
+
+		_, w2, _, err := chain2.Read(b2.Hash())
+		test.Ok(t, err)
+		test.Equals(t, uint64(2000), w2)
+	})
+
 	t.Run("for each", func(t *testing.T) {
 		var saw []onl.ID
 		test.Ok(t, chain.ForEach(0, func(id onl.ID, b *onl.Block, stk *onl.Stakes) error {
@@ -179,6 +348,149 @@ func TestRoundWeigh(t *testing.T) {
 
 }
 
+//memWeightStore keeps block weights in memory, like stores did before the
+//weights were persisted
+type memWeightStore struct {
+	onl.Store
+	weights map[onl.ID]uint64
+}
+
+func (s *memWeightStore) CreateTx(writable bool) onl.Tx {
+	return &memWeightTx{s.Store.CreateTx(writable), s.weights}
+}
+
+type memWeightTx struct {
+	onl.Tx
+	weights map[onl.ID]uint64
+}
+
+func (tx *memWeightTx) WriteWeight(id onl.ID, w uint64) error {
+	tx.weights[id] = w
+	return nil
+}
+
+func (tx *memWeightTx) ReadWeight(id onl.ID) (uint64, error) {
+	w, ok := tx.weights[id]
+	if !ok {
+		return 0, onl.ErrNotWeighted
+	}
+
+	return w, nil
+}
+
+func TestChainWeightMigration(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+
+	old := &memWeightStore{Store: store, weights: make(map[onl.ID]uint64)}
+	chain, gen, err := onl.NewChain(old, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+
+	b2 := idn2.Mint(ts(), gen, gen, 1)
+	idn2.Sign(b2)
+	test.Ok(t, chain.Append(b2))
+
+	b3 := idn1.Mint(ts(), b2.Hash(), gen, 2)
+	idn1.Sign(b3)
+	test.Ok(t, chain.Append(b3))
+	test.Equals(t, b3.Hash(), chain.Tip())
+
+	//the store has blocks and a tip, but no weights
+	tx := store.CreateTx(false)
+	_, err = tx.ReadWeight(gen)
+	tx.Discard()
+	test.Equals(t, onl.ErrNotWeighted, err)
+
+	//re-opening weighs the whole chain once
+	chain2, gen2, err := onl.NewChain(store, 0)
+	test.Ok(t, err)
+	test.Equals(t, gen, gen2)
+	test.Equals(t, b3.Hash(), chain2.Tip())
+
+	for id, w := range old.weights {
+		_, w2, _, err := chain2.Read(id)
+		test.Ok(t, err)
+		test.Equals(t, w, w2)
+	}
+
+	chain2.View(func(kv *onl.KV) {
+		test.Equals(t, uint64(1), kv.AccountBalance(idn1.PK()))
+	})
+}
+
+func TestChainBaselineWeightMigration(t *testing.T) {
+	store, clean := baselineStore(t)
+	defer clean()
+
+	tx := store.CreateTx(false)
+	tip, _, err := tx.ReadTip()
+	test.Ok(t, err)
+	_, err = tx.ReadWeight(tip)
+	tx.Discard()
+	test.Equals(t, onl.ErrNotWeighted, err)
+
+	//re-opening weighs the whole chain once
+	chain, gen, err := onl.NewChain(store, 0)
+	test.Ok(t, err)
+	test.Equals(t, tip, chain.Tip())
+
+	//the same chain appended by this release is weighed the same
+	fstore, fclean := onl.TempBadgerStore()
+	defer fclean()
+
+	idn := onl.NewIdentity([]byte{0x01})
+	pk := idn.PK()
+	fchain, fgen, err := onl.NewChain(fstore, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(pk, 3)
+		kv.DepositStake(pk, 1, idn.TokenPK())
+	})
+	test.Ok(t, err)
+
+	w, err := fchain.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], 0x01), []byte{0x02}); return nil })
+	test.Ok(t, err)
+	w.PK = pk
+	test.Ok(t, w.GenerateNonce())
+	idn.SignWrite(w)
+
+	b1 := idn.Mint(1, fgen, fgen, 1)
+	b1.AppendWrite(w)
+	idn.Sign(b1)
+	test.Ok(t, fchain.Append(b1))
+
+	b2 := idn.Mint(2, b1.Hash(), fgen, 2)
+	idn.Sign(b2)
+	test.Ok(t, fchain.Append(b2))
+
+	fids := []onl.ID{b2.Hash(), b1.Hash(), fgen}
+	var ids []onl.ID
+	test.Ok(t, chain.Walk(chain.Tip(), func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+		ids = append(ids, id)
+		return nil
+	}))
+
+	test.Equals(t, len(fids), len(ids))
+	test.Equals(t, gen, ids[2])
+	for i, id := range ids {
+		_, w1, _, err := chain.Read(id)
+		test.Ok(t, err)
+		_, w2, _, err := fchain.Read(fids[i])
+		test.Ok(t, err)
+		test.Equals(t, w2, w1)
+	}
+}
+
 func tallRound(height, width uint64, t *testing.T) {
 	store, clean := onl.TempBadgerStore()
 	defer clean()
@@ -225,19 +537,23 @@ func TestChainKVOperation(t *testing.T) {
 	//create a chain with genesis deposit and coinbase
 	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
 		kv.CoinbaseTransfer(idn.PK(), 3)
-		kv.CoinbaseTransfer(idn2.PK(), 2)
+		kv.CoinbaseTransfer(idn2.PK(), 3)
 		kv.DepositStake(idn.PK(), 1, idn.TokenPK())
 	})
-
 	test.Ok(t, err)
 
-	//create a write from the current genesis tip
-	w := chain.Update(func(kv *onl.KV) {
-		kv.Set([]byte{0x01}, []byte{0x02})
-		kv.DepositStake(idn2.PK(), 2, idn.TokenPK())
+	//create a write from the current genesis tip, in the keyspace of idn2
+	pk2 := idn2.PK()
+	k := append(pk2[:], 0x01)
+	w, err := chain.Update(func(kv *onl.KV) error {
+		kv.Set(k, []byte{0x02})
+		return kv.Join(idn2.PK(), 2, idn.TokenPK())
 	})
+	test.Ok(t, err)
 
+	w.PK = idn2.PK()
 	test.Ok(t, w.GenerateNonce())
+	idn2.SignWrite(w)
 
 	//mint a block ourselves, add the write
 	b := idn.Mint(1, gen, gen, 1)
@@ -251,7 +567,7 @@ func TestChainKVOperation(t *testing.T) {
 
 	//new tip has the write incorporated
 	chain.View(func(kv *onl.KV) {
-		test.Equals(t, []byte{0x02}, kv.Get([]byte{0x01}))
+		test.Equals(t, []byte{0x02}, kv.Get(k))
 	})
 
 	//check total deposit summing
@@ -282,4 +598,645 @@ func TestChainKVOperation(t *testing.T) {
 		test.Ok(t, err)
 		test.Equals(t, 0.3333333333333333, f3)
 	})
+
+	t.Run("historical reads", func(t *testing.T) {
+		test.Ok(t, chain.ViewAt(gen, func(kv *onl.KV) {
+			test.Equals(t, []byte(nil), kv.Get(k))
+			test.Equals(t, uint64(3), kv.AccountBalance(idn2.PK()))
+		}))
+
+		test.Ok(t, chain.ViewAt(b.Hash(), func(kv *onl.KV) {
+			test.Equals(t, []byte{0x02}, kv.Get(k))
+			test.Equals(t, uint64(0), kv.AccountBalance(idn2.PK()))
+		}))
+
+		test.Equals(t, onl.ErrBlockNotExist, chain.ViewAt(bid1, func(kv *onl.KV) {}))
+
+		id, err := chain.ViewAtRound(0, func(kv *onl.KV) {
+			test.Equals(t, []byte(nil), kv.Get(k))
+		})
+
+		test.Ok(t, err)
+		test.Equals(t, gen, id)
+
+		id, err = chain.ViewAtRound(1, func(kv *onl.KV) {
+			test.Equals(t, []byte{0x02}, kv.Get(k))
+		})
+
+		test.Ok(t, err)
+		test.Equals(t, b.Hash(), id)
+
+		id, err = chain.ViewAtRound(100, func(kv *onl.KV) {})
+		test.Ok(t, err)
+		test.Equals(t, chain.Tip(), id)
+	})
+}
+
+func TestChainPruning(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x02})
+
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	//nothing is finalized beyond the genesis yet
+	_, pruned, err := chain.Prune(0.5)
+	test.Ok(t, err)
+	test.Equals(t, 0, len(pruned))
+
+	//round 1 forks in two
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+	b2 := idn2.Mint(ts(), gen, gen, 1)
+	idn2.Sign(b2)
+	test.Ok(t, chain.Append(b2))
+
+	tip1 := chain.Tip()
+	lost := b1.Hash()
+	if tip1 == lost {
+		lost = b2.Hash()
+	}
+
+	//round 2 both build on the tip, round 3 finalizes the round 2 tip
+	c1 := idn1.Mint(ts(), tip1, gen, 2)
+	idn1.Sign(c1)
+	test.Ok(t, chain.Append(c1))
+	c2 := idn2.Mint(ts(), tip1, gen, 2)
+	idn2.Sign(c2)
+	test.Ok(t, chain.Append(c2))
+
+	tip2 := chain.Tip()
+	d1 := idn1.Mint(ts(), tip2, gen, 3)
+	idn1.Sign(d1)
+	test.Ok(t, chain.Append(d1))
+
+	fin, pruned, err := chain.Prune(0.5)
+	test.Ok(t, err)
+	test.Equals(t, tip2, fin)
+	test.Equals(t, []onl.ID{lost}, pruned)
+
+	_, _, _, err = chain.Read(lost)
+	test.Equals(t, onl.ErrBlockNotExist, err)
+
+	t.Run("pruning again should do nothing", func(t *testing.T) {
+		_, pruned, err := chain.Prune(0.5)
+		test.Ok(t, err)
+		test.Equals(t, 0, len(pruned))
+	})
+
+	t.Run("chain should continue after pruning", func(t *testing.T) {
+		e1 := idn2.Mint(ts(), d1.Hash(), gen, 4)
+		idn2.Sign(e1)
+		test.Ok(t, chain.Append(e1))
+		test.Equals(t, e1.Hash(), chain.Tip())
+	})
+}
+
+func TestChainPersistentState(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	dir, err := ioutil.TempDir("", "onl_")
+	test.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	idn := onl.NewIdentity([]byte{0x01})
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn.PK(), 1)
+		kv.DepositStake(idn.PK(), 1, idn.TokenPK())
+	}
+
+	chain1, gen, err := onl.NewChain(store, 0, genf)
+	test.Ok(t, err)
+	test.Ok(t, chain1.OpenState(dir))
+
+	pk := idn.PK()
+	k := append(pk[:], 0x01)
+	w, err := chain1.Update(func(kv *onl.KV) error { kv.Set(k, []byte{0x02}); return nil })
+	test.Ok(t, err)
+	w.PK = idn.PK()
+	test.Ok(t, w.GenerateNonce())
+	idn.SignWrite(w)
+
+	b1 := idn.Mint(ts(), gen, gen, 1)
+	b1.AppendWrite(w)
+	idn.Sign(b1)
+	test.Ok(t, chain1.Append(b1))
+
+	b2 := idn.Mint(ts(), b1.Hash(), gen, 2)
+	idn.Sign(b2)
+	test.Ok(t, chain1.Append(b2))
+
+	//pruning advances the state on disk to the finalized block
+	fin, _, err := chain1.Prune(0.5)
+	test.Ok(t, err)
+	test.Equals(t, b1.Hash(), fin)
+	test.Ok(t, chain1.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(k))
+	}))
+
+	test.Ok(t, chain1.CloseState())
+
+	s, err := onl.OpenState(dir)
+	test.Ok(t, err)
+	test.Ok(t, s.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(k))
+	}))
+
+	test.Equals(t, onl.ErrAlreadyApplied, s.Apply(w, false))
+	test.Ok(t, s.Close())
+
+	t.Run("re-open", func(t *testing.T) {
+		chain2, _, err := onl.NewChain(store, 0, genf)
+		test.Ok(t, err)
+		test.Ok(t, chain2.OpenState(dir))
+		defer chain2.CloseState()
+
+		test.Equals(t, b2.Hash(), chain2.Tip())
+		test.Ok(t, chain2.View(func(kv *onl.KV) {
+			test.Equals(t, []byte{0x02}, kv.Get(k))
+		}))
+
+		//blocks continue to validate and replay on top of it
+		test.Equals(t, onl.ErrAlreadyApplied, func() error {
+			b3 := idn.Mint(ts(), b2.Hash(), gen, 3)
+			b3.AppendWrite(w)
+			idn.Sign(b3)
+			return chain2.Append(b3)
+		}())
+
+		b3 := idn.Mint(ts(), b2.Hash(), gen, 3)
+		idn.Sign(b3)
+		test.Ok(t, chain2.Append(b3))
+		test.Equals(t, b3.Hash(), chain2.Tip())
+	})
+}
+
+func TestChainCheckpointing(t *testing.T) {
+	store1, clean1 := onl.TempBadgerStore()
+	defer clean1()
+
+	idn := onl.NewIdentity([]byte{0x01})
+	chain1, gen, err := onl.NewChain(store1, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn.PK(), 1)
+		kv.DepositStake(idn.PK(), 1, idn.TokenPK())
+	})
+	test.Ok(t, err)
+
+	_, err = chain1.Finalized(0.5)
+	test.Equals(t, onl.ErrNoFinalizedBlock, err)
+
+	pk := idn.PK()
+	k := append(pk[:], 0x01)
+	w, err := chain1.Update(func(kv *onl.KV) error { kv.Set(k, []byte{0x02}); return nil })
+	test.Ok(t, err)
+	w.PK = idn.PK()
+	test.Ok(t, w.GenerateNonce())
+	idn.SignWrite(w)
+
+	b1 := idn.Mint(ts(), gen, gen, 1)
+	b1.AppendWrite(w)
+	idn.Sign(b1)
+	test.Ok(t, chain1.Append(b1))
+
+	b2 := idn.Mint(ts(), b1.Hash(), gen, 2)
+	idn.Sign(b2)
+	test.Ok(t, chain1.Append(b2))
+
+	fin, err := chain1.Finalized(0.5)
+	test.Ok(t, err)
+	test.Equals(t, b1.Hash(), fin)
+
+	cp, err := chain1.Checkpoint(fin)
+	test.Ok(t, err)
+	test.OkEquals(t, cp.Commitment)(cp.Hash())
+	test.Equals(t, gen, cp.TokenPKs[idn.PK()])
+	test.Equals(t, []onl.ID{gen}, cp.Ancestry)
+
+	store2, clean2 := onl.TempBadgerStore()
+	defer clean2()
+
+	t.Run("tampered checkpoint should fail", func(t *testing.T) {
+		cp2 := *cp
+		cp2.Sum = 100
+		_, _, err := onl.NewChainFromCheckpoint(store2, &cp2, cp.Commitment)
+		test.Equals(t, onl.ErrCheckpointCommitment, err)
+	})
+
+	t.Run("untrusted checkpoint should fail", func(t *testing.T) {
+		cp2 := *cp
+		cp2.Sum = 100
+		cp2.Commitment, err = cp2.Hash()
+		test.Ok(t, err)
+
+		_, _, err = onl.NewChainFromCheckpoint(store2, &cp2, cp.Commitment)
+		test.Equals(t, onl.ErrCheckpointNotTrusted, err)
+	})
+
+	chain2, root, err := onl.NewChainFromCheckpoint(store2, cp, cp.Commitment)
+	test.Ok(t, err)
+	test.Equals(t, fin, root)
+	test.Equals(t, fin, chain2.Tip())
+
+	chain2.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(k))
+	})
+
+	//blocks after the checkpoint should validate and replay
+	test.Ok(t, chain2.Append(b2))
+	test.Equals(t, b2.Hash(), chain2.Tip())
+
+	//writes from before the checkpoint are known to the new chain
+	test.Equals(t, onl.ErrAlreadyApplied, func() error {
+		b3 := idn.Mint(ts(), b2.Hash(), gen, 3)
+		b3.AppendWrite(w)
+		idn.Sign(b3)
+		return chain2.Append(b3)
+	}())
+
+	t.Run("keeping the checkpoint state on disk", func(t *testing.T) {
+		store3, clean3 := onl.TempBadgerStore()
+		defer clean3()
+
+		dir, err := ioutil.TempDir("", "onl_")
+		test.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		chain4, _, err := onl.NewChainFromCheckpoint(store3, cp, cp.Commitment)
+		test.Ok(t, err)
+		test.Ok(t, chain4.OpenState(dir))
+		defer chain4.CloseState()
+
+		test.Ok(t, chain4.View(func(kv *onl.KV) {
+			test.Equals(t, []byte{0x02}, kv.Get(k))
+		}))
+
+		test.Ok(t, chain4.Append(b2))
+		cp2, err := chain4.Checkpoint(fin)
+		test.Ok(t, err)
+		test.Equals(t, cp.Commitment, cp2.Commitment)
+	})
+
+	t.Run("re-opening from the checkpoint should keep the tip", func(t *testing.T) {
+		chain3, _, err := onl.NewChainFromCheckpoint(store2, cp, cp.Commitment)
+		test.Ok(t, err)
+		test.Equals(t, b2.Hash(), chain3.Tip())
+	})
+}
+
+func TestChainEvents(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	sub := chain.Subscribe(100)
+	defer sub.Close()
+
+	drain := func() (evs []onl.Event) {
+		for len(sub.C()) > 0 {
+			evs = append(evs, <-sub.C())
+		}
+
+		return
+	}
+
+	//b1 becomes the tip, the genesis gets half of the votes
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+	test.Equals(t, []onl.Event{
+		onl.TipChanged{Old: gen, New: b1.Hash()},
+		onl.Finalized{ID: gen, Level: 0.5},
+	}, drain())
+
+	//b2 out-ranks b1 in the same round (see TestRoundWeigh), causing a reorg
+	b2 := idn2.Mint(ts(), gen, gen, 1)
+	idn2.Sign(b2)
+	test.Ok(t, chain.Append(b2))
+	test.Equals(t, []onl.Event{
+		onl.TipChanged{Old: b1.Hash(), New: b2.Hash()},
+		onl.Reorg{CommonAncestor: gen, Reverted: []onl.ID{b1.Hash()}, Applied: []onl.ID{b2.Hash()}},
+		onl.Finalized{ID: gen, Level: 2.0 / 3},
+		onl.Finalized{ID: gen, Level: 1.0},
+	}, drain())
+
+	//both vote on b2, finalizing it at all levels
+	c1 := idn1.Mint(ts(), b2.Hash(), gen, 2)
+	idn1.Sign(c1)
+	test.Ok(t, chain.Append(c1))
+	test.Equals(t, []onl.Event{
+		onl.TipChanged{Old: b2.Hash(), New: c1.Hash()},
+		onl.Finalized{ID: b2.Hash(), Level: 0.5},
+	}, drain())
+
+	c2 := idn2.Mint(ts(), b2.Hash(), gen, 2)
+	idn2.Sign(c2)
+	test.Ok(t, chain.Append(c2))
+
+	var fins []onl.Event
+	for _, ev := range drain() {
+		if _, ok := ev.(onl.Finalized); ok {
+			fins = append(fins, ev)
+		}
+	}
+
+	test.Equals(t, []onl.Event{
+		onl.Finalized{ID: b2.Hash(), Level: 2.0 / 3},
+		onl.Finalized{ID: b2.Hash(), Level: 1.0},
+	}, fins)
+
+	t.Run("full buffer should drop events", func(t *testing.T) {
+		sub2 := chain.Subscribe(0)
+		defer sub2.Close()
+
+		d1 := idn1.Mint(ts(), chain.Tip(), gen, 3)
+		idn1.Sign(d1)
+		test.Ok(t, chain.Append(d1))
+		test.Assert(t, sub2.Dropped() > 0, "should have dropped events")
+	})
+
+	t.Run("blocking subscription should wait for the subscriber", func(t *testing.T) {
+		sub3 := chain.SubscribeBlocking(0)
+
+		evc := make(chan []onl.Event)
+		go func() {
+			var evs []onl.Event
+			for ev := range sub3.C() {
+				evs = append(evs, ev)
+			}
+
+			evc <- evs
+		}()
+
+		d2 := idn1.Mint(ts(), chain.Tip(), gen, 4)
+		idn1.Sign(d2)
+		test.Ok(t, chain.Append(d2))
+		sub3.Close()
+
+		evs := <-evc
+		test.Equals(t, uint64(0), sub3.Dropped())
+		test.Equals(t, onl.TipChanged{Old: d2.Prev, New: d2.Hash()}, evs[0])
+	})
+
+	t.Run("slow subscriber should not block subscribing and closing", func(t *testing.T) {
+		sub4 := chain.SubscribeBlocking(0)
+
+		errc := make(chan error)
+		go func() {
+			d3 := idn1.Mint(ts(), chain.Tip(), gen, 5)
+			idn1.Sign(d3)
+			errc <- chain.Append(d3)
+		}()
+
+		donec := make(chan struct{})
+		go func() {
+			chain.Subscribe(1).Close()
+			close(donec)
+		}()
+
+		select {
+		case <-donec:
+		case <-time.After(time.Second):
+			t.Fatal("subscribing should not wait for a slow subscriber")
+		}
+
+		//closing the slow subscription releases the append
+		sub4.Close()
+		test.Ok(t, <-errc)
+	})
+}
+
+func TestChainReorgWrites(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	pk := idn1.PK()
+	write := func(k byte) *onl.Write {
+		w, err := chain.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], k), []byte{k}); return nil })
+		test.Ok(t, err)
+		w.PK = idn1.PK()
+		test.Ok(t, w.GenerateNonce())
+		idn1.SignWrite(w)
+		return w
+	}
+
+	w1, w2, w3 := write(0x01), write(0x02), write(0x03)
+
+	//b1 has w1 and w3, b2 (which out-ranks b1) has w2 and w3
+	b1 := idn1.Mint(ts(), gen, gen, 1)
+	b1.AppendWrite(w1, w3)
+	idn1.Sign(b1)
+	test.Ok(t, chain.Append(b1))
+
+	b2 := idn2.Mint(ts(), gen, gen, 1)
+	b2.AppendWrite(w2, w3)
+	idn2.Sign(b2)
+	test.Ok(t, chain.Append(b2))
+	test.Equals(t, b2.Hash(), chain.Tip())
+
+	r, err := chain.Reorg(b1.Hash(), b2.Hash())
+	test.Ok(t, err)
+	test.Equals(t, gen, r.CommonAncestor)
+	test.Equals(t, 1, len(r.RevertedWrites))
+	test.Equals(t, w1.Nonce, r.RevertedWrites[0].Nonce)
+	test.Equals(t, 1, len(r.AppliedWrites))
+	test.Equals(t, w2.Nonce, r.AppliedWrites[0].Nonce)
+
+	chain.View(func(kv *onl.KV) {
+		test.Equals(t, []byte(nil), kv.Get(append(pk[:], 0x01)))
+		test.Equals(t, []byte{0x03}, kv.Get(append(pk[:], 0x03)))
+	})
+
+	t.Run("moving forward reverts nothing", func(t *testing.T) {
+		c1 := idn1.Mint(ts(), b2.Hash(), gen, 2)
+		idn1.Sign(c1)
+		test.Ok(t, chain.Append(c1))
+
+		r, err := chain.Reorg(b2.Hash(), c1.Hash())
+		test.Ok(t, err)
+		test.Equals(t, b2.Hash(), r.CommonAncestor)
+		test.Equals(t, 0, len(r.Reverted))
+		test.Equals(t, []onl.ID{c1.Hash()}, r.Applied)
+	})
+}
+
+func TestChainStableBlock(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 2)
+	})
+	test.Ok(t, err)
+
+	//within the first rounds the genesis is the stable block
+	stable, err := chain.Stable(gen, 1)
+	test.Ok(t, err)
+	test.Equals(t, gen, stable)
+
+	prev := gen
+	blocks := map[uint64]onl.ID{0: gen}
+	for r := uint64(1); r <= 11; r++ {
+		b := idn1.Mint(ts(), prev, stable, r)
+		if r == 11 { //idn2 deposits, and commits its token pk, late
+			w, err := chain.Update(func(kv *onl.KV) error { return kv.Join(idn2.PK(), 1, idn2.TokenPK()) })
+			test.Ok(t, err)
+			w.PK = idn2.PK()
+			test.Ok(t, w.GenerateNonce())
+			idn2.SignWrite(w)
+			b.AppendWrite(w)
+		}
+
+		idn1.Sign(b)
+		test.Ok(t, chain.Append(b))
+
+		prev = b.Hash()
+		blocks[r] = prev
+		stable, err = chain.Stable(prev, r+1)
+		test.Ok(t, err)
+	}
+
+	//the stable block is the first ancestor that is 'depth' rounds back
+	test.Equals(t, blocks[2], stable)
+
+	t.Run("genesis is no longer the stable block", func(t *testing.T) {
+		b := idn1.Mint(ts(), prev, gen, 12)
+		idn1.Sign(b)
+		test.Equals(t, onl.ErrInvalidToken, chain.Append(b))
+	})
+
+	t.Run("token pk committed after the stable block", func(t *testing.T) {
+		b := idn2.Mint(ts(), prev, stable, 12)
+		idn2.Sign(b)
+		test.Equals(t, onl.ErrTokenPKNotStable, chain.Append(b))
+	})
+
+	b := idn1.Mint(ts(), prev, stable, 12)
+	idn1.Sign(b)
+	test.Ok(t, chain.Append(b))
+}
+
+func TestChainMembership(t *testing.T) {
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+	chain, gen, err := onl.NewChain(store, 0, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	prev := gen
+	mint := func(idn *onl.Identity, r uint64, ws ...*onl.Write) *onl.Block {
+		stable, err := chain.Stable(prev, r)
+		test.Ok(t, err)
+
+		b := idn.Mint(ts(), prev, stable, r)
+		for _, w := range ws {
+			w.PK = idn2.PK() //all writes are from idn2
+			test.Ok(t, w.GenerateNonce())
+			idn2.SignWrite(w)
+			b.AppendWrite(w)
+		}
+
+		idn.Sign(b)
+		return b
+	}
+
+	t.Run("cannot leave in the past", func(t *testing.T) {
+		w, err := chain.Update(func(kv *onl.KV) error { return kv.Leave(idn2.PK(), 0) })
+		test.Ok(t, err)
+		test.Equals(t, onl.ErrLeaveBeforeBlock, chain.Append(mint(idn1, 1, w)))
+	})
+
+	t.Run("cannot leave too far ahead", func(t *testing.T) {
+		w, err := chain.Update(func(kv *onl.KV) error { return kv.Leave(idn2.PK(), 2+onl.MaxLeaveRounds) })
+		test.Ok(t, err)
+		test.Equals(t, onl.ErrLeaveTooFarAhead, chain.Append(mint(idn1, 1, w)))
+	})
+
+	sum := func(id onl.ID) uint64 {
+		tx := store.CreateTx(false)
+		defer tx.Discard()
+		_, stk, _, err := tx.Read(id)
+		test.Ok(t, err)
+		return stk.Sum
+	}
+
+	//idn2 leaves from round 2 onwards
+	w, err := chain.Update(func(kv *onl.KV) error { return kv.Leave(idn2.PK(), 2) })
+	test.Ok(t, err)
+	b1 := mint(idn1, 1, w)
+	test.Ok(t, chain.Append(b1))
+	prev = b1.Hash()
+
+	//the stake of idn2 still counts until its leave round
+	test.Equals(t, uint64(2), sum(b1.Hash()))
+
+	t.Run("blocks from members that left are ignored", func(t *testing.T) {
+		test.Equals(t, onl.ErrMemberLeft, chain.Append(mint(idn2, 2)))
+	})
+
+	t.Run("cannot release before unbonding", func(t *testing.T) {
+		w, err := chain.Update(func(kv *onl.KV) error { return kv.Release(idn2.PK(), 2+onl.UnbondingRounds) })
+		test.Ok(t, err)
+		test.Equals(t, onl.ErrStakeLocked, chain.Append(mint(idn1, 2, w)))
+	})
+
+	for r := uint64(2); r < 2+onl.UnbondingRounds; r++ {
+		b := mint(idn1, r)
+		test.Ok(t, chain.Append(b))
+		prev = b.Hash()
+	}
+
+	//from its leave round the stake of idn2 no longer counts
+	test.Equals(t, uint64(1), sum(prev))
+
+	w, err = chain.Update(func(kv *onl.KV) error { return kv.Release(idn2.PK(), 2+onl.UnbondingRounds) })
+	test.Ok(t, err)
+	test.Ok(t, chain.Append(mint(idn1, 2+onl.UnbondingRounds, w)))
+
+	chain.View(func(kv *onl.KV) {
+		stake, _ := kv.ReadStake(idn2.PK())
+		test.Equals(t, uint64(0), stake)
+		test.Equals(t, uint64(1), kv.AccountBalance(idn2.PK()))
+	})
 }
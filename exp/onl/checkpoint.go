@@ -0,0 +1,400 @@
+package onl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/advanderveer/27067dd17/onl/enc"
+	"github.com/advanderveer/27067dd17/onl/ssi"
+)
+
+// Checkpoint captures the state of the chain at a finalized block such that new
+// members can start validating blocks from there without having to download
+// and replay all the blocks that came before it.
+type Checkpoint struct {
+
+	// The finalized block that the state belongs to
+	Block *Block
+
+	// Sum of all stake deposited in the ancestory of the block, including itself
+	Sum uint64
+
+	// Stake of members that leave after the block, by leave round
+	Leaving map[uint64]uint64
+
+	// Time of the state's status oracle
+	Time uint64
+
+	// Low-watermark of the state's status oracle, and the times after recent
+	// blocks by round that it will be raised to by the blocks that follow
+	Low   uint64
+	Marks map[uint64]uint64
+
+	// All key-value entries of the state, in key order
+	Entries []*ssi.Entry
+
+	// Nonces of all writes that were applied to the state, in order
+	Nonces []Nonce
+
+	// Blocks that last committed the token pk of each member, they are needed
+	// to check that a member's token pk came before its stable block
+	TokenPKs map[PK]ID
+
+	// Blocks before the checkpoint block, newest first, that can still be the
+	// stable block for blocks that come after it
+	Ancestry []ID
+
+	// Commitment to all of the above, as returned by Hash
+	Commitment [sha256.Size]byte
+}
+
+const checkpointVersion = 3
+
+// MarshalBinary encodes the checkpoint in its canonical format, the commitment
+// is always the last part of the encoding
+func (cp *Checkpoint) MarshalBinary() (d []byte, err error) {
+	bd, err := cp.Block.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode block: %v", err)
+	}
+
+	e := enc.NewWriter(checkpointVersion)
+	e.Bytes(bd)
+	e.Uint64(cp.Sum)
+	e.Uint64(cp.Time)
+
+	e.Len(len(cp.Entries))
+	for _, ent := range cp.Entries {
+		e.Bytes(ent.K)
+		e.Bytes(ent.V)
+		e.Uint64(ent.T)
+	}
+
+	e.Len(len(cp.Nonces))
+	for _, n := range cp.Nonces {
+		e.Fixed(n[:])
+	}
+
+	pks := make([]PK, 0, len(cp.TokenPKs))
+	for pk := range cp.TokenPKs {
+		pks = append(pks, pk)
+	}
+
+	sort.Slice(pks, func(i, j int) bool {
+		return bytes.Compare(pks[i][:], pks[j][:]) < 0
+	})
+
+	e.Len(len(pks))
+	for _, pk := range pks {
+		id := cp.TokenPKs[pk]
+		e.Fixed(pk[:])
+		e.Fixed(id[:])
+	}
+
+	e.Len(len(cp.Ancestry))
+	for _, id := range cp.Ancestry {
+		e.Fixed(id[:])
+	}
+
+	encodeRounds(e, cp.Leaving)
+	e.Uint64(cp.Low)
+	encodeRounds(e, cp.Marks)
+
+	e.Fixed(cp.Commitment[:])
+	return e.Data(), nil
+}
+
+// encodeRounds encodes a map by round in order of the rounds
+func encodeRounds(e *enc.Writer, m map[uint64]uint64) {
+	rounds := make([]uint64, 0, len(m))
+	for round := range m {
+		rounds = append(rounds, round)
+	}
+
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	e.Len(len(rounds))
+	for _, round := range rounds {
+		e.Uint64(round)
+		e.Uint64(m[round])
+	}
+}
+
+// decodeRounds decodes a map that was encoded by encodeRounds, the rounds must
+// be in ascending order
+func decodeRounds(r *enc.Reader) (m map[uint64]uint64) {
+	n := r.Len()
+	m = make(map[uint64]uint64)
+	var prev uint64
+	for i := 0; i < n && r.Err() == nil; i++ {
+		round := r.Uint64()
+		if i > 0 && round <= prev {
+			r.Fail(enc.ErrNonCanonical)
+		}
+
+		m[round], prev = r.Uint64(), round
+	}
+
+	return
+}
+
+// UnmarshalBinary decodes a checkpoint that was encoded by MarshalBinary. It
+// doesn't check the commitment.
+func (cp *Checkpoint) UnmarshalBinary(d []byte) (err error) {
+	r, _ := enc.NewReader(d, checkpointVersion)
+	bd := r.Bytes()
+	cp.Sum = r.Uint64()
+	cp.Time = r.Uint64()
+
+	n := r.Len()
+	cp.Entries = nil
+	var prev []byte
+	for i := 0; i < n && r.Err() == nil; i++ {
+		ent := &ssi.Entry{K: r.Bytes(), V: r.Bytes(), T: r.Uint64()}
+		r.Ascending(prev, ent.K)
+		cp.Entries = append(cp.Entries, ent)
+		prev = ent.K
+	}
+
+	n = r.Len()
+	cp.Nonces = nil
+	prev = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var nonce Nonce
+		r.Fixed(nonce[:])
+		r.Ascending(prev, nonce[:])
+		cp.Nonces = append(cp.Nonces, nonce)
+		prev = nonce[:]
+	}
+
+	n = r.Len()
+	cp.TokenPKs = make(map[PK]ID, n)
+	prev = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var pk PK
+		var id ID
+		r.Fixed(pk[:])
+		r.Fixed(id[:])
+		r.Ascending(prev, pk[:])
+		cp.TokenPKs[pk] = id
+		prev = pk[:]
+	}
+
+	n = r.Len()
+	cp.Ancestry = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var id ID
+		r.Fixed(id[:])
+		cp.Ancestry = append(cp.Ancestry, id)
+	}
+
+	cp.Leaving = decodeRounds(r)
+	cp.Low = r.Uint64()
+	cp.Marks = decodeRounds(r)
+
+	r.Fixed(cp.Commitment[:])
+	if err = r.Done(); err != nil {
+		return err
+	}
+
+	cp.Block = &Block{}
+	return cp.Block.UnmarshalBinary(bd)
+}
+
+// Hash the checkpoint's contents, it is taken over the encoded checkpoint
+// without the commitment. New members should compare it to a hash that they
+// received from a source they trust.
+func (cp *Checkpoint) Hash() (h [sha256.Size]byte, err error) {
+	if cp.Block == nil {
+		return h, ErrCheckpointNoBlock
+	}
+
+	d, err := cp.MarshalBinary()
+	if err != nil {
+		return h, fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	return sha256.Sum256(d[:len(d)-sha256.Size]), nil
+}
+
+// NewChainFromCheckpoint creates a chain that starts from the checkpoint's block
+// instead of a genesis. Blocks before the checkpoint are never read so the
+// store only has to hold the checkpoint block and what came after it. The
+// checkpoint has to be provided each time the store is opened.
+//
+// Nothing in the checkpoint proves that its state is the state of the block,
+// therefore its hash must match the 'trusted' hash: a hash the new member got
+// from a source it trusts, for example an existing member it knows.
+func NewChainFromCheckpoint(s Store, cp *Checkpoint, trusted [sha256.Size]byte) (c *Chain, root ID, err error) {
+	h, err := cp.Hash()
+	if err != nil {
+		return nil, root, err
+	}
+
+	if h != cp.Commitment {
+		return nil, root, ErrCheckpointCommitment
+	}
+
+	if h != trusted {
+		return nil, root, ErrCheckpointNotTrusted
+	}
+
+	if cp.Block.Prev != NilID && !cp.Block.VerifySignature() {
+		return nil, root, ErrInvalidSignature
+	}
+
+	c = newChain(s)
+	c.genesis.Block = cp.Block
+	c.genesis.Stakes = NewStakes(cp.Sum)
+	for round, stake := range cp.Leaving {
+		c.genesis.Stakes.Leaving[round] = stake
+	}
+	c.genesis.id = cp.Block.Hash()
+	c.genesis.state = NewStateFromSnapshot(cp.Time, cp.Entries, cp.Nonces)
+	c.genesis.state.restoreWatermark(cp.Low, cp.Marks)
+	c.genesis.ancestry = append([]ID(nil), cp.Ancestry...)
+	c.genesis.tpks = make(map[PK]ID, len(cp.TokenPKs))
+	for pk, id := range cp.TokenPKs {
+		c.genesis.tpks[pk] = id
+	}
+
+	tx := c.store.CreateTx(true)
+	defer tx.Discard()
+
+	_, _, _, err = tx.Read(c.genesis.id)
+	switch err {
+	case ErrBlockNotExist:
+
+		//write the checkpoint block as if it was the genesis
+		if err = tx.Write(c.genesis.Block, c.genesis.Stakes, big.NewInt(1)); err != nil {
+			return nil, root, fmt.Errorf("failed to write checkpoint block: %v", err)
+		}
+
+		if err = tx.WriteTip(c.genesis.id, 0); err != nil {
+			return nil, root, fmt.Errorf("failed to write checkpoint tip weight: %v", err)
+		}
+
+		if err = c.weigh(tx, c.genesis.Round); err != nil {
+			return nil, root, fmt.Errorf("failed to weigh checkpoint block: %v", err)
+		}
+	case nil:
+		//re-opened, weights and tip were persisted
+	default:
+		return nil, root, fmt.Errorf("failed to read checkpoint block: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, root, fmt.Errorf("failed to commit writing of checkpoint block: %v", err)
+	}
+
+	return c, c.genesis.id, nil
+}
+
+// Finalized walks back from the tip and returns the first block that reached
+// the provided finalization.
+func (c *Chain) Finalized(finality float64) (id ID, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return NilID, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	if err = c.walk(tx, tip, func(bid ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if stk.Sum > 0 && stk.Finalization() >= finality {
+			id = bid
+			return errStopWalk
+		}
+
+		return nil
+	}); err != nil && err != errStopWalk {
+		return NilID, fmt.Errorf("failed to walk from tip: %v", err)
+	}
+
+	if id == NilID {
+		return NilID, ErrNoFinalizedBlock
+	}
+
+	return id, nil
+}
+
+// Checkpoint creates a checkpoint of the state at block 'id'. It should only be
+// used for blocks that are finalized.
+func (c *Chain) Checkpoint(id ID) (cp *Checkpoint, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	b, stk, _, err := tx.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, state, err := c.state(tx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build state: %v", err)
+	}
+
+	cp = &Checkpoint{Block: b, Sum: stk.Sum, Leaving: stk.Leaving, TokenPKs: make(map[PK]ID)}
+	cp.Time, cp.Entries, cp.Nonces, err = state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	cp.Low, cp.Marks = state.watermark()
+
+	//blocks after the checkpoint may pick a stable block up to 'depth' rounds
+	//before it, remember those in the checkpoint's ancestry
+	var min uint64
+	if b.Round > c.depth {
+		min = b.Round - c.depth
+	}
+
+	done := false
+	if err = c.walk(tx, id, func(bid ID, bb *Block, stk *Stakes, rank *big.Int) error {
+		if bid != id && !done {
+			cp.Ancestry = append(cp.Ancestry, bid)
+			done = bb.Round <= min
+		}
+
+		//walking back, the latest token pk commit of a member is kept
+		for _, w := range bb.Writes {
+			for _, wr := range w.TxData.WriteRows {
+				if len(wr.K) != 32+len(tpkKey) || !bytes.Equal(wr.K[32:], []byte(tpkKey)) {
+					continue
+				}
+
+				var pk PK
+				copy(pk[:], wr.K[:32])
+				if _, ok := cp.TokenPKs[pk]; !ok {
+					cp.TokenPKs[pk] = bid
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk token pks: %v", err)
+	}
+
+	//we were started from a checkpoint ourselves, continue with its history
+	for _, aid := range c.genesis.ancestry {
+		if done {
+			break
+		}
+
+		cp.Ancestry = append(cp.Ancestry, aid)
+		done = aid.Round() <= min
+	}
+
+	for pk, bid := range c.genesis.tpks {
+		if _, ok := cp.TokenPKs[pk]; !ok {
+			cp.TokenPKs[pk] = bid
+		}
+	}
+
+	cp.Commitment, err = cp.Hash()
+	return
+}
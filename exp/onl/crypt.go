@@ -0,0 +1,213 @@
+package onl
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/advanderveer/27067dd17/vrf/ed25519/extra25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	dataKeyVersionKey = "_dkv" //current version of the owner's data key
+	dataKeyPrefix     = "_dk/" //data key versions, sealed for each reader
+)
+
+// CryptKV encrypts values before they are written to the key-value store and
+// decrypts them when they are read, such that only the owner and the readers
+// it shared its data key with can read them. Values are encrypted with a
+// random data key of the owner, the data key is stored in the owner's keyspace
+// once for each reader: encrypted with keys derived from their identities.
+type CryptKV struct {
+	kv    *KV
+	idn   *Identity
+	owner PK
+}
+
+// Crypt returns an encryption layer over the key-value store, values are read
+// and written for the 'owner' of the data key by identity 'idn'. Only the
+// owner itself can write values and manage its data keys.
+func (kv *KV) Crypt(idn *Identity, owner PK) *CryptKV {
+	return &CryptKV{kv: kv, idn: idn, owner: owner}
+}
+
+// Set encrypts value 'v' with the current data key and writes it to key 'k'.
+// If the owner has no data key yet, one is created that is only shared with
+// itself.
+func (ckv *CryptKV) Set(k, v []byte) (err error) {
+	if ckv.idn.PK() != ckv.owner {
+		return ErrNotDataKeyOwner
+	}
+
+	version := ckv.Version()
+	if version < 1 {
+		err = ckv.Rotate()
+		if err != nil {
+			return err
+		}
+
+		version = ckv.Version()
+	}
+
+	dk, err := ckv.dataKey(version)
+	if err != nil {
+		return err
+	}
+
+	//versioned so the value can be decrypted after the data key rotated
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	ev := make([]byte, 8, 8+len(nonce)+secretbox.Overhead+len(v))
+	binary.BigEndian.PutUint64(ev, version)
+	ev = append(ev, nonce[:]...)
+	ckv.kv.Set(k, secretbox.Seal(ev, v, &nonce, dk))
+	return nil
+}
+
+// Get reads the value at key 'k' and decrypts it, it returns nil if the key
+// doesn't exist.
+func (ckv *CryptKV) Get(k []byte) (v []byte, err error) {
+	ev := ckv.kv.Get(k)
+	if ev == nil {
+		return nil, nil
+	}
+
+	if len(ev) < 8+24+secretbox.Overhead {
+		return nil, ErrDecryptValue
+	}
+
+	dk, err := ckv.dataKey(binary.BigEndian.Uint64(ev))
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ev[8:])
+	v, ok := secretbox.Open(nil, ev[8+24:], &nonce, dk)
+	if !ok {
+		return nil, ErrDecryptValue
+	}
+
+	if v == nil {
+		v = []byte{} //the value exists, but is empty
+	}
+
+	return v, nil
+}
+
+// Version returns the version of the owner's current data key, it is zero if
+// the owner has no data key yet.
+func (ckv *CryptKV) Version() (version uint64) {
+	v := ckv.kv.Get(append(ckv.owner[:], []byte(dataKeyVersionKey)...))
+	if len(v) < 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(v)
+}
+
+// Rotate creates a new data key that is shared with the owner and the provided
+// readers, new values will be encrypted with it. Values that were encrypted
+// with earlier data keys can still be read by those who had access to them.
+func (ckv *CryptKV) Rotate(readers ...PK) (err error) {
+	if ckv.idn.PK() != ckv.owner {
+		return ErrNotDataKeyOwner
+	}
+
+	var dk [32]byte
+	_, err = rand.Read(dk[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	version := ckv.Version() + 1
+	for _, pk := range append([]PK{ckv.owner}, readers...) {
+		err = ckv.seal(version, &dk, pk)
+		if err != nil {
+			return err
+		}
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, version)
+	ckv.kv.Set(append(ckv.owner[:], []byte(dataKeyVersionKey)...), v)
+	return nil
+}
+
+// Share gives 'reader' access to the values that were encrypted with the
+// current data key, and those that will be until it is rotated. It does so by
+// re-encrypting the data key for the reader.
+func (ckv *CryptKV) Share(reader PK) (err error) {
+	if ckv.idn.PK() != ckv.owner {
+		return ErrNotDataKeyOwner
+	}
+
+	version := ckv.Version()
+	dk, err := ckv.dataKey(version)
+	if err != nil {
+		return err
+	}
+
+	return ckv.seal(version, dk, reader)
+}
+
+// seal the data key of 'version' for 'reader' and store it
+func (ckv *CryptKV) seal(version uint64, dk *[32]byte, reader PK) (err error) {
+	rpk, ok := curvePK(reader)
+	if !ok {
+		return ErrInvalidReaderPK
+	}
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	ckv.kv.Set(dkkey(ckv.owner, version, reader), box.Seal(nonce[:], dk[:], &nonce, rpk, ckv.idn.curveSK()))
+	return nil
+}
+
+// dataKey opens the data key of 'version' that was shared with our identity
+func (ckv *CryptKV) dataKey(version uint64) (dk *[32]byte, err error) {
+	sealed := ckv.kv.Get(dkkey(ckv.owner, version, ckv.idn.PK()))
+	if len(sealed) < 24+box.Overhead {
+		return nil, ErrNoDataKey
+	}
+
+	opk, ok := curvePK(ckv.owner)
+	if !ok {
+		return nil, ErrNoDataKey
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	d, ok := box.Open(nil, sealed[24:], &nonce, opk, ckv.idn.curveSK())
+	if !ok || len(d) != 32 {
+		return nil, ErrNoDataKey
+	}
+
+	dk = new([32]byte)
+	copy(dk[:], d)
+	return dk, nil
+}
+
+// curvePK converts an identity's signing key to a key it can decrypt with
+func curvePK(pk PK) (cpk *[32]byte, ok bool) {
+	cpk = new([32]byte)
+	epk := [32]byte(pk)
+	return cpk, extra25519.PublicKeyToCurve25519(cpk, &epk)
+}
+
+func dkkey(owner PK, version uint64, reader PK) (k []byte) {
+	k = append(owner[:], []byte(dataKeyPrefix)...)
+	k = append(k, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(k[len(k)-8:], version)
+	return append(k, reader[:]...)
+}
@@ -0,0 +1,88 @@
+package onl_test
+
+import (
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/go-test"
+)
+
+func TestCryptKV(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x02})
+	pk1, pk2 := idn1.PK(), idn2.PK()
+	k1, k2, k3 := append(pk1[:], 0x01), append(pk1[:], 0x02), append(pk1[:], 0x03)
+
+	st1, err := onl.NewState(nil)
+	test.Ok(t, err)
+	w, err := st1.Update(func(kv *onl.KV) error {
+		ckv1 := kv.Crypt(idn1, pk1)
+		ckv2 := kv.Crypt(idn2, pk1)
+
+		//first write creates the data key
+		test.Equals(t, uint64(0), ckv1.Version())
+		test.Ok(t, ckv1.Set(k1, []byte("hello")))
+		test.Equals(t, uint64(1), ckv1.Version())
+		test.Assert(t, string(kv.Get(k1)) != "hello", "value should be encrypted")
+
+		v, err := ckv1.Get(k1)
+		test.Ok(t, err)
+		test.Equals(t, []byte("hello"), v)
+
+		v, err = ckv1.Get(k3)
+		test.Ok(t, err)
+		test.Equals(t, []byte(nil), v)
+
+		test.Ok(t, ckv1.Set(k3, nil))
+		v, err = ckv1.Get(k3)
+		test.Ok(t, err)
+		test.Equals(t, []byte{}, v)
+
+		//readers need the data key to be shared, and can't write
+		_, err = ckv2.Get(k1)
+		test.Equals(t, onl.ErrNoDataKey, err)
+		test.Equals(t, onl.ErrNotDataKeyOwner, ckv2.Set(k1, []byte("bye")))
+		test.Equals(t, onl.ErrNotDataKeyOwner, ckv2.Share(pk2))
+
+		test.Ok(t, ckv1.Share(pk2))
+		v, err = ckv2.Get(k1)
+		test.Ok(t, err)
+		test.Equals(t, []byte("hello"), v)
+
+		//after rotating without the reader it can only read older values
+		test.Ok(t, ckv1.Rotate())
+		test.Equals(t, uint64(2), ckv1.Version())
+		test.Ok(t, ckv1.Set(k2, []byte("secret")))
+
+		_, err = ckv2.Get(k2)
+		test.Equals(t, onl.ErrNoDataKey, err)
+		v, err = ckv2.Get(k1)
+		test.Ok(t, err)
+		test.Equals(t, []byte("hello"), v)
+
+		v, err = ckv1.Get(k2)
+		test.Ok(t, err)
+		test.Equals(t, []byte("secret"), v)
+
+		//rotating with the reader shares the new key
+		test.Ok(t, ckv1.Rotate(pk2))
+		test.Ok(t, ckv1.Set(k2, []byte("secret")))
+		v, err = ckv2.Get(k2)
+		test.Ok(t, err)
+		test.Equals(t, []byte("secret"), v)
+
+		//tampered values fail to decrypt
+		kv.Set(k3, append(kv.Get(k1), 0x01))
+		_, err = ckv1.Get(k3)
+		test.Equals(t, onl.ErrDecryptValue, err)
+		return nil
+	})
+
+	test.Ok(t, err)
+
+	//all data keys and values are in the keyspace of the owner
+	w.PK = pk1
+	test.Ok(t, w.GenerateNonce())
+	idn1.SignWrite(w)
+	test.Ok(t, st1.Apply(w, false))
+}
@@ -0,0 +1,179 @@
+// Package enc implements the primitives of the canonical binary format that is
+// used to store, transmit and hash protocol data. Every encoded value starts
+// with a single version byte, integers are 8 byte big-endian, variable length
+// byte slices and collections are prefixed with a 4 byte big-endian length and
+// fixed-size arrays are written as-is. Collections that have no natural order
+// (maps) are written sorted by their key such that each value has exactly one
+// encoding.
+package enc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+//Writer appends values to a buffer in the canonical format
+type Writer struct {
+	buf []byte
+}
+
+//NewWriter starts a new encoding with the provided format version
+func NewWriter(version byte) (w *Writer) {
+	return &Writer{buf: []byte{version}}
+}
+
+//Uint64 writes an 8 byte big-endian integer
+func (w *Writer) Uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+//Float64 writes the IEEE 754 bits of a float
+func (w *Writer) Float64(v float64) { w.Uint64(math.Float64bits(v)) }
+
+//Len writes the length of a collection or byte slice
+func (w *Writer) Len(n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	w.buf = append(w.buf, b[:]...)
+}
+
+//Bytes writes a length prefixed byte slice
+func (w *Writer) Bytes(b []byte) {
+	w.Len(len(b))
+	w.buf = append(w.buf, b...)
+}
+
+//Fixed writes the bytes of a fixed size value without a length prefix
+func (w *Writer) Fixed(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+//Data returns the encoded bytes
+func (w *Writer) Data() []byte { return w.buf }
+
+//Reader reads values in the canonical format. Errors are sticky: once a read
+//failed all subsequent reads return zero values and Err returns the first error
+type Reader struct {
+	d   []byte
+	err error
+}
+
+//NewReader reads the version byte and checks it against the supported versions
+func NewReader(d []byte, versions ...byte) (r *Reader, version byte) {
+	r = &Reader{d: d}
+	if len(d) < 1 {
+		r.err = ErrShortBuffer
+		return
+	}
+
+	version, r.d = d[0], d[1:]
+	for _, v := range versions {
+		if v == version {
+			return
+		}
+	}
+
+	r.err = ErrUnsupportedVersion
+	return
+}
+
+func (r *Reader) next(n int) (b []byte) {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(r.d) < n {
+		r.err = ErrShortBuffer
+		return nil
+	}
+
+	b, r.d = r.d[:n], r.d[n:]
+	return
+}
+
+//Uint64 reads an 8 byte big-endian integer
+func (r *Reader) Uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+//Float64 reads the IEEE 754 bits of a float
+func (r *Reader) Float64() float64 { return math.Float64frombits(r.Uint64()) }
+
+//Len reads the length of a collection or byte slice. Each element takes at
+//least one byte so a length that exceeds the remaining data is rejected before
+//anything is allocated for it.
+func (r *Reader) Len() int {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+
+	n := int(binary.BigEndian.Uint32(b))
+	if n > len(r.d) {
+		r.err = ErrShortBuffer
+		return 0
+	}
+
+	return n
+}
+
+//Bytes reads a length prefixed byte slice, the result is a copy. An empty
+//slice is returned as nil.
+func (r *Reader) Bytes() []byte {
+	n := r.Len()
+	b := r.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+//Fixed reads len(dst) bytes into dst
+func (r *Reader) Fixed(dst []byte) {
+	b := r.next(len(dst))
+	if b == nil {
+		return
+	}
+
+	copy(dst, b)
+}
+
+//Ascending checks that 'cur' sorts strictly after 'prev', it is used to only
+//accept map entries in their canonical order
+func (r *Reader) Ascending(prev, cur []byte) {
+	if r.err == nil && prev != nil && bytes.Compare(prev, cur) >= 0 {
+		r.err = ErrNonCanonical
+	}
+}
+
+//Fail records an error that occurred while decoding a nested value
+func (r *Reader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+//Err returns the first error that was encountered while reading
+func (r *Reader) Err() error { return r.err }
+
+//Done returns the first read error or ErrTrailingData if not all data was read
+func (r *Reader) Done() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if len(r.d) > 0 {
+		return ErrTrailingData
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package enc_test
+
+import (
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl/enc"
+	"github.com/advanderveer/go-test"
+)
+
+func TestWriteRead(t *testing.T) {
+	w := enc.NewWriter(2)
+	w.Uint64(42)
+	w.Float64(0.5)
+	w.Bytes([]byte("foo"))
+	w.Bytes(nil)
+	w.Fixed([]byte{0x01, 0x02})
+	test.Equals(t, 1+8+8+4+3+4+2, len(w.Data()))
+
+	r, v := enc.NewReader(w.Data(), 1, 2)
+	test.Equals(t, byte(2), v)
+	test.Equals(t, uint64(42), r.Uint64())
+	test.Equals(t, 0.5, r.Float64())
+	test.Equals(t, []byte("foo"), r.Bytes())
+	test.Equals(t, []byte(nil), r.Bytes())
+
+	fixed := make([]byte, 2)
+	r.Fixed(fixed)
+	test.Equals(t, []byte{0x01, 0x02}, fixed)
+	test.Ok(t, r.Done())
+
+	t.Run("unsupported version", func(t *testing.T) {
+		r, _ := enc.NewReader(w.Data(), 1)
+		test.Equals(t, enc.ErrUnsupportedVersion, r.Done())
+	})
+
+	t.Run("short data", func(t *testing.T) {
+		r, _ := enc.NewReader(w.Data()[:10], 2)
+		r.Uint64()
+		test.Equals(t, uint64(0), r.Uint64())
+		test.Equals(t, enc.ErrShortBuffer, r.Done())
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		r, _ := enc.NewReader(w.Data(), 2)
+		r.Uint64()
+		test.Equals(t, enc.ErrTrailingData, r.Done())
+	})
+
+	t.Run("length exceeds data", func(t *testing.T) {
+		w := enc.NewWriter(1)
+		w.Len(1 << 30)
+		r, _ := enc.NewReader(w.Data(), 1)
+		test.Equals(t, 0, r.Len())
+		test.Equals(t, enc.ErrShortBuffer, r.Err())
+	})
+
+	t.Run("non canonical order", func(t *testing.T) {
+		r, _ := enc.NewReader([]byte{1}, 1)
+		r.Ascending(nil, []byte{0x02})
+		r.Ascending([]byte{0x01}, []byte{0x02})
+		test.Ok(t, r.Err())
+		r.Ascending([]byte{0x02}, []byte{0x02})
+		test.Equals(t, enc.ErrNonCanonical, r.Err())
+	})
+}
@@ -0,0 +1,19 @@
+package enc
+
+import "errors"
+
+var (
+	//ErrShortBuffer is returned when the data ended before a value could be read
+	ErrShortBuffer = errors.New("enc: data is too short")
+
+	//ErrTrailingData is returned when data remained after all values were read
+	ErrTrailingData = errors.New("enc: unexpected trailing data")
+
+	//ErrUnsupportedVersion is returned when the data was encoded in a format
+	//version that this implementation doesn't know about
+	ErrUnsupportedVersion = errors.New("enc: unsupported format version")
+
+	//ErrNonCanonical is returned when the data decodes but isn't in its one
+	//canonical form, e.g map entries that are not sorted
+	ErrNonCanonical = errors.New("enc: data is not canonically encoded")
+)
@@ -1,7 +1,10 @@
 package engine
 
 import (
+	"fmt"
+
 	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/27067dd17/onl/enc"
 )
 
 //Msg transports information over the broadcast network.
@@ -9,12 +12,165 @@ type Msg struct {
 	Block *onl.Block
 	Write *onl.Write
 	Sync  *Sync
+
+	CheckpointReq *CheckpointReq
+	Checkpoint    *onl.Checkpoint
+
+	SyncRounds *SyncRounds
+	HeadersReq *HeadersReq
+	Headers    Headers
+
+	//peer and wf are set (decorated) by the broadcast layer
+	peer string
+	wf   func(msg *Msg) (err error)
+}
+
+//SetPeer sets the peer the message was read from
+func (msg *Msg) SetPeer(peer string) { msg.peer = peer }
+
+//Peer returns the peer the message was read from, it is empty for messages
+//that didn't come from the broadcast
+func (msg *Msg) Peer() string { return msg.peer }
+
+//SetWF sets the function that writes to the peer the message was read from,
+//it is set for headers such that the blocks can be requested from that peer
+func (msg *Msg) SetWF(f func(msg *Msg) (err error)) { msg.wf = f }
+
+//CanReply returns whether messages can be written to the peer the message was
+//read from
+func (msg *Msg) CanReply() bool { return msg.wf != nil }
+
+//Reply writes a message to the peer the message was read from
+func (msg *Msg) Reply(rmsg *Msg) (err error) {
+	if msg.wf == nil {
+		panic("reply without write function")
+	}
+
+	return msg.wf(rmsg)
+}
+
+const (
+	msgVersion = 1
+
+	msgTagBlock         = 0x01
+	msgTagWrite         = 0x02
+	msgTagSync          = 0x03
+	msgTagCheckpointReq = 0x04
+	msgTagCheckpoint    = 0x05
+	msgTagSyncRounds    = 0x06
+	msgTagHeadersReq    = 0x07
+	msgTagHeaders       = 0x08
+)
+
+// MarshalBinary encodes the message canonically as a list of tagged fields in
+// order of their tag, only fields that are set are encoded.
+func (msg *Msg) MarshalBinary() (d []byte, err error) {
+	type field struct {
+		tag byte
+		v   interface{ MarshalBinary() ([]byte, error) }
+	}
+
+	var fields []field
+	if msg.Block != nil {
+		fields = append(fields, field{msgTagBlock, msg.Block})
+	}
+
+	if msg.Write != nil {
+		fields = append(fields, field{msgTagWrite, msg.Write})
+	}
+
+	if msg.Sync != nil {
+		fields = append(fields, field{msgTagSync, msg.Sync})
+	}
+
+	if msg.CheckpointReq != nil {
+		fields = append(fields, field{msgTagCheckpointReq, msg.CheckpointReq})
+	}
+
+	if msg.Checkpoint != nil {
+		fields = append(fields, field{msgTagCheckpoint, msg.Checkpoint})
+	}
+
+	if msg.SyncRounds != nil {
+		fields = append(fields, field{msgTagSyncRounds, msg.SyncRounds})
+	}
+
+	if msg.HeadersReq != nil {
+		fields = append(fields, field{msgTagHeadersReq, msg.HeadersReq})
+	}
+
+	if msg.Headers != nil {
+		fields = append(fields, field{msgTagHeaders, msg.Headers})
+	}
+
+	e := enc.NewWriter(msgVersion)
+	e.Len(len(fields))
+	for _, f := range fields {
+		fd, err := f.v.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode message field %d: %v", f.tag, err)
+		}
+
+		e.Fixed([]byte{f.tag})
+		e.Bytes(fd)
+	}
+
+	return e.Data(), nil
+}
+
+// UnmarshalBinary decodes a message that was encoded by MarshalBinary, fields
+// with a tag that is unknown to this version are skipped.
+func (msg *Msg) UnmarshalBinary(d []byte) (err error) {
+	r, _ := enc.NewReader(d, msgVersion)
+	n := r.Len()
+
+	var prev []byte
+	for i := 0; i < n && r.Err() == nil; i++ {
+		tag := make([]byte, 1)
+		r.Fixed(tag)
+		r.Ascending(prev, tag)
+		prev = tag
+
+		fd := r.Bytes()
+		if r.Err() != nil {
+			break
+		}
+
+		switch tag[0] {
+		case msgTagBlock:
+			msg.Block = &onl.Block{}
+			r.Fail(msg.Block.UnmarshalBinary(fd))
+		case msgTagWrite:
+			msg.Write = &onl.Write{}
+			r.Fail(msg.Write.UnmarshalBinary(fd))
+		case msgTagSync:
+			msg.Sync = &Sync{}
+			r.Fail(msg.Sync.UnmarshalBinary(fd))
+		case msgTagCheckpointReq:
+			msg.CheckpointReq = &CheckpointReq{}
+			r.Fail(msg.CheckpointReq.UnmarshalBinary(fd))
+		case msgTagCheckpoint:
+			msg.Checkpoint = &onl.Checkpoint{}
+			r.Fail(msg.Checkpoint.UnmarshalBinary(fd))
+		case msgTagSyncRounds:
+			msg.SyncRounds = &SyncRounds{}
+			r.Fail(msg.SyncRounds.UnmarshalBinary(fd))
+		case msgTagHeadersReq:
+			msg.HeadersReq = &HeadersReq{}
+			r.Fail(msg.HeadersReq.UnmarshalBinary(fd))
+		case msgTagHeaders:
+			msg.Headers = Headers{}
+			r.Fail(msg.Headers.UnmarshalBinary(fd))
+		}
+	}
+
+	return r.Done()
 }
 
 // Dependency returns what block this message is dependant on the before it can
 // be handled (if any).
 func (msg *Msg) Dependency() (dep onl.ID, round uint64) {
-	if msg.Write != nil || msg.Block == nil {
+	if msg.Write != nil || msg.Block == nil || msg.Checkpoint != nil {
 		return onl.NilID, 0
 	}
 
@@ -29,6 +185,33 @@ type Sync struct {
 	wf func(b *onl.Block) (err error)
 }
 
+const syncVersion = 1
+
+//MarshalBinary encodes the sync request
+func (r *Sync) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(syncVersion)
+	e.Len(len(r.IDs))
+	for _, id := range r.IDs {
+		e.Fixed(id[:])
+	}
+
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes the sync request
+func (r *Sync) UnmarshalBinary(d []byte) (err error) {
+	rd, _ := enc.NewReader(d, syncVersion)
+	n := rd.Len()
+	r.IDs = nil
+	for i := 0; i < n && rd.Err() == nil; i++ {
+		var id onl.ID
+		rd.Fixed(id[:])
+		r.IDs = append(r.IDs, id)
+	}
+
+	return rd.Done()
+}
+
 //SetWF sets the return write function
 func (r *Sync) SetWF(f func(b *onl.Block) (err error)) { r.wf = f }
 
@@ -41,6 +224,177 @@ func (r *Sync) Push(b *onl.Block) (err error) {
 	return r.wf(b)
 }
 
+// CheckpointReq is send to peers when a member wants to bootstrap from the
+// state at a finalized block instead of syncing from the genesis. If Block is
+// set peers respond with the checkpoint at that block, else at their latest
+// block with the finality.
+type CheckpointReq struct {
+	Finality float64
+	Block    onl.ID
+
+	//wf is set (decorated) by the broadcast layer
+	wf func(cp *onl.Checkpoint) (err error)
+}
+
+const checkpointReqVersion = 2
+
+//MarshalBinary encodes the checkpoint request
+func (r *CheckpointReq) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(checkpointReqVersion)
+	e.Float64(r.Finality)
+	e.Fixed(r.Block[:])
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes the checkpoint request
+func (r *CheckpointReq) UnmarshalBinary(d []byte) (err error) {
+	rd, _ := enc.NewReader(d, checkpointReqVersion)
+	r.Finality = rd.Float64()
+	rd.Fixed(r.Block[:])
+	return rd.Done()
+}
+
+//SetWF sets the return write function
+func (r *CheckpointReq) SetWF(f func(cp *onl.Checkpoint) (err error)) { r.wf = f }
+
+//Push the checkpoint to the peer that requested it
+func (r *CheckpointReq) Push(cp *onl.Checkpoint) (err error) {
+	if r.wf == nil {
+		panic("checkpoint push without write function")
+	}
+
+	return r.wf(cp)
+}
+
+// SyncRounds is send to peers when a member requires all blocks in the rounds
+// From up to and including To
+type SyncRounds struct {
+	From uint64
+	To   uint64
+
+	//wf is set (decorated) by the broadcast layer
+	wf func(b *onl.Block) (err error)
+}
+
+const syncRoundsVersion = 1
+
+//MarshalBinary encodes the ranged sync request
+func (r *SyncRounds) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(syncRoundsVersion)
+	e.Uint64(r.From)
+	e.Uint64(r.To)
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes the ranged sync request
+func (r *SyncRounds) UnmarshalBinary(d []byte) (err error) {
+	rd, _ := enc.NewReader(d, syncRoundsVersion)
+	r.From = rd.Uint64()
+	r.To = rd.Uint64()
+	return rd.Done()
+}
+
+//SetWF sets the return write function
+func (r *SyncRounds) SetWF(f func(b *onl.Block) (err error)) { r.wf = f }
+
+//Push the block to the peer that requested the ranged sync
+func (r *SyncRounds) Push(b *onl.Block) (err error) {
+	if r.wf == nil {
+		panic("sync rounds push without write function")
+	}
+
+	return r.wf(b)
+}
+
+// HeadersReq is send to peers when a member wants the headers of the blocks
+// between its own tip and the peer's tip. Known holds ids of blocks the member
+// has, most recent first, such that the peer can find a common ancestor.
+type HeadersReq struct {
+	Known []onl.ID
+
+	//wf is set (decorated) by the broadcast layer
+	wf func(hdrs Headers) (err error)
+}
+
+const headersReqVersion = 1
+
+//MarshalBinary encodes the headers request
+func (r *HeadersReq) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(headersReqVersion)
+	e.Len(len(r.Known))
+	for _, id := range r.Known {
+		e.Fixed(id[:])
+	}
+
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes the headers request
+func (r *HeadersReq) UnmarshalBinary(d []byte) (err error) {
+	rd, _ := enc.NewReader(d, headersReqVersion)
+	n := rd.Len()
+	r.Known = nil
+	for i := 0; i < n && rd.Err() == nil; i++ {
+		var id onl.ID
+		rd.Fixed(id[:])
+		r.Known = append(r.Known, id)
+	}
+
+	return rd.Done()
+}
+
+//SetWF sets the return write function
+func (r *HeadersReq) SetWF(f func(hdrs Headers) (err error)) { r.wf = f }
+
+//Push the headers to the peer that requested them
+func (r *HeadersReq) Push(hdrs Headers) (err error) {
+	if r.wf == nil {
+		panic("headers push without write function")
+	}
+
+	return r.wf(hdrs)
+}
+
+// Headers are send in response to a headers request, in chain order
+type Headers []*onl.Header
+
+const headersVersion = 1
+
+//MarshalBinary encodes the headers
+func (hdrs Headers) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(headersVersion)
+	e.Len(len(hdrs))
+	for _, h := range hdrs {
+		hd, err := h.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode header: %v", err)
+		}
+
+		e.Bytes(hd)
+	}
+
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes the headers
+func (hdrs *Headers) UnmarshalBinary(d []byte) (err error) {
+	rd, _ := enc.NewReader(d, headersVersion)
+	n := rd.Len()
+	*hdrs = Headers{}
+	for i := 0; i < n && rd.Err() == nil; i++ {
+		hd := rd.Bytes()
+		if rd.Err() != nil {
+			break
+		}
+
+		h := &onl.Header{}
+		rd.Fail(h.UnmarshalBinary(hd))
+		*hdrs = append(*hdrs, h)
+	}
+
+	return rd.Done()
+}
+
 //Broadcast provide reliable message dissemation
 type Broadcast interface {
 	Read(msg *Msg) (err error)
@@ -5,4 +5,5 @@ import "errors"
 var (
 	ErrClosed      = errors.New("closed broadcast")
 	ErrPeerRefused = errors.New("peer refused connection")
+	ErrFrameSize   = errors.New("message frame exceeds the maximum size")
 )
@@ -0,0 +1,71 @@
+package broadcast
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/advanderveer/27067dd17/onl/engine"
+)
+
+//maxFrameSize limits how much a peer can make us allocate for a single message
+const maxFrameSize = 64 << 20
+
+//frameEncoder writes messages to a stream, each prefixed with its length
+type frameEncoder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func newFrameEncoder(w io.Writer) *frameEncoder {
+	return &frameEncoder{w: w}
+}
+
+//Encode writes a message as a single frame, safe for concurrent use
+func (e *frameEncoder) Encode(msg *engine.Msg) (err error) {
+	d, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4, 4+len(d))
+	binary.BigEndian.PutUint32(frame, uint32(len(d)))
+	frame = append(frame, d...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(frame)
+	return
+}
+
+//frameDecoder reads length prefixed messages from a stream
+type frameDecoder struct {
+	r *bufio.Reader
+}
+
+func newFrameDecoder(r io.Reader) *frameDecoder {
+	return &frameDecoder{r: bufio.NewReader(r)}
+}
+
+//Decode reads the next frame into the message
+func (d *frameDecoder) Decode(msg *engine.Msg) (err error) {
+	var size [4]byte
+	_, err = io.ReadFull(d.r, size[:])
+	if err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return ErrFrameSize
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(d.r, data)
+	if err != nil {
+		return err
+	}
+
+	return msg.UnmarshalBinary(data)
+}
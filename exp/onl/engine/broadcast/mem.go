@@ -2,7 +2,6 @@ package broadcast
 
 import (
 	"bytes"
-	"encoding/gob"
 	"fmt"
 	"io"
 	"math/rand"
@@ -71,23 +70,67 @@ func (bc *Mem) Read(msg *engine.Msg) (err error) {
 		return io.EOF
 	}
 
-	dec := gob.NewDecoder(rmsg.buf)
-	err = dec.Decode(msg)
+	err = msg.UnmarshalBinary(rmsg.buf.Bytes())
 	if err != nil {
 		return err
 	}
 
+	msg.SetPeer(fmt.Sprintf("%p", rmsg.remote))
+
 	if msg.Sync != nil {
 		msg.Sync.SetWF(func(b *onl.Block) (err error) {
-			buf := bytes.NewBuffer(nil)
-			enc := gob.NewEncoder(buf)
-			err = enc.Encode(&engine.Msg{Block: b})
+			d, err := (&engine.Msg{Block: b}).MarshalBinary()
 			if err != nil {
 				return fmt.Errorf("failed to encode broadcast message: %v", err)
 			}
 
 			//note: latency may be added, synchronous
-			return peerWrite(bc, rmsg.remote, buf.Bytes(), bc.latency())
+			return peerWrite(bc, rmsg.remote, d, bc.latency())
+		})
+	}
+
+	if msg.CheckpointReq != nil {
+		msg.CheckpointReq.SetWF(func(cp *onl.Checkpoint) (err error) {
+			d, err := (&engine.Msg{Checkpoint: cp}).MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("failed to encode broadcast message: %v", err)
+			}
+
+			return peerWrite(bc, rmsg.remote, d, bc.latency())
+		})
+	}
+
+	if msg.SyncRounds != nil {
+		msg.SyncRounds.SetWF(func(b *onl.Block) (err error) {
+			d, err := (&engine.Msg{Block: b}).MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("failed to encode broadcast message: %v", err)
+			}
+
+			return peerWrite(bc, rmsg.remote, d, bc.latency())
+		})
+	}
+
+	if msg.HeadersReq != nil {
+		msg.HeadersReq.SetWF(func(hdrs engine.Headers) (err error) {
+			d, err := (&engine.Msg{Headers: hdrs}).MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("failed to encode broadcast message: %v", err)
+			}
+
+			return peerWrite(bc, rmsg.remote, d, bc.latency())
+		})
+	}
+
+	//blocks of the headers are requested from the peer that send them
+	if msg.Headers != nil {
+		msg.SetWF(func(m *engine.Msg) (err error) {
+			d, err := m.MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("failed to encode broadcast message: %v", err)
+			}
+
+			return peerWrite(bc, rmsg.remote, d, bc.latency())
 		})
 	}
 
@@ -96,9 +139,7 @@ func (bc *Mem) Read(msg *engine.Msg) (err error) {
 
 //Write a message to the broadcast
 func (bc *Mem) Write(msg *engine.Msg) (err error) {
-	buf := bytes.NewBuffer(nil)
-	enc := gob.NewEncoder(buf)
-	err = enc.Encode(msg)
+	d, err := msg.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to encode broadcast message: %v", err)
 	}
@@ -106,7 +147,7 @@ func (bc *Mem) Write(msg *engine.Msg) (err error) {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 	for peer := range bc.peers {
-		go peerWrite(bc, peer, buf.Bytes(), bc.latency())
+		go peerWrite(bc, peer, d, bc.latency())
 	}
 
 	return
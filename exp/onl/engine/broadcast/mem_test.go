@@ -34,7 +34,9 @@ func TestBroadcast(t *testing.T) {
 
 	msg2 := &engine.Msg{}
 	test.Ok(t, bc2.Read(msg2))
+	test.Assert(t, msg2.Peer() != "", "message should be tagged with the peer")
 
+	msg2.SetPeer("")
 	test.Equals(t, msg1, msg2)
 
 	t.Run("with latency", func(t *testing.T) {
@@ -65,6 +67,7 @@ func TestBroadcast(t *testing.T) {
 		test.Ok(t, bc2.Read(msg7))
 
 		//msg6 should arrive before msg5
+		msg7.SetPeer("")
 		test.Equals(t, msg7, msg6)
 	})
 
@@ -103,3 +106,48 @@ func TestSyncMessage(t *testing.T) {
 	b2 := &onl.Block{Round: 1}
 	test.Equals(t, broadcast.ErrClosed, msg2.Sync.Push(b2))
 }
+
+func TestCheckpointMessage(t *testing.T) {
+	bc1 := broadcast.NewMem(1)
+	bc2 := broadcast.NewMem(1)
+	bc1.To(bc2)
+
+	//bc1 asks for a checkpoint
+	test.Ok(t, bc1.Write(&engine.Msg{CheckpointReq: &engine.CheckpointReq{Finality: 0.5}}))
+
+	msg2 := &engine.Msg{}
+	test.Ok(t, bc2.Read(msg2))
+	test.Equals(t, 0.5, msg2.CheckpointReq.Finality)
+
+	//bc2 pushes a checkpoint back
+	cp := &onl.Checkpoint{Block: &onl.Block{Round: 1}, Sum: 1}
+	test.Ok(t, msg2.CheckpointReq.Push(cp))
+
+	msg3 := &engine.Msg{}
+	test.Ok(t, bc1.Read(msg3))
+	test.Equals(t, uint64(1), msg3.Checkpoint.Block.Round)
+	test.Equals(t, uint64(1), msg3.Checkpoint.Sum)
+}
+
+func TestHeadersReply(t *testing.T) {
+	bc1 := broadcast.NewMem(1)
+	bc2 := broadcast.NewMem(1)
+	bc1.To(bc2)
+
+	//bc1 sends headers to bc2
+	test.Ok(t, bc1.Write(&engine.Msg{Headers: engine.Headers{&onl.Header{Round: 1}}}))
+
+	msg2 := &engine.Msg{}
+	test.Ok(t, bc2.Read(msg2))
+	test.Equals(t, true, msg2.CanReply())
+
+	//bc2 asks bc1 for the blocks of the headers
+	test.Ok(t, msg2.Reply(&engine.Msg{Sync: &engine.Sync{IDs: []onl.ID{bid1}}}))
+
+	msg3 := &engine.Msg{}
+	test.Ok(t, bc1.Read(msg3))
+	test.Equals(t, []onl.ID{bid1}, msg3.Sync.IDs)
+
+	//other messages cannot be replied to
+	test.Equals(t, false, msg3.CanReply())
+}
@@ -0,0 +1,105 @@
+package broadcast
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+//PeerStats holds statistics about the traffic with a peer
+type PeerStats struct {
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+//DisconnectedPeers is the key under which Stats reports the traffic with
+//peers that have disconnected since
+const DisconnectedPeers = "disconnected"
+
+//hostTraffic is the traffic with a host over all its connections
+type hostTraffic struct {
+	PeerStats
+	conns int
+}
+
+//meteredConn counts the bytes that are read from and written to a connection
+type meteredConn struct {
+	net.Conn
+	host  string
+	stats *hostTraffic
+}
+
+func (c *meteredConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.BytesIn, uint64(n))
+	return
+}
+
+func (c *meteredConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.BytesOut, uint64(n))
+	return
+}
+
+//meter wraps the connection such that its traffic is counted for the host it
+//is connected to. Hosts are counted without the port such that reconnecting
+//peers don't add new entries.
+func (bc *TCP) meter(conn net.Conn) net.Conn {
+	bc.smu.Lock()
+	defer bc.smu.Unlock()
+
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	stats, ok := bc.stats[host]
+	if !ok {
+		stats = &hostTraffic{}
+		bc.stats[host] = stats
+	}
+
+	stats.conns++
+	return &meteredConn{Conn: conn, host: host, stats: stats}
+}
+
+//unmeter is called when a connection disconnected, once a host has no more
+//connections its traffic is folded into that of all disconnected peers
+func (bc *TCP) unmeter(conn net.Conn) {
+	mc, ok := conn.(*meteredConn)
+	if !ok {
+		return
+	}
+
+	bc.smu.Lock()
+	defer bc.smu.Unlock()
+
+	mc.stats.conns--
+	if mc.stats.conns > 0 {
+		return
+	}
+
+	bc.gone.BytesIn += atomic.LoadUint64(&mc.stats.BytesIn)
+	bc.gone.BytesOut += atomic.LoadUint64(&mc.stats.BytesOut)
+	delete(bc.stats, mc.host)
+}
+
+//Stats returns the traffic with each connected peer by its host, the traffic
+//with peers that have disconnected since is reported as DisconnectedPeers
+func (bc *TCP) Stats() (peers map[string]PeerStats) {
+	bc.smu.Lock()
+	defer bc.smu.Unlock()
+
+	peers = make(map[string]PeerStats, len(bc.stats)+1)
+	for host, stats := range bc.stats {
+		peers[host] = PeerStats{
+			BytesIn:  atomic.LoadUint64(&stats.BytesIn),
+			BytesOut: atomic.LoadUint64(&stats.BytesOut),
+		}
+	}
+
+	if bc.gone.BytesIn > 0 || bc.gone.BytesOut > 0 {
+		peers[DisconnectedPeers] = bc.gone
+	}
+
+	return
+}
@@ -1,7 +1,6 @@
 package broadcast
 
 import (
-	"encoding/gob"
 	"fmt"
 	"io"
 	"log"
@@ -24,11 +23,16 @@ type TCP struct {
 	conns  chan net.Conn
 	closed bool
 	in     chan *engine.Msg
+
+	//traffic per connected host and of all disconnected hosts
+	stats map[string]*hostTraffic
+	gone  PeerStats
+	smu   sync.Mutex
 }
 
 type tcppeer struct {
 	conn net.Conn
-	enc  *gob.Encoder
+	enc  *frameEncoder
 }
 
 //NewTCP will start a new tcp endpoint, listening for incoming connections
@@ -38,6 +42,7 @@ func NewTCP(logw io.Writer, bind string, maxConn, maxBuf int) (bc *TCP, err erro
 		logs:  log.New(logw, "", 0),
 		in:    make(chan *engine.Msg, maxBuf),
 		peers: make(map[net.Addr]*tcppeer),
+		stats: make(map[string]*hostTraffic),
 	}
 
 	//listen on a random available port
@@ -68,23 +73,29 @@ func NewTCP(logw io.Writer, bind string, maxConn, maxBuf int) (bc *TCP, err erro
 				continue
 			}
 
+			//count the traffic over the connection
+			conn = bc.meter(conn)
+
 			//keep track of the connections so we can close them
 			bc.conns <- conn
 
 			//handle each connection concurrently
-			go bc.handleConn(conn)
+			go bc.handleConn(conn, newFrameEncoder(conn))
 		}
 	}()
 
 	return
 }
 
-func (bc *TCP) handleConn(conn net.Conn) {
+//handleConn reads messages from the connection, responses are written with enc
+//so they don't interleave with other writes on the same connection
+func (bc *TCP) handleConn(conn net.Conn, enc *frameEncoder) {
 	bc.cwg.Add(1)
 	defer bc.cwg.Done()
+	defer bc.unmeter(conn)
 
 	//start decoding
-	dec := gob.NewDecoder(conn)
+	dec := newFrameDecoder(conn)
 	for {
 		msg := &engine.Msg{}
 		err := dec.Decode(msg)
@@ -96,9 +107,10 @@ func (bc *TCP) handleConn(conn net.Conn) {
 			return
 		}
 
+		msg.SetPeer(conn.RemoteAddr().String())
+
 		//for sync messages we provide a return func for bi-directional sending
 		if msg.Sync != nil {
-			enc := gob.NewEncoder(conn)
 			msg.Sync.SetWF(func(b *onl.Block) (err error) {
 				err = enc.Encode(&engine.Msg{Block: b})
 				if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
@@ -109,6 +121,54 @@ func (bc *TCP) handleConn(conn net.Conn) {
 			})
 		}
 
+		//checkpoint requests are answered over the same connection
+		if msg.CheckpointReq != nil {
+			msg.CheckpointReq.SetWF(func(cp *onl.Checkpoint) (err error) {
+				err = enc.Encode(&engine.Msg{Checkpoint: cp})
+				if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					bc.logs.Printf("[ERRO] failed to encode checkpoint message to %s: %v", conn.RemoteAddr(), err)
+				}
+
+				return nil
+			})
+		}
+
+		//ranged syncs are answered over the same connection
+		if msg.SyncRounds != nil {
+			msg.SyncRounds.SetWF(func(b *onl.Block) (err error) {
+				err = enc.Encode(&engine.Msg{Block: b})
+				if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					bc.logs.Printf("[ERRO] failed to encode sync rounds message to %s: %v", conn.RemoteAddr(), err)
+				}
+
+				return nil
+			})
+		}
+
+		//headers requests are answered over the same connection
+		if msg.HeadersReq != nil {
+			msg.HeadersReq.SetWF(func(hdrs engine.Headers) (err error) {
+				err = enc.Encode(&engine.Msg{Headers: hdrs})
+				if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					bc.logs.Printf("[ERRO] failed to encode headers message to %s: %v", conn.RemoteAddr(), err)
+				}
+
+				return nil
+			})
+		}
+
+		//blocks of the headers are requested over the same connection
+		if msg.Headers != nil {
+			msg.SetWF(func(m *engine.Msg) (err error) {
+				err = enc.Encode(m)
+				if err != nil && err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+					bc.logs.Printf("[ERRO] failed to encode message to %s: %v", conn.RemoteAddr(), err)
+				}
+
+				return nil
+			})
+		}
+
 		//send to incoming channel for consumer to read from
 		bc.in <- msg
 	}
@@ -129,14 +189,16 @@ func (bc *TCP) To(to time.Duration, peers ...net.Addr) (err error) {
 			return fmt.Errorf("failed to dial peer: %v", err)
 		}
 
+		conn = bc.meter(conn)
+
 		//keep conn info for later writing
 		bc.peers[p] = &tcppeer{
 			conn: conn,
-			enc:  gob.NewEncoder(conn),
+			enc:  newFrameEncoder(conn),
 		}
 
 		//handle incoming message from connecting peers
-		go bc.handleConn(conn)
+		go bc.handleConn(conn, bc.peers[p].enc)
 
 		//@TODO handle any incoming messages from the peers we connect to
 	}
@@ -2,6 +2,7 @@ package broadcast_test
 
 import (
 	"io"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -35,18 +36,33 @@ func TestTCPBroadcast(t *testing.T) {
 
 	msg2 := &engine.Msg{}
 	test.Ok(t, bc2.Read(msg2))
+	test.Assert(t, msg2.Peer() != "", "message should be tagged with the peer")
+	msg2.SetPeer("")
 	test.Equals(t, msg2, msg1)
 	test.Ok(t, bc2.Write(msg2))
 
 	msg3 := &engine.Msg{}
 	test.Ok(t, bc3.Read(msg3))
+	test.Assert(t, msg3.Peer() != "", "message should be tagged with the peer")
+	msg3.SetPeer("")
 	test.Equals(t, msg3, msg1)
 	test.Ok(t, bc3.Write(msg3))
 
 	msg4 := &engine.Msg{}
 	test.Ok(t, bc1.Read(msg4))
+	test.Assert(t, msg4.Peer() != "", "message should be tagged with the peer")
+	msg4.SetPeer("")
 	test.Equals(t, msg4, msg1)
 
+	//traffic is counted per peer, bc1 sent to bc2 and received from bc3
+	var in, out uint64
+	for _, stats := range bc1.Stats() {
+		in, out = in+stats.BytesIn, out+stats.BytesOut
+	}
+
+	test.Assert(t, in > 0, "should have counted received bytes")
+	test.Assert(t, out > 0, "should have counted sent bytes")
+
 	//close down
 	test.Ok(t, bc1.Close())
 	test.Ok(t, bc2.Close())
@@ -112,3 +128,34 @@ func TestSyncMessageHandling(t *testing.T) {
 	test.Ok(t, msg2.Sync.Push(b2))
 
 }
+
+func TestTCPStatsByHost(t *testing.T) {
+	bc1, err := broadcast.NewTCP(os.Stderr, "127.0.0.1:0", 10, 100)
+	test.Ok(t, err)
+
+	//two connections from the same host are counted together
+	conn1, err := net.Dial("tcp", bc1.Addr().String())
+	test.Ok(t, err)
+	conn2, err := net.Dial("tcp", bc1.Addr().String())
+	test.Ok(t, err)
+
+	_, err = conn1.Write([]byte{0x00})
+	test.Ok(t, err)
+	_, err = conn2.Write([]byte{0x00})
+	test.Ok(t, err)
+
+	stats := func() map[string]broadcast.PeerStats {
+		time.Sleep(time.Millisecond * 20)
+		return bc1.Stats()
+	}
+
+	test.Equals(t, map[string]broadcast.PeerStats{"127.0.0.1": {BytesIn: 2}}, stats())
+
+	//once disconnected, the traffic is folded together
+	test.Ok(t, conn1.Close())
+	test.Equals(t, map[string]broadcast.PeerStats{"127.0.0.1": {BytesIn: 2}}, stats())
+	test.Ok(t, conn2.Close())
+	test.Equals(t, map[string]broadcast.PeerStats{broadcast.DisconnectedPeers: {BytesIn: 2}}, stats())
+
+	test.Ok(t, bc1.Close())
+}
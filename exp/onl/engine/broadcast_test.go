@@ -0,0 +1,41 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/27067dd17/onl/engine"
+	"github.com/advanderveer/go-test"
+)
+
+func TestMsgEncoding(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	b1 := idn1.Mint(1, onl.NilID, onl.NilID, 1)
+	idn1.Sign(b1)
+
+	msg1 := &engine.Msg{
+		Block:         b1,
+		Sync:          &engine.Sync{IDs: []onl.ID{b1.Hash(), onl.NilID}},
+		CheckpointReq: &engine.CheckpointReq{Finality: 0.66, Block: b1.Hash()},
+		SyncRounds:    &engine.SyncRounds{From: 2, To: 5},
+		HeadersReq:    &engine.HeadersReq{Known: []onl.ID{b1.Hash()}},
+		Headers:       engine.Headers{b1.Header()},
+	}
+
+	d1, err := msg1.MarshalBinary()
+	test.Ok(t, err)
+
+	msg2 := &engine.Msg{}
+	test.Ok(t, msg2.UnmarshalBinary(d1))
+	test.Equals(t, b1.Hash(), msg2.Block.Hash())
+	test.Equals(t, msg1.Sync.IDs, msg2.Sync.IDs)
+	test.Equals(t, 0.66, msg2.CheckpointReq.Finality)
+	test.Equals(t, b1.Hash(), msg2.CheckpointReq.Block)
+	test.Equals(t, (*onl.Write)(nil), msg2.Write)
+	test.Equals(t, (*onl.Checkpoint)(nil), msg2.Checkpoint)
+	test.Equals(t, msg1.SyncRounds.From, msg2.SyncRounds.From)
+	test.Equals(t, msg1.SyncRounds.To, msg2.SyncRounds.To)
+	test.Equals(t, msg1.HeadersReq.Known, msg2.HeadersReq.Known)
+	test.Equals(t, msg1.Headers, msg2.Headers)
+
+}
@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"github.com/advanderveer/27067dd17/onl"
+)
+
+// FetchCheckpoint asks peers on the broadcast for the checkpoint at block 'id'
+// with the provided finalization and returns the first one that is pushed back
+// with the trusted hash. It should be called before an engine starts reading
+// from the broadcast. Reading blocks until a message arrives, the context is
+// checked in between messages.
+func FetchCheckpoint(ctx context.Context, bc Broadcast, finality float64, id onl.ID, trusted [sha256.Size]byte) (cp *onl.Checkpoint, err error) {
+	err = bc.Write(&Msg{CheckpointReq: &CheckpointReq{Finality: finality, Block: id}})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		msg := &Msg{}
+		err = bc.Read(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		//other messages are ignored until we have a chain to handle them
+		if msg.Checkpoint != nil {
+			h, err := msg.Checkpoint.Hash()
+			if err == nil && h == trusted && h == msg.Checkpoint.Commitment {
+				return msg.Checkpoint, nil
+			}
+		}
+	}
+}
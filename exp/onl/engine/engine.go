@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/big"
+	"sync"
+	"sync/atomic"
 
 	"github.com/advanderveer/27067dd17/onl"
 )
@@ -23,12 +27,23 @@ type Engine struct {
 	chain *onl.Chain
 	ooo   *OutOfOrder
 	pool  *MemPool
+	evs   *onl.Subscription
 
 	logs    *log.Logger
 	idn     *onl.Identity
 	done    chan struct{}
-	maxw    int
 	genesis onl.ID
+	prunef  uint64 //float64 bits of the finalization to prune at
+
+	roundc chan struct{} //closed once the current round was handled
+	rmu    sync.Mutex
+
+	catchup  uint64             //round in which we last started catching up
+	fetching map[onl.ID]*source //blocks being fetched, nil if not requested yet
+	queue    []onl.ID           //blocks of verified headers that are not requested yet
+	sources  map[string]*source //peers that send us headers, by peer
+	more     bool               //more headers to fetch once fetching is done
+	fmu      sync.Mutex
 }
 
 // New initiates an engine
@@ -40,18 +55,32 @@ func New(logw io.Writer, bc Broadcast, clock Clock, idn *onl.Identity, c *onl.Ch
 		done:  make(chan struct{}, 2),
 		logs:  log.New(logw, "", 0),
 		chain: c,
-		maxw:  10, //@TODO make configurable, or measure total block size in MiB
 
-		pool: NewMemPool(),
+		pool:     NewMemPool(),
+		roundc:   make(chan struct{}),
+		fetching: make(map[onl.ID]*source),
+		sources:  make(map[string]*source),
 	}
 
+	//we follow reorgs to keep writes that end up on abandoned forks, none of
+	//the events may be dropped
+	e.evs = e.chain.SubscribeBlocking(100)
+
 	//genesis is kept for resolving purposes
 	e.genesis = e.chain.Genesis().Hash()
 
-	//setup out of order buffer, genesis is always marked as resolved
-	e.ooo = NewOutOfOrder(e, bc)
+	//setup out of order buffer, genesis is always marked as resolved and
+	//blocks that were resolved long ago are looked up in the chain
+	e.ooo = NewOutOfOrder(e, bc, e.chain.Has)
 	e.ooo.Resolve(e.genesis)
 
+	//chain events, until the subscription is closed on shutdown
+	go func() {
+		for ev := range e.evs.C() {
+			e.handleEvent(ev)
+		}
+	}()
+
 	//round progress
 	go func() {
 		for {
@@ -63,6 +92,12 @@ func New(logw io.Writer, bc Broadcast, clock Clock, idn *onl.Identity, c *onl.Ch
 
 			//handle round
 			e.handleRound(round, ts)
+
+			//signal anyone waiting for the round to pass
+			e.rmu.Lock()
+			close(e.roundc)
+			e.roundc = make(chan struct{})
+			e.rmu.Unlock()
 		}
 
 		e.done <- struct{}{}
@@ -81,6 +116,11 @@ func New(logw io.Writer, bc Broadcast, clock Clock, idn *onl.Identity, c *onl.Ch
 				break //shutting down
 			}
 
+			//blocks far ahead of our tip mean we missed a lot, catch up
+			if msg.Block != nil {
+				e.catchUpIfBehind(msg.Block)
+			}
+
 			//handle out-of-order
 			e.ooo.Handle(msg)
 		}
@@ -96,33 +136,109 @@ func (e *Engine) Tip() onl.ID {
 	return e.chain.Tip()
 }
 
+//Subscribe to events of the chain the engine is working with
+func (e *Engine) Subscribe(bufn int) *onl.Subscription {
+	return e.chain.Subscribe(bufn)
+}
+
 // View will read the chain's state
 func (e *Engine) View(f func(kv *onl.KV)) (err error) {
-	e.chain.View(f)
-	return
+	return e.chain.View(f)
+}
+
+// ViewAt views the key-value state as it was right after block 'id'
+func (e *Engine) ViewAt(id onl.ID, f func(kv *onl.KV)) (err error) {
+	return e.chain.ViewAt(id, f)
+}
+
+// ViewAtRound views the key-value state as it was in round 'round' on the
+// current tip's ancestry. It returns the block whose state was viewed.
+func (e *Engine) ViewAtRound(round uint64, f func(kv *onl.KV)) (id onl.ID, err error) {
+	return e.chain.ViewAtRound(round, f)
+}
+
+// UpdateOpts configure how a change is submitted and when Update returns
+type UpdateOpts struct {
+
+	//ValidUntil is the last round in which the change can be included in a
+	//block. Zero means the change doesn't expire.
+	ValidUntil uint64
+
+	//Fee is paid to the proposer of the block that includes the change, writes
+	//with a higher fee are proposed first.
+	Fee uint64
+
+	//Finality is the finalization the block that includes the change needs to
+	//reach. Zero means returning as soon as the block is on the tip.
+	Finality float64
 }
 
 // Update will submit a change the key-value state by, it returns when the change
-// was submitted and ended up in the longest chain.
-func (e *Engine) Update(ctx context.Context, f func(kv *onl.KV)) (err error) {
-	w := e.chain.Update(f)
+// was submitted and ended up in the longest chain. If 'f' returns an error the
+// change is discarded and the error is returned. If 'f' made no changes it
+// returns immediately without a receipt.
+func (e *Engine) Update(ctx context.Context, f func(kv *onl.KV) error) (rcpt *Receipt, err error) {
+	return e.UpdateWith(ctx, UpdateOpts{}, f)
+}
+
+// UpdateWith submits a change like Update but returns according to the options
+func (e *Engine) UpdateWith(ctx context.Context, opts UpdateOpts, f func(kv *onl.KV) error) (rcpt *Receipt, err error) {
+	w, err := e.Submit(opts, f)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	return e.Await(ctx, w, opts.Finality)
+}
+
+// Submit a change to the key-value state without waiting for it to end up in
+// the chain, the returned write can be awaited. The finality option is ignored.
+func (e *Engine) Submit(opts UpdateOpts, f func(kv *onl.KV) error) (w *onl.Write, err error) {
+	w, err = e.chain.Update(f)
+	if err != nil {
+		return nil, err
+	}
+
 	if w == nil {
-		return nil //no changes, "succeeds" immediately
+		return nil, nil //no changes, "succeeds" immediately
 	}
 
+	w.ValidUntil, w.Fee = opts.ValidUntil, opts.Fee
+
 	//generate a nonce for this write
 	err = w.GenerateNonce()
 	if err != nil {
-		return fmt.Errorf("failed to generate nonce: %v", err)
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
 	}
 
 	//sign the write
 	w.PK = e.idn.PK()
 	e.idn.SignWrite(w)
 
-	//handle our own write
-	e.handleWrite(w)
-	return
+	//handle our own write, if it isn't pooled it will never be included
+	err = e.handleWrite(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+//Orphans returns the number of messages that wait on a block or round before
+//they can be handled, and the total size of their blocks
+func (e *Engine) Orphans() (n, size int) {
+	return e.ooo.Orphans()
+}
+
+//AutoPrune configures the engine to prune abandoned forks at the start of each
+//round once a block reached the provided finalization. Zero disables pruning.
+func (e *Engine) AutoPrune(finality float64) {
+	atomic.StoreUint64(&e.prunef, math.Float64bits(finality))
+}
+
+//LimitPool configures the limits of the mempool, see MemPool.Limit
+func (e *Engine) LimitPool(writes, size, perSender int) {
+	e.pool.Limit(writes, size, perSender)
 }
 
 //Round returns the current round the engine is on
@@ -130,14 +246,33 @@ func (e *Engine) Round() uint64 {
 	return e.clock.Round()
 }
 
+//roundDone returns a channel that is closed once the current round was handled
+func (e *Engine) roundDone() <-chan struct{} {
+	e.rmu.Lock()
+	defer e.rmu.Unlock()
+	return e.roundc
+}
+
 //Handle a single message, assumes that is called in-order
 func (e *Engine) Handle(msg *Msg) {
 	if msg.Write != nil {
-		e.handleWrite(msg.Write)
+		if err := e.handleWrite(msg.Write); err != nil {
+			e.logs.Printf("[INFO][%s] failed to add write from peer to mempool: %v", e.idn, err)
+		}
 	} else if msg.Block != nil {
 		e.handleBlock(msg.Block)
 	} else if msg.Sync != nil {
 		e.handleSync(msg.Sync)
+	} else if msg.CheckpointReq != nil {
+		e.handleCheckpointReq(msg.CheckpointReq)
+	} else if msg.SyncRounds != nil {
+		e.handleSyncRounds(msg.SyncRounds)
+	} else if msg.HeadersReq != nil {
+		e.handleHeadersReq(msg.HeadersReq)
+	} else if msg.Headers != nil {
+		e.handleHeaders(msg)
+	} else if msg.Checkpoint != nil {
+		return //only of interest to members that are bootstrapping
 	} else {
 		e.logs.Printf("[INFO][%s] read messages that is neither a write or a block, ignoring", e.idn)
 		return
@@ -159,11 +294,85 @@ func (e *Engine) handleSync(s *Sync) {
 	}
 }
 
+// Checkpoint returns the checkpoint at the latest block on our tip that reached
+// the finality. Its block id and hash can be given to new members that trust
+// us, so they can fetch it from any peer.
+func (e *Engine) Checkpoint(finality float64) (cp *onl.Checkpoint, err error) {
+	id, err := e.chain.Finalized(finality)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.chain.Checkpoint(id)
+}
+
+func (e *Engine) handleCheckpointReq(r *CheckpointReq) {
+	id, err := e.chain.Finalized(r.Finality)
+	if err == nil && r.Block != onl.NilID {
+		id, err = r.Block, e.checkFinalized(r.Block, r.Finality)
+	}
+
+	if err != nil {
+		e.logs.Printf("[INFO][%s] peer requested checkpoint at finality %.2f that we can't provide: %v", e.idn, r.Finality, err)
+		return
+	}
+
+	cp, err := e.chain.Checkpoint(id)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to create checkpoint at block %s: %v", e.idn, id, err)
+		return
+	}
+
+	err = r.Push(cp)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to push checkpoint %s as respons to a request: %v", e.idn, id, err)
+	}
+}
+
+//checkFinalized checks that block 'id' is an ancestor of our tip that reached
+//the finality
+func (e *Engine) checkFinalized(id onl.ID, finality float64) (err error) {
+	_, _, f, err := e.chain.Read(id)
+	if err != nil {
+		return err
+	}
+
+	if f < finality {
+		return onl.ErrNoFinalizedBlock
+	}
+
+	err = e.chain.Walk(e.chain.Tip(), func(bid onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+		if bid == id {
+			return errFound
+		}
+
+		if b.Round <= id.Round() {
+			return onl.ErrTipNotFinalized
+		}
+
+		return nil
+	})
+
+	if err == errFound {
+		return nil
+	}
+
+	return err
+}
+
 func (e *Engine) handleRound(round, ts uint64) {
 
 	//start handling blocks that we're to early
 	e.ooo.ResolveRound(round)
 
+	//prune abandoned forks, if configured
+	e.prune()
+
+	//writes that expired will never be included, stop proposing them
+	if n := e.pool.Expire(round); n > 0 {
+		e.logs.Printf("[INFO][%s][%d] removed %d expired writes from the mempool", e.idn, round, n)
+	}
+
 	//read tip and current state from chain
 	tip, state, err := e.chain.State(onl.NilID)
 	if err != nil {
@@ -173,9 +382,15 @@ func (e *Engine) handleRound(round, ts uint64) {
 
 	//check if we have stake in the heaviest tip state
 	var stake uint64
-	state.View(func(kv *onl.KV) {
+	if err = state.View(func(kv *onl.KV) {
 		stake, _ = kv.ReadStake(e.idn.PK())
-	})
+		if left, ok := kv.ReadLeave(e.idn.PK()); ok && round >= left {
+			stake = 0 //we left, our stake is only waiting to be released
+		}
+	}); err != nil {
+		e.logs.Printf("[ERRO][%s] failed to read state for round %d: %v", e.idn, round, err)
+		return
+	}
 
 	if stake < 1 {
 		e.logs.Printf("[INFO][%s][%d] we have no stake put up, proposing no block this round", e.idn, round)
@@ -185,16 +400,20 @@ func (e *Engine) handleRound(round, ts uint64) {
 	//mint a block for our current tip
 	e.logs.Printf("[INFO][%s][%d] we have %d stake to propose blocks, minting on tip %s", e.idn, round, stake, tip)
 
-	//@TODO find a stable block by walking the chain, not hardcode genesis
-	b := e.idn.Mint(ts, tip, e.genesis, round)
+	//the stable block is determined by the tip and round so others can verify it
+	stable, err := e.chain.Stable(tip, round)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to determine stable block for round %d: %v", e.idn, round, err)
+		return
+	}
 
-	//pick writes that are suited for the new block
-	e.pool.Pick(state, func(w *onl.Write) bool {
-		b.AppendWrite(w)
-		if len(b.Writes) >= e.maxw {
-			return true
-		}
+	b := e.idn.Mint(ts, tip, stable, round)
 
+	//pick writes that are suited for the new block, as long as they fit. The
+	//watermark is raised like it will be when the block is appended.
+	state.Raise(round)
+	e.pool.Pick(state, onl.MaxBlockSize-b.Size(), func(w *onl.Write) bool {
+		b.AppendWrite(w)
 		return false
 	})
 
@@ -205,16 +424,59 @@ func (e *Engine) handleRound(round, ts uint64) {
 	e.handleBlock(b)
 }
 
-func (e *Engine) handleWrite(w *onl.Write) {
+func (e *Engine) prune() {
+	finality := math.Float64frombits(atomic.LoadUint64(&e.prunef))
+	if finality <= 0 {
+		return //pruning is disabled
+	}
+
+	fin, pruned, err := e.chain.Prune(finality)
+	if err != nil {
+		e.logs.Printf("[INFO][%s] failed to prune chain: %v", e.idn, err)
+		return
+	}
+
+	if len(pruned) < 1 {
+		return
+	}
+
+	//messages waiting on pruned blocks will never resolve
+	e.ooo.Forget(pruned...)
+
+	//writes in the finalized chain don't need to be proposed ever again
+	e.cleanPool(fin)
+	e.logs.Printf("[INFO][%s] pruned %d blocks that are not ancestors of finalized block %s", e.idn, len(pruned), fin)
+}
+
+//cleanPool removes writes from the mempool that are in (or conflict with) the
+//state of finalized block 'fin'
+func (e *Engine) cleanPool(fin onl.ID) {
+	_, state, err := e.chain.State(fin)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to build state of finalized block %s: %v", e.idn, fin, err)
+		return
+	}
+
+	if n := e.pool.Clean(state); n > 0 {
+		e.logs.Printf("[INFO][%s] removed %d writes from the mempool that are settled by finalized block %s", e.idn, n, fin)
+	}
+}
+
+func (e *Engine) handleWrite(w *onl.Write) (err error) {
 
 	//@TODO check if the write (identified with the nonce) is already in the
 	//finalized chain. If so, reject.
 
-	//attempt to add to the mempool
-	err := e.pool.Add(w)
+	//expired writes will never be included
+	if w.Expired(e.clock.Round()) {
+		return onl.ErrWriteExpired
+	}
+
+	//attempt to add to the mempool, writes that exceed the limits or don't fit
+	//are rejected
+	err = e.pool.Add(w)
 	if err != nil {
-		e.logs.Printf("[INFO][%s] failed to add write to mempool: %v", e.idn, err)
-		return
+		return err
 	}
 
 	//relay to peers
@@ -227,10 +489,16 @@ func (e *Engine) handleWrite(w *onl.Write) {
 	if err != nil {
 		e.logs.Printf("[ERRO][%s] failed to relay write to peers: %v", e.idn, err)
 	}
+
+	return nil
 }
 
 func (e *Engine) handleBlock(b *onl.Block) {
 
+	//the block is no longer being fetched, whether it could be appended or not
+	id := b.Hash()
+	defer e.fetched(id)
+
 	//append the block to the chain, any invalid blocks will be rejected here
 	//@TODO make append retry n configurable and have some exponential backoff
 	for i := 0; i < 5; i++ {
@@ -250,7 +518,6 @@ func (e *Engine) handleBlock(b *onl.Block) {
 	}
 
 	//handle any messages that were waiting on this block
-	id := b.Hash()
 	e.ooo.Resolve(id)
 	e.logs.Printf("[INFO][%s] appended block %s to our chain", e.idn, id)
 
@@ -261,6 +528,40 @@ func (e *Engine) handleBlock(b *onl.Block) {
 	}
 }
 
+//handleEvent puts the writes from blocks that the chain reverted back in the
+//mempool, they may need to be proposed again. Writes in finalized blocks never
+//need to be proposed again.
+func (e *Engine) handleEvent(ev onl.Event) {
+	if fin, ok := ev.(onl.Finalized); ok && fin.Level == onl.FinalizationLevels[0] {
+		e.cleanPool(fin.ID)
+		return
+	}
+
+	reorg, ok := ev.(onl.Reorg)
+	if !ok || len(reorg.RevertedWrites) < 1 {
+		return
+	}
+
+	_, state, err := e.chain.State(onl.NilID)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to build tip state after reorg: %v", e.idn, err)
+		return
+	}
+
+	var n int
+	for _, w := range reorg.RevertedWrites {
+		if err = state.Apply(w, true); err != nil {
+			continue //no longer valid on the new tip
+		}
+
+		if err = e.pool.Add(w); err == nil {
+			n++
+		}
+	}
+
+	e.logs.Printf("[INFO][%s] reorg to common ancestor %s reverted %d writes, %d were put back in the mempool", e.idn, reorg.CommonAncestor, len(reorg.RevertedWrites), n)
+}
+
 //Draw will vizualize the engine's chain using the dot graph language
 func (e *Engine) Draw(w io.Writer) (err error) {
 	fmt.Fprintln(w, `digraph {`)
@@ -325,6 +626,7 @@ func (e *Engine) Shutdown(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-e.done: //2th subsystem
+			e.evs.Close()
 			return nil
 		}
 	}
@@ -30,6 +30,15 @@ func drawPNG(t *testing.T, e *engine.Engine, name string) {
 	test.Ok(t, cmd.Run())
 }
 
+//key returns key 'j' in the keyspace of the identity, the only place where it
+//is allowed to write
+func key(idn *onl.Identity, j uint64) []byte {
+	pk := idn.PK()
+	kb := make([]byte, 8)
+	binary.LittleEndian.PutUint64(kb, j)
+	return append(pk[:], kb...)
+}
+
 func testEngine(t *testing.T, osc *clock.MemOscillator, idn *onl.Identity, genf ...func(kv *onl.KV)) (bc *broadcast.Mem, e *engine.Engine, clean func()) {
 	store, cleanstore := onl.TempBadgerStore()
 
@@ -73,15 +82,13 @@ func TestEngineWritingByItself(t *testing.T) {
 
 	//write to the engine async
 	go func() {
-		ctx := context.Background()
 		for j := uint64(0); j < nWrites; j++ {
 			time.Sleep(time.Millisecond)
-			test.Ok(t, e1.Update(ctx, func(kv *onl.KV) {
-				kb := make([]byte, 8)
-				binary.LittleEndian.PutUint64(kb, j)
-
-				kv.Set(kb, []byte{0x01})
-			}))
+			_, err := e1.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+				kv.Set(key(idn, j), []byte{0x01})
+				return nil
+			})
+			test.Ok(t, err)
 		}
 	}()
 
@@ -91,23 +98,202 @@ func TestEngineWritingByItself(t *testing.T) {
 		osc.Fire()
 	}
 
+	//the last round's block was handled, no writes or blocks are left waiting
+	time.Sleep(time.Millisecond * 50)
+	stats, err := e1.Stats()
+	test.Ok(t, err)
+	test.Equals(t, uint64(101), stats.Round)
+	test.Equals(t, uint64(101), stats.TipRound)
+	test.Equals(t, uint64(100), stats.Chain.Appended)
+	test.Equals(t, 0, stats.PoolWrites)
+	test.Equals(t, 0, stats.Orphans)
+
 	//wait for rounds to be wrapped up
 	clean1()
 
 	//should now read all 50 puts on itself
 	test.Ok(t, e1.View(func(kv *onl.KV) {
 		for j := uint64(0); j < nWrites; j++ {
-			kb := make([]byte, 8)
-			binary.LittleEndian.PutUint64(kb, j)
 
 			//@TODO (#2) this fails onces in a full moont
-			test.Equals(t, []byte{0x01}, kv.Get(kb))
+			test.Equals(t, []byte{0x01}, kv.Get(key(idn, j)))
+
+		}
+	}))
+
+	//the genesis state didn't have any of the puts yet
+	id, err := e1.ViewAtRound(0, func(kv *onl.KV) {
+		test.Equals(t, []byte(nil), kv.Get(key(idn, 0)))
+	})
+
+	test.Ok(t, err)
+	test.Ok(t, e1.ViewAt(id, func(kv *onl.KV) {
+		test.Equals(t, []byte(nil), kv.Get(key(idn, 0)))
+	}))
+}
+
+// Test that updates wait for their write to be included and finalized
+func TestEngineUpdateReceipt(t *testing.T) {
+	idn := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	_, e1, clean1 := testEngine(t, osc, idn, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn.PK(), 1)
+		kv.DepositStake(idn.PK(), 1, idn.TokenPK())
+	})
 
+	//keep firing rounds until the updates returned
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 3):
+				osc.Fire()
+			}
 		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rcpt, err := e1.Update(ctx, func(kv *onl.KV) error {
+		kv.Set(key(idn, 1), []byte{0x01})
+		return nil
+	})
+
+	test.Ok(t, err)
+	test.Equals(t, rcpt.Block.Round(), rcpt.Round)
+	test.Ok(t, e1.ViewAt(rcpt.Block, func(kv *onl.KV) {
+		test.Equals(t, []byte{0x01}, kv.Get(key(idn, 1)))
 	}))
 
-	//@TODO assert memory pool size to be very empty
-	//@TODO assert out-of-order to be empty
+	t.Run("should wait for finalization", func(t *testing.T) {
+		rcpt, err := e1.UpdateWith(ctx, engine.UpdateOpts{Finality: 1}, func(kv *onl.KV) error {
+			kv.Set(key(idn, 2), []byte{0x01})
+			return nil
+		})
+
+		test.Ok(t, err)
+		test.Equals(t, 1.0, rcpt.Finalization)
+	})
+
+	t.Run("should return without changes", func(t *testing.T) {
+		rcpt, err := e1.Update(ctx, func(kv *onl.KV) error { return nil })
+		test.Ok(t, err)
+		test.Equals(t, (*engine.Receipt)(nil), rcpt)
+	})
+
+	t.Run("should fail when expired", func(t *testing.T) {
+		_, err := e1.UpdateWith(ctx, engine.UpdateOpts{ValidUntil: 1}, func(kv *onl.KV) error {
+			kv.Set(key(idn, 3), []byte{0x01})
+			return nil
+		})
+
+		test.Equals(t, onl.ErrWriteExpired, err)
+	})
+
+	close(done)
+	clean1()
+}
+
+// Test that awaiting a write that is never included returns once it expired,
+// even if no blocks are appended in the meantime
+func TestEngineAwaitExpiryWithoutBlocks(t *testing.T) {
+	idn := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	_, e1, clean1 := testEngine(t, osc, idn) //not a member, no blocks
+	defer clean1()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	w, err := e1.Submit(engine.UpdateOpts{ValidUntil: e1.Round() + 2}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 1), []byte{0x01})
+		return nil
+	})
+
+	test.Ok(t, err)
+
+	errc := make(chan error)
+	go func() {
+		_, err := e1.Await(ctx, w, 0)
+		errc <- err
+	}()
+
+	for i := 0; i < 3; i++ {
+		osc.Fire()
+	}
+
+	test.Equals(t, onl.ErrWriteExpired, <-errc)
+}
+
+// Test that writes that didn't make it into the pool, or were evicted from it,
+// return an error instead of waiting to be included
+func TestEngineUpdateFullPool(t *testing.T) {
+	idn := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	_, e1, clean1 := testEngine(t, osc, idn) //not a member, no blocks
+	defer clean1()
+	e1.LimitPool(1, onl.MaxBlockSize, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	w1, err := e1.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 1), []byte{0x01})
+		return nil
+	})
+	test.Ok(t, err)
+
+	_, err = e1.Update(ctx, func(kv *onl.KV) error {
+		kv.Set(key(idn, 2), []byte{0x01})
+		return nil
+	})
+	test.Equals(t, engine.ErrPoolFull, err)
+	test.Ok(t, ctx.Err())
+
+	//a write with a higher fee evicts the first write
+	_, err = e1.Submit(engine.UpdateOpts{Fee: 1}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 3), []byte{0x01})
+		return nil
+	})
+	test.Ok(t, err)
+
+	_, err = e1.Await(ctx, w1, 0)
+	test.Equals(t, engine.ErrWriteDropped, err)
+	test.Ok(t, ctx.Err())
+}
+
+// Test that writes rejected by the pool return the error to the caller
+func TestEngineUpdateRejected(t *testing.T) {
+	idn := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	_, e1, clean1 := testEngine(t, osc, idn) //not a member, no blocks
+	defer clean1()
+	e1.LimitPool(10, onl.MaxBlockSize, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := e1.UpdateWith(ctx, engine.UpdateOpts{}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 1), make([]byte, onl.MaxValueLen+1))
+		return nil
+	})
+	test.Equals(t, onl.ErrValueTooLong, err)
+
+	_, err = e1.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 2), []byte{0x01})
+		return nil
+	})
+	test.Ok(t, err)
+
+	_, err = e1.UpdateWith(ctx, engine.UpdateOpts{}, func(kv *onl.KV) error {
+		kv.Set(key(idn, 3), []byte{0x01})
+		return nil
+	})
+	test.Equals(t, engine.ErrSenderLimit, err)
+	test.Ok(t, ctx.Err())
 }
 
 // Test that one n engine writes and other engines replicate without writing themselves
@@ -141,15 +327,13 @@ func TestEngineWriterReplication(t *testing.T) {
 
 	//start writing thread
 	go func() {
-		ctx := context.Background()
 		for j := uint64(0); j < nWrites; j++ {
 			time.Sleep(time.Millisecond)
-			test.Ok(t, e1.Update(ctx, func(kv *onl.KV) {
-				kb := make([]byte, 8)
-				binary.LittleEndian.PutUint64(kb, j)
-
-				kv.Set(kb, []byte{0x01})
-			}))
+			_, err := e1.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+				kv.Set(key(idn1, j), []byte{0x01})
+				return nil
+			})
+			test.Ok(t, err)
 		}
 	}()
 
@@ -167,17 +351,13 @@ func TestEngineWriterReplication(t *testing.T) {
 	//check if repication was successfull
 	test.Ok(t, e2.View(func(kv *onl.KV) {
 		for j := uint64(0); j < nWrites; j++ {
-			kb := make([]byte, 8)
-			binary.LittleEndian.PutUint64(kb, j)
-			test.Equals(t, []byte{0x01}, kv.Get(kb))
+			test.Equals(t, []byte{0x01}, kv.Get(key(idn1, j)))
 		}
 	}))
 
 	test.Ok(t, e3.View(func(kv *onl.KV) {
 		for j := uint64(0); j < nWrites; j++ {
-			kb := make([]byte, 8)
-			binary.LittleEndian.PutUint64(kb, j)
-			test.Equals(t, []byte{0x01}, kv.Get(kb))
+			test.Equals(t, []byte{0x01}, kv.Get(key(idn1, j)))
 		}
 	}))
 
@@ -219,14 +399,23 @@ func TestEngine3WriteConsensusStepByStep(t *testing.T) {
 	bc2.To(bc3)
 	bc3.To(bc1)
 
-	//write to mempool one-time
+	//write to mempool one-time, each member writes in its own keyspace but reads
+	//the keys of the others such that the writes conflict
+	idns := []*onl.Identity{idn1, idn2, idn3}
+	engines := []*engine.Engine{e1, e2, e3}
 	for j := uint64(0); j < nWrites; j++ {
-		kb := make([]byte, 8)
-		binary.LittleEndian.PutUint64(kb, j)
-
-		test.Ok(t, e1.Update(context.Background(), func(kv *onl.KV) { kv.Set(kb, append([]byte{0x01}, kv.Get(kb)...)) }))
-		test.Ok(t, e2.Update(context.Background(), func(kv *onl.KV) { kv.Set(kb, append([]byte{0x02}, kv.Get(kb)...)) }))
-		test.Ok(t, e3.Update(context.Background(), func(kv *onl.KV) { kv.Set(kb, append([]byte{0x03}, kv.Get(kb)...)) }))
+		for i, e := range engines {
+			idn, v := idns[i], byte(i+1)
+			_, err := e.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+				for _, other := range idns {
+					kv.Get(key(other, j))
+				}
+
+				kv.Set(key(idn, j), []byte{v})
+				return nil
+			})
+			test.Ok(t, err)
+		}
 	}
 
 	//wait for writes to have spread to all members
@@ -256,14 +445,15 @@ func TestEngine3WriteConsensusStepByStep(t *testing.T) {
 	test.Equals(t, e1.Tip(), e3.Tip())
 
 	//check if replication was successfull
-	results := make([][3]byte, nWrites)
+	results := make([][3]string, nWrites)
 	for j := uint64(0); j < nWrites; j++ {
-		kb := make([]byte, 8)
-		binary.LittleEndian.PutUint64(kb, j)
-
-		test.Ok(t, e1.View(func(kv *onl.KV) { results[j][0] = kv.Get(kb)[0] }))
-		test.Ok(t, e2.View(func(kv *onl.KV) { results[j][1] = kv.Get(kb)[0] }))
-		test.Ok(t, e3.View(func(kv *onl.KV) { results[j][2] = kv.Get(kb)[0] }))
+		for i, e := range engines {
+			test.Ok(t, e.View(func(kv *onl.KV) {
+				for _, idn := range idns {
+					results[j][i] += string(kv.Get(key(idn, j)))
+				}
+			}))
+		}
 	}
 
 	//print and test results
@@ -278,7 +468,7 @@ func TestBlockSyncing(t *testing.T) {
 	osc := clock.NewMemOscillator()
 
 	idn1 := onl.NewIdentity([]byte{0x01})
-	idn2 := onl.NewIdentity([]byte{0x02})
+	idn2 := onl.NewIdentity([]byte{0x06})
 
 	genf := func(kv *onl.KV) {
 		kv.CoinbaseTransfer(idn1.PK(), 1)
@@ -321,3 +511,252 @@ func TestBlockSyncing(t *testing.T) {
 	drawPNG(t, e1, "e1.png")
 	drawPNG(t, e2, "e2.png")
 }
+
+func TestFetchCheckpoint(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	bc1, e1, clean1 := testEngine(t, osc, idn1, func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	})
+
+	defer clean1()
+	_, err := e1.Submit(engine.UpdateOpts{}, func(kv *onl.KV) error {
+		kv.Set(key(idn1, 1), []byte{0x02})
+		return nil
+	})
+	test.Ok(t, err)
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond * 3)
+		osc.Fire()
+	}
+
+	//a new member connects and asks for a checkpoint
+	bc2 := broadcast.NewMem(100)
+	bc1.To(bc2)
+	bc2.To(bc1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	//the block and hash of the checkpoint come from a member it trusts
+	trusted, err := e1.Checkpoint(0.5)
+	test.Ok(t, err)
+
+	cp, err := engine.FetchCheckpoint(ctx, bc2, 0.5, trusted.Block.Hash(), trusted.Commitment)
+	test.Ok(t, err)
+	test.Assert(t, cp.Block.Round > 0, "checkpoint should be past the genesis")
+
+	store, cleanstore := onl.TempBadgerStore()
+	defer cleanstore()
+
+	chain, root, err := onl.NewChainFromCheckpoint(store, cp, trusted.Commitment)
+	test.Ok(t, err)
+	test.Equals(t, root, chain.Tip())
+
+	chain.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(key(idn1, 1)))
+	})
+}
+
+// Test that writes of a block that is reverted by a reorg are proposed again
+func TestEngineReorgRepoolsWrites(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x05})
+	osc := clock.NewMemOscillator()
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 1)
+		kv.DepositStake(idn2.PK(), 1, idn2.TokenPK())
+	}
+
+	_, e1, clean1 := testEngine(t, osc, idn1, genf)
+	gen := e1.Tip()
+
+	//the write reads from the genesis state, older writes would be too old
+	gst, err := onl.NewState(nil)
+	test.Ok(t, err)
+	gw, err := gst.Update(func(kv *onl.KV) error { genf(kv); return nil })
+	test.Ok(t, err)
+	st, err := onl.NewState([][]*onl.Write{{gw}})
+	test.Ok(t, err)
+	w1, err := st.Update(func(kv *onl.KV) error { kv.Set(key(idn1, 1), []byte{0x02}); return nil })
+	test.Ok(t, err)
+	test.Ok(t, w1.GenerateNonce())
+	w1.PK = idn1.PK()
+	idn1.SignWrite(w1)
+
+	//a peer's block with the write is appended but then out-ranked
+	b1 := idn1.Mint(1, gen, gen, 1)
+	b1.AppendWrite(w1)
+	idn1.Sign(b1)
+	e1.Handle(&engine.Msg{Block: b1})
+	test.Equals(t, b1.Hash(), e1.Tip())
+
+	b2 := idn2.Mint(2, gen, gen, 1)
+	idn2.Sign(b2)
+	e1.Handle(&engine.Msg{Block: b2})
+	test.Equals(t, b2.Hash(), e1.Tip())
+
+	//the next block we propose should include the reverted write
+	osc.Fire()
+	clean1()
+
+	test.Ok(t, e1.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(key(idn1, 1)))
+	}))
+}
+
+func TestEngineSyncing(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	}
+
+	bc1, e1, clean1 := testEngine(t, osc, idn1, genf)
+	defer clean1()
+
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond * 3)
+		osc.Fire()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	t.Run("ranged sync", func(t *testing.T) {
+		bc := broadcast.NewMem(100)
+		bc.To(bc1)
+		test.Ok(t, bc.Write(&engine.Msg{SyncRounds: &engine.SyncRounds{From: 2, To: 4}}))
+
+		for r := uint64(2); r <= 4; r++ {
+			msg := &engine.Msg{}
+			test.Ok(t, bc.Read(msg))
+			test.Equals(t, r, msg.Block.Round)
+		}
+	})
+
+	t.Run("empty range", func(t *testing.T) {
+		var n int
+		s := &engine.SyncRounds{From: 4, To: 2}
+		s.SetWF(func(b *onl.Block) error { n++; return nil })
+		e1.Handle(&engine.Msg{SyncRounds: s})
+		test.Equals(t, 0, n)
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		store, clean := onl.TempBadgerStore()
+		defer clean()
+		_, gen, err := onl.NewChain(store, 0, genf)
+		test.Ok(t, err)
+
+		bc := broadcast.NewMem(100)
+		bc.To(bc1)
+		test.Ok(t, bc.Write(&engine.Msg{HeadersReq: &engine.HeadersReq{Known: []onl.ID{gen}}}))
+
+		msg := &engine.Msg{}
+		test.Ok(t, bc.Read(msg))
+		test.Equals(t, 20, len(msg.Headers))
+		test.Equals(t, gen, msg.Headers[0].Prev)
+		test.Equals(t, e1.Tip(), msg.Headers[19].Hash())
+	})
+
+	t.Run("catch up", func(t *testing.T) {
+		idn2 := onl.NewIdentity([]byte{0x02})
+		bc2, e2, clean2 := testEngine(t, osc, idn2, genf)
+		defer clean2()
+
+		bc1.To(bc2)
+		bc2.To(bc1)
+
+		//the first block of the next round is far ahead, e2 should catch up
+		osc.Fire()
+		time.Sleep(time.Millisecond * 500)
+		test.Equals(t, e1.Tip(), e2.Tip())
+	})
+}
+
+func TestEngineFetchingFromPeers(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	osc := clock.NewMemOscillator()
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	}
+
+	//a chain that is far ahead of the engine
+	store, clean := onl.TempBadgerStore()
+	defer clean()
+	c1, gen, err := onl.NewChain(store, 0, genf)
+	test.Ok(t, err)
+
+	n := 2*engine.SyncBatchesPerPeer*engine.SyncBatchSize + 10
+	for r := uint64(1); r <= uint64(n); r++ {
+		stable, err := c1.Stable(c1.Tip(), r)
+		test.Ok(t, err)
+
+		b := idn1.Mint(r, c1.Tip(), stable, r)
+		idn1.Sign(b)
+		test.Ok(t, c1.Append(b))
+	}
+
+	hdrs, err := c1.Headers([]onl.ID{gen})
+	test.Ok(t, err)
+	test.Equals(t, n, len(hdrs))
+
+	_, e1, clean1 := testEngine(t, osc, onl.NewIdentity([]byte{0x02}), genf)
+	defer clean1()
+
+	//both peers send us the headers, they are asked for different blocks
+	peer := func(name string) (msg *engine.Msg, reqs chan []onl.ID) {
+		reqs = make(chan []onl.ID, 10)
+		msg = &engine.Msg{Headers: hdrs}
+		msg.SetPeer(name)
+		msg.SetWF(func(m *engine.Msg) error { reqs <- m.Sync.IDs; return nil })
+		return
+	}
+
+	requested := func(reqs chan []onl.ID, nbatches int) (ids map[onl.ID]struct{}) {
+		ids = make(map[onl.ID]struct{})
+		for i := 0; i < nbatches; i++ {
+			select {
+			case batch := <-reqs:
+				for _, id := range batch {
+					ids[id] = struct{}{}
+				}
+
+			case <-time.After(time.Second):
+				t.Fatal("peer should have been asked for a batch")
+			}
+		}
+
+		return
+	}
+
+	msg1, reqs1 := peer("peer1")
+	e1.Handle(msg1)
+	ids1 := requested(reqs1, engine.SyncBatchesPerPeer)
+	test.Equals(t, engine.SyncBatchesPerPeer*engine.SyncBatchSize, len(ids1))
+
+	msg2, reqs2 := peer("peer2")
+	e1.Handle(msg2)
+	ids2 := requested(reqs2, engine.SyncBatchesPerPeer)
+	test.Equals(t, engine.SyncBatchesPerPeer*engine.SyncBatchSize, len(ids2))
+	for id := range ids2 {
+		_, ok := ids1[id]
+		test.Equals(t, false, ok)
+	}
+
+	//once a block arrives the peer is asked for the remaining blocks, also if
+	//the block could not be appended because its prev didn't arrive yet
+	_, ok := ids1[hdrs[1].Hash()]
+	test.Equals(t, true, ok)
+	b2, _, _, err := c1.Read(hdrs[1].Hash())
+	test.Ok(t, err)
+	e1.Handle(&engine.Msg{Block: b2})
+	test.Equals(t, 10, len(requested(reqs1, 1)))
+	test.Equals(t, 0, len(reqs2))
+}
@@ -5,4 +5,7 @@ import "errors"
 var (
 	ErrAlreadyInPool         = errors.New("write is already in pool")
 	ErrInvalidWriteSignature = errors.New("write signature is invalid")
+	ErrPoolFull              = errors.New("pool is full with writes of a higher priority")
+	ErrSenderLimit           = errors.New("pool holds the maximum number of writes for the sender")
+	ErrWriteDropped          = errors.New("write is neither in the pool nor in the chain")
 )
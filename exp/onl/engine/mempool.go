@@ -1,43 +1,110 @@
 package engine
 
 import (
+	"bytes"
+	"sort"
 	"sync"
 
 	"github.com/advanderveer/27067dd17/onl"
 )
 
+const (
+	//DefaultPoolWrites is the default maximum number of writes in the pool
+	DefaultPoolWrites = 4096
+
+	//DefaultPoolBytes is the default maximum encoded size of all writes in the pool
+	DefaultPoolBytes = 16 * onl.MaxBlockSize
+
+	//DefaultSenderWrites is the default maximum number of writes in the pool
+	//that are signed by the same identity
+	DefaultSenderWrites = 256
+)
+
 //MemPool stores pending writes before they are committed into the chain
 type MemPool struct {
-	writes map[onl.Nonce]*onl.Write
-	mu     sync.RWMutex
+	writes  map[onl.Nonce]*pooled
+	senders map[onl.PK]int
+	size    int
+	seq     uint64
+	mu      sync.RWMutex
+
+	maxWrites int
+	maxBytes  int
+	maxSender int
 
 	//for inspiration about mempool handling in bitcoin:
 	//https://blog.kaiko.com/an-in-depth-guide-into-how-the-mempool-works-c758b781c608
 	//https://bitcoin.stackexchange.com/questions/59257/what-going-to-happend-with-transactions-that-is-in-both-rejectend-and-accepted-c
 }
 
-//NewMemPool creates a new mem pool
+//pooled is a write in the pool with what is needed to prioritize it
+type pooled struct {
+	*onl.Write
+	seq  uint64 //order of arrival, lower is older
+	size int
+}
+
+//before returns whether pooled write 'a' has priority over 'b'. Writes that pay
+//a higher fee go first, then older writes. The nonce breaks ties so the order
+//is always the same.
+func before(a, b *pooled) bool {
+	if a.Fee != b.Fee {
+		return a.Fee > b.Fee
+	}
+
+	if a.seq != b.seq {
+		return a.seq < b.seq
+	}
+
+	return bytes.Compare(a.Nonce[:], b.Nonce[:]) < 0
+}
+
+//NewMemPool creates a new mem pool with the default limits
 func NewMemPool() (p *MemPool) {
-	p = &MemPool{writes: make(map[onl.Nonce]*onl.Write)}
+	p = &MemPool{
+		writes:  make(map[onl.Nonce]*pooled),
+		senders: make(map[onl.PK]int),
+
+		maxWrites: DefaultPoolWrites,
+		maxBytes:  DefaultPoolBytes,
+		maxSender: DefaultSenderWrites,
+	}
 	return
 }
 
+//Limit configures the maximum number of writes, the maximum number of bytes
+//and the maximum number of writes per signing identity the pool holds. Writes
+//that are already in the pool are not removed when the limits are lowered.
+func (p *MemPool) Limit(writes, size, perSender int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxWrites, p.maxBytes, p.maxSender = writes, size, perSender
+}
+
 // Pick writes from the mempool that are not in the provided tip and do not
-// cause a conflict in the chosen order. It calls f for every suitable write.
-func (p *MemPool) Pick(state *onl.State, f func(w *onl.Write) bool) {
+// cause a conflict, in order of priority. It calls f for every suitable write.
+// Writes that take up more bytes than what is left of the budget are skipped.
+func (p *MemPool) Pick(state *onl.State, budget int, f func(w *onl.Write) bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	for _, w := range p.writes {
+	//picked writes are applied to a copy of the state, such that writes that
+	//conflict with writes picked earlier are skipped
+	state = state.Clone()
+	for _, pw := range p.sorted() {
+		if pw.size > budget {
+			continue
+		}
 
 		//apply will check if the write would conflict or is alreayd applied
 		//to the provided state
-		err := state.Apply(w, true)
+		err := state.Apply(pw.Write, false)
 		if err != nil {
 			continue
 		}
 
-		stop := f(w)
+		budget -= pw.size
+		stop := f(pw.Write)
 		if stop {
 			break
 		}
@@ -49,6 +116,11 @@ func (p *MemPool) Pick(state *onl.State, f func(w *onl.Write) bool) {
 // Add will attempt to put a write in the mempool if it returns an error it failed
 // to do so
 func (p *MemPool) Add(w *onl.Write) (err error) {
+	err = w.CheckLimits()
+	if err != nil {
+		return err
+	}
+
 	if !w.VerifySignature() {
 		return ErrInvalidWriteSignature
 	}
@@ -61,6 +133,128 @@ func (p *MemPool) Add(w *onl.Write) (err error) {
 		return ErrAlreadyInPool
 	}
 
-	p.writes[w.Nonce] = w
+	if p.senders[w.PK] >= p.maxSender {
+		return ErrSenderLimit
+	}
+
+	//a write that is larger than the whole pool will never fit
+	pw := &pooled{Write: w, seq: p.seq, size: w.Size()}
+	if pw.size > p.maxBytes {
+		return ErrPoolFull
+	}
+
+	//when full, make room by evicting writes that have a lower priority
+	n, size := len(p.writes)+1, p.size+pw.size
+	if n > p.maxWrites || size > p.maxBytes {
+		var evict []*pooled
+		for pws := p.sorted(); n > p.maxWrites || size > p.maxBytes; pws = pws[:len(pws)-1] {
+			if len(pws) < 1 {
+				return ErrPoolFull
+			}
+
+			low := pws[len(pws)-1]
+			if !before(pw, low) {
+				return ErrPoolFull
+			}
+
+			evict = append(evict, low)
+			n, size = n-1, size-low.size
+		}
+
+		for _, low := range evict {
+			p.remove(low)
+		}
+	}
+
+	p.seq++
+	p.add(pw)
+	return
+}
+
+// Clean removes all writes that were already applied to the provided state,
+// conflict with it or are too old to ever be applied to it. The state should be
+// finalized, such that removed writes will not be needed on another fork.
+func (p *MemPool) Clean(state *onl.State) (n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for nonce, pw := range p.writes {
+		if state.Applied(nonce) {
+			p.remove(pw)
+			n++
+			continue
+		}
+
+		switch state.Apply(pw.Write, true) {
+		case onl.ErrApplyConflict, onl.ErrWriteTooOld:
+			p.remove(pw)
+			n++
+		}
+	}
+
+	return
+}
+
+// Expire removes all writes that can no longer be included in a block of
+// round 'round', it returns how many were removed
+func (p *MemPool) Expire(round uint64) (n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pw := range p.writes {
+		if pw.Expired(round) {
+			p.remove(pw)
+			n++
+		}
+	}
+
+	return
+}
+
+// Has returns whether the write with nonce 'nonce' is in the pool
+func (p *MemPool) Has(nonce onl.Nonce) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.writes[nonce]
+	return ok
+}
+
+// Len returns the number of writes in the pool
+func (p *MemPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.writes)
+}
+
+// Size returns the encoded size of all writes in the pool
+func (p *MemPool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.size
+}
+
+func (p *MemPool) add(pw *pooled) {
+	p.writes[pw.Nonce] = pw
+	p.senders[pw.PK]++
+	p.size += pw.size
+}
+
+func (p *MemPool) remove(pw *pooled) {
+	delete(p.writes, pw.Nonce)
+	p.size -= pw.size
+	p.senders[pw.PK]--
+	if p.senders[pw.PK] < 1 {
+		delete(p.senders, pw.PK)
+	}
+}
+
+//sorted returns the pooled writes in order of priority
+func (p *MemPool) sorted() (pws []*pooled) {
+	pws = make([]*pooled, 0, len(p.writes))
+	for _, pw := range p.writes {
+		pws = append(pws, pw)
+	}
+
+	sort.Slice(pws, func(i, j int) bool { return before(pws[i], pws[j]) })
 	return
 }
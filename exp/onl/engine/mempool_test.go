@@ -12,10 +12,13 @@ func TestBasicMemPool(t *testing.T) {
 	idn1 := onl.NewIdentity([]byte{0x01})
 	p1 := engine.NewMemPool()
 
+	pk := idn1.PK()
 	st1, _ := onl.NewState(nil)
-	w1 := st1.Update(func(kv *onl.KV) {
-		kv.Set([]byte{0x01}, []byte{0x02})
+	w1, err := st1.Update(func(kv *onl.KV) error {
+		kv.Set(append(pk[:], 0x01), []byte{0x02})
+		return nil
 	})
+	test.Ok(t, err)
 
 	test.Ok(t, w1.GenerateNonce())
 	w1.PK = idn1.PK()
@@ -28,7 +31,7 @@ func TestBasicMemPool(t *testing.T) {
 
 	t.Run("should pick if not applied", func(t *testing.T) {
 		var picked []*onl.Write
-		p1.Pick(st1, func(w *onl.Write) bool {
+		p1.Pick(st1, onl.MaxBlockSize, func(w *onl.Write) bool {
 			picked = append(picked, w)
 			return false
 		})
@@ -36,11 +39,21 @@ func TestBasicMemPool(t *testing.T) {
 		test.Equals(t, []*onl.Write{w1}, picked)
 	})
 
+	t.Run("should not pick if over budget", func(t *testing.T) {
+		var picked []*onl.Write
+		p1.Pick(st1, w1.Size()-1, func(w *onl.Write) bool {
+			picked = append(picked, w)
+			return false
+		})
+
+		test.Equals(t, 0, len(picked))
+	})
+
 	t.Run("should not pick if applied", func(t *testing.T) {
 		test.Ok(t, st1.Apply(w1, false))
 
 		var picked []*onl.Write
-		p1.Pick(st1, func(w *onl.Write) bool {
+		p1.Pick(st1, onl.MaxBlockSize, func(w *onl.Write) bool {
 			picked = append(picked, w)
 			return false
 		})
@@ -48,4 +61,177 @@ func TestBasicMemPool(t *testing.T) {
 		test.Equals(t, 0, len(picked))
 	})
 
+	t.Run("should clean if applied", func(t *testing.T) {
+		test.Equals(t, 1, p1.Len())
+		p1.Clean(st1)
+		test.Equals(t, 0, p1.Len())
+	})
+
+	t.Run("should expire writes", func(t *testing.T) {
+		w2, err := st1.Update(func(kv *onl.KV) error {
+			kv.Set(append(pk[:], 0x02), []byte{0x02})
+			return nil
+		})
+		test.Ok(t, err)
+
+		w2.PK = idn1.PK()
+		w2.ValidUntil = 5
+		test.Ok(t, w2.GenerateNonce())
+		idn1.SignWrite(w2)
+		test.Ok(t, p1.Add(w2))
+
+		test.Equals(t, 0, p1.Expire(5))
+		test.Equals(t, 1, p1.Expire(6))
+		test.Equals(t, 0, p1.Len())
+	})
+
+}
+
+//poolWrite creates a signed write by 'idn' that reads and writes key 'k' in its keyspace
+func poolWrite(t *testing.T, st *onl.State, idn *onl.Identity, k byte) *onl.Write {
+	w, err := st.Update(func(kv *onl.KV) error {
+		kv.Get(key(idn, 0))
+		kv.Set(key(idn, uint64(k)), []byte{k})
+		return nil
+	})
+
+	test.Ok(t, err)
+	test.Ok(t, w.GenerateNonce())
+	w.PK = idn.PK()
+	idn.SignWrite(w)
+	return w
+}
+
+func TestMemPoolPriority(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	st1, _ := onl.NewState(nil)
+	p1 := engine.NewMemPool()
+
+	w1, w2, w3 := poolWrite(t, st1, idn1, 1), poolWrite(t, st1, idn1, 2), poolWrite(t, st1, idn1, 3)
+	test.Ok(t, p1.Add(w3))
+	test.Ok(t, p1.Add(w1))
+	test.Ok(t, p1.Add(w2))
+
+	//older writes are picked first, every time
+	for i := 0; i < 10; i++ {
+		var picked []*onl.Write
+		p1.Pick(st1, onl.MaxBlockSize, func(w *onl.Write) bool {
+			picked = append(picked, w)
+			return false
+		})
+
+		test.Equals(t, []*onl.Write{w3, w1, w2}, picked)
+	}
+
+	t.Run("should pick writes with a higher fee first", func(t *testing.T) {
+		gst, _ := onl.NewState(nil)
+		gw, err := gst.Update(func(kv *onl.KV) error { kv.CoinbaseTransfer(idn1.PK(), 1); return nil })
+		test.Ok(t, err)
+		st2, err := onl.NewState([][]*onl.Write{{gw}})
+		test.Ok(t, err)
+
+		w4 := poolWrite(t, st1, idn1, 4)
+		w4.Fee = 1
+		idn1.SignWrite(w4)
+		test.Ok(t, p1.Add(w4))
+
+		var picked []*onl.Write
+		p1.Pick(st2, onl.MaxBlockSize, func(w *onl.Write) bool {
+			picked = append(picked, w)
+			return false
+		})
+
+		test.Equals(t, []*onl.Write{w4, w3, w1, w2}, picked)
+	})
+
+	t.Run("should skip writes that conflict with picked writes", func(t *testing.T) {
+		w4, err := st1.Update(func(kv *onl.KV) error {
+			kv.Set(key(idn1, 0), []byte{0x04})
+			return nil
+		})
+
+		test.Ok(t, err)
+		test.Ok(t, w4.GenerateNonce())
+		w4.PK = idn1.PK()
+		idn1.SignWrite(w4)
+
+		p2 := engine.NewMemPool()
+		test.Ok(t, p2.Add(w4))
+		test.Ok(t, p2.Add(w1))
+
+		var picked []*onl.Write
+		p2.Pick(st1, onl.MaxBlockSize, func(w *onl.Write) bool {
+			picked = append(picked, w)
+			return false
+		})
+
+		test.Equals(t, []*onl.Write{w4}, picked)
+
+		//once settled, the conflicting write is removed
+		test.Ok(t, st1.Apply(w4, false))
+		test.Equals(t, 2, p2.Clean(st1))
+		test.Equals(t, 0, p2.Len())
+	})
+}
+
+func TestMemPoolLimits(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x02})
+	st1, _ := onl.NewState(nil)
+
+	w1, w2, w3 := poolWrite(t, st1, idn1, 1), poolWrite(t, st1, idn1, 2), poolWrite(t, st1, idn2, 3)
+
+	t.Run("by count", func(t *testing.T) {
+		p1 := engine.NewMemPool()
+		p1.Limit(2, onl.MaxBlockSize, 2)
+		test.Ok(t, p1.Add(w1))
+		test.Ok(t, p1.Add(w2))
+		test.Equals(t, engine.ErrPoolFull, p1.Add(w3))
+		test.Equals(t, 2, p1.Len())
+	})
+
+	t.Run("by bytes", func(t *testing.T) {
+		p1 := engine.NewMemPool()
+		p1.Limit(10, w1.Size()+w2.Size(), 10)
+		test.Ok(t, p1.Add(w1))
+		test.Ok(t, p1.Add(w2))
+		test.Equals(t, w1.Size()+w2.Size(), p1.Size())
+		test.Equals(t, engine.ErrPoolFull, p1.Add(w3))
+	})
+
+	t.Run("larger than the pool", func(t *testing.T) {
+		p1 := engine.NewMemPool()
+		p1.Limit(10, w1.Size()-1, 10)
+		test.Equals(t, engine.ErrPoolFull, p1.Add(w1))
+		test.Equals(t, 0, p1.Len())
+
+		//also when there is nothing left to evict
+		p1.Limit(0, w2.Size(), 10)
+		test.Equals(t, engine.ErrPoolFull, p1.Add(w2))
+		test.Equals(t, 0, p1.Size())
+	})
+
+	t.Run("by protocol limits", func(t *testing.T) {
+		w4 := poolWrite(t, st1, idn2, 4)
+		for i := 0; i <= onl.MaxWriteRows; i++ {
+			w4.WriteRows.Add([]byte{byte(i >> 8), byte(i)}, nil)
+		}
+
+		p1 := engine.NewMemPool()
+		test.Equals(t, onl.ErrTooManyWriteRows, p1.Add(w4))
+	})
+
+	t.Run("by sender", func(t *testing.T) {
+		p1 := engine.NewMemPool()
+		p1.Limit(10, onl.MaxBlockSize, 1)
+		test.Ok(t, p1.Add(w1))
+		test.Equals(t, engine.ErrSenderLimit, p1.Add(w2))
+		test.Ok(t, p1.Add(w3))
+
+		//removed writes make room for the sender again
+		test.Ok(t, st1.Apply(w1, false))
+		test.Equals(t, 1, p1.Clean(st1))
+		test.Ok(t, p1.Add(w2))
+		test.Equals(t, 2, p1.Len())
+	})
 }
@@ -1,11 +1,30 @@
 package engine
 
 import (
+	"net"
 	"sync"
 
 	"github.com/advanderveer/27067dd17/onl"
 )
 
+const (
+	//DefaultOrphans is the default maximum number of messages that wait on a
+	//block or round
+	DefaultOrphans = 2 * onl.MaxHeaders
+
+	//DefaultOrphanBytes is the default maximum encoded size of all blocks that
+	//wait on a block or round
+	DefaultOrphanBytes = 16 * onl.MaxBlockSize
+
+	//DefaultPeerOrphans is the default maximum number of waiting messages that
+	//were read from the same peer
+	DefaultPeerOrphans = onl.MaxHeaders
+
+	//DefaultOrphanExpiry is the default number of rounds a message waits before
+	//it is dropped
+	DefaultOrphanExpiry = 64
+)
+
 //Handler handles messages
 type Handler interface {
 	Handle(msg *Msg)
@@ -22,115 +41,309 @@ func (h HandlerFunc) Handle(msg *Msg) { h(msg) }
 type OutOfOrder struct {
 	handler   Handler
 	broadcast BroadcastWriter
+	known     func(id onl.ID) bool
 
 	mu       sync.RWMutex
-	onBlocks map[onl.ID][]*Msg
-	onRounds map[uint64][]*Msg
+	onBlocks map[onl.ID][]*orphan
+	onRounds map[uint64][]*orphan
+	round    uint64 //highest round that was resolved
+
+	//blocks that were resolved recently, older blocks are looked up through
+	//known such that this doesn't grow with the chain
+	resolved map[onl.ID]struct{}
+
+	//accounting of the waiting messages, per peer they are counted by host
+	//such that a peer cannot get around the limit by reconnecting
+	n     int
+	size  int
+	peers map[string]int
+
+	//when missing blocks are requested again
+	syncs map[onl.ID]*backoff
+
+	maxOrphans int
+	maxBytes   int
+	maxPeer    int
+	expiry     uint64
+}
+
+//orphan is a message that waits on a block or round
+type orphan struct {
+	*Msg
+	id    onl.ID //of the block, if any
+	size  int
+	since uint64 //round in which it started waiting
 }
 
-//NewOutOfOrder creates a new OutOfOrder
-func NewOutOfOrder(h Handler, bc BroadcastWriter) *OutOfOrder {
+//backoff schedules sync requests for a missing block
+type backoff struct {
+	next uint64 //round in which it is requested again
+	wait uint64 //rounds to wait after the next request
+}
+
+//NewOutOfOrder creates a new OutOfOrder with the default limits. Blocks that
+//were resolved longer than the expiry ago are only considered resolved when
+//'known' returns true for them, it may be nil.
+func NewOutOfOrder(h Handler, bc BroadcastWriter, known func(id onl.ID) bool) *OutOfOrder {
 	return &OutOfOrder{
 		broadcast: bc,
 		handler:   h,
-		onBlocks:  make(map[onl.ID][]*Msg),
-		onRounds:  make(map[uint64][]*Msg),
+		known:     known,
+		onBlocks:  make(map[onl.ID][]*orphan),
+		onRounds:  make(map[uint64][]*orphan),
+		resolved:  make(map[onl.ID]struct{}),
+		peers:     make(map[string]int),
+		syncs:     make(map[onl.ID]*backoff),
+
+		maxOrphans: DefaultOrphans,
+		maxBytes:   DefaultOrphanBytes,
+		maxPeer:    DefaultPeerOrphans,
+		expiry:     DefaultOrphanExpiry,
 	}
 }
 
-//ResolveRound will resolve blocks that are waiting on the round to start
+//Limit configures the maximum number of waiting messages, their maximum total
+//size, the maximum number of waiting messages per peer and the number of rounds
+//after which waiting messages are dropped. Messages that are already waiting
+//are not dropped when the limits are lowered.
+func (o *OutOfOrder) Limit(orphans, size, perPeer int, expiry uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.maxOrphans, o.maxBytes, o.maxPeer, o.expiry = orphans, size, perPeer, expiry
+}
+
+//Orphans returns the number of messages that are waiting and their total size
+func (o *OutOfOrder) Orphans() (n, size int) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.n, o.size
+}
+
+//ResolveRound will resolve blocks that are waiting on the round to start, drop
+//messages that waited too long and ask peers for blocks that are missing
 func (o *OutOfOrder) ResolveRound(nr uint64) {
 	o.mu.Lock()
-	defers, ok := o.onRounds[nr]
-	o.onRounds[nr] = nil
+	defers := o.take(o.onRounds[nr])
+	delete(o.onRounds, nr)
+	if nr > o.round {
+		o.round = nr
+	}
+
+	o.expire(nr)
 
 	var syncids []onl.ID
-	for id, msgs := range o.onBlocks {
-		if msgs == nil {
+	for id := range o.onBlocks {
+
+		//upon resolving a round, send out syncs to peers for blocks that we're
+		//waiting on from previous rounds. Each time a block is requested we
+		//wait twice as long before requesting it again.
+		if id.Round() > nr {
+			continue
+		}
+
+		bo, ok := o.syncs[id]
+		if !ok {
+			bo = &backoff{next: nr, wait: 1}
+			o.syncs[id] = bo
+		}
+
+		if bo.next > nr {
 			continue
 		}
 
-		//upon resolving a round, send out syncs to peers for all blocks
-		//that we're waiting on from previous rounds
-		if id.Round() <= nr {
-			syncids = append(syncids, id)
+		syncids = append(syncids, id)
+		bo.next = nr + bo.wait
+		if bo.wait < o.expiry {
+			bo.wait *= 2
 		}
 	}
 
 	o.mu.Unlock()
 
-	err := o.broadcast.Write(&Msg{Sync: &Sync{IDs: syncids}})
-	if err != nil {
-		//@TODO handle
+	if len(syncids) > 0 {
+		err := o.broadcast.Write(&Msg{Sync: &Sync{IDs: syncids}})
+		if err != nil {
+			//@TODO handle
+		}
 	}
 
-	if ok {
-		for _, msg := range defers {
-			o.Handle(msg)
-		}
+	for _, msg := range defers {
+		o.Handle(msg)
 	}
 }
 
 //Resolve will handle any messages that depended on this block
 func (o *OutOfOrder) Resolve(id onl.ID) {
 	o.mu.Lock()
-	defers, ok := o.onBlocks[id]
-	o.onBlocks[id] = nil
+	defers := o.take(o.onBlocks[id])
+	delete(o.onBlocks, id)
+	delete(o.syncs, id)
+	o.resolved[id] = struct{}{}
 	o.mu.Unlock()
 
-	if ok {
-		for _, msg := range defers {
-			o.Handle(msg)
-		}
+	for _, msg := range defers {
+		o.Handle(msg)
+	}
+}
+
+//Forget drops any messages that depended on these blocks, they will never be
+//resolved.
+func (o *OutOfOrder) Forget(ids ...onl.ID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, id := range ids {
+		o.take(o.onBlocks[id])
+		delete(o.onBlocks, id)
+		delete(o.syncs, id)
+		delete(o.resolved, id)
 	}
 }
 
 //Handle will try to handle the message unless it waits for a block or round
-//to resolve first
+//to resolve first. If the message would need to wait but the limits are
+//reached, it is dropped.
 func (o *OutOfOrder) Handle(msg *Msg) {
-	var (
-		bdepResolved bool
-		rdepResolved bool
-	)
 
 	//aks for block and round deps
 	bdep, rdep := msg.Dependency()
 
 	o.mu.Lock()
 
-	//if there is a block dependency, check if it was resolved
-	//already or else add it to the block defer. In that case
-	//it will not be resolved
-	if bdep != onl.NilID {
-		ex, ok := o.onBlocks[bdep]
-		if ok && ex == nil {
-			bdepResolved = true
-		} else if !ok { //only add if not exist
-			ex = append(ex, msg)
-			o.onBlocks[bdep] = ex
+	//if there is a block dependency, check if it was resolved already. If
+	//not the message waits on the block, once resolved it is handled again
+	//and it may have to wait on its round
+	if bdep != onl.NilID && !o.isResolved(bdep) {
+		ex := o.onBlocks[bdep]
+		if orph := o.orphan(ex, msg); orph != nil {
+			o.onBlocks[bdep] = append(ex, orph)
 		}
-	} else {
-		bdepResolved = true //no block dep, always resolved
-	}
-
-	//if there is a round dependency, check if it was already resolved
-	//or else schedule it for resolving and don't mark it as such
-	if rdep > 0 {
-		ex, ok := o.onRounds[rdep]
-		if ok && ex == nil {
-			rdepResolved = true
-		} else if !ok { //only add if ot exist
-			ex = append(ex, msg)
-			o.onRounds[rdep] = ex
+
+		o.mu.Unlock()
+		return
+	}
+
+	//if there is a round dependency, check if it was already resolved. Rounds
+	//before the last resolved round count as resolved as well, blocks from
+	//those are synced from peers.
+	if rdep > o.round {
+		if orph := o.orphan(o.onRounds[rdep], msg); orph != nil {
+			o.onRounds[rdep] = append(o.onRounds[rdep], orph)
 		}
-	} else {
-		rdepResolved = true //no round dep, always resolved
+
+		o.mu.Unlock()
+		return
 	}
 
 	o.mu.Unlock()
 
-	//if both are resolved we can finally call the handle
-	if rdepResolved && bdepResolved {
-		go o.handler.Handle(msg)
+	//both are resolved we can finally call the handle
+	go o.handler.Handle(msg)
+}
+
+//isResolved returns whether block 'id' was resolved, the lock must be held such
+//that the block cannot be resolved while the message is being orphaned
+func (o *OutOfOrder) isResolved(id onl.ID) bool {
+	if _, ok := o.resolved[id]; ok {
+		return true
+	}
+
+	return o.known != nil && o.known(id)
+}
+
+//peerHost returns the host of the peer a message was read from, without the
+//port, or the peer as is if it isn't a network address
+func peerHost(msg *Msg) string {
+	host, _, err := net.SplitHostPort(msg.Peer())
+	if err != nil {
+		return msg.Peer()
+	}
+
+	return host
+}
+
+//orphan accounts for a message that is to wait with the 'waiting' messages, it
+//returns nil if the same block is already waiting or if the limits are reached
+func (o *OutOfOrder) orphan(waiting []*orphan, msg *Msg) (orph *orphan) {
+	orph = &orphan{Msg: msg, since: o.round}
+	if msg.Block != nil {
+		orph.id, orph.size = msg.Block.Hash(), msg.Block.Size()
+		for _, w := range waiting {
+			if w.Block != nil && w.id == orph.id {
+				return nil //relayed by multiple peers
+			}
+		}
+	}
+
+	if o.n+1 > o.maxOrphans ||
+		o.size+orph.size > o.maxBytes ||
+		o.peers[peerHost(msg)]+1 > o.maxPeer {
+		return nil
+	}
+
+	o.n++
+	o.size += orph.size
+	o.peers[peerHost(msg)]++
+	return orph
+}
+
+//take removes the accounting of messages that stop waiting
+func (o *OutOfOrder) take(orphans []*orphan) (msgs []*Msg) {
+	for _, orph := range orphans {
+		o.n--
+		o.size -= orph.size
+		host := peerHost(orph.Msg)
+		o.peers[host]--
+		if o.peers[host] < 1 {
+			delete(o.peers, host)
+		}
+
+		msgs = append(msgs, orph.Msg)
+	}
+
+	return
+}
+
+//expire drops all messages that waited more than the expiry by round 'nr'
+func (o *OutOfOrder) expire(nr uint64) {
+	if nr <= o.expiry {
+		return
+	}
+
+	keep := func(orphans []*orphan) (kept []*orphan) {
+		for _, orph := range orphans {
+			if orph.since >= nr-o.expiry {
+				kept = append(kept, orph)
+				continue
+			}
+
+			o.take([]*orphan{orph})
+		}
+
+		return
+	}
+
+	for id, orphans := range o.onBlocks {
+		if orphans = keep(orphans); orphans == nil {
+			delete(o.onBlocks, id)
+			delete(o.syncs, id)
+			continue
+		}
+
+		o.onBlocks[id] = orphans
+	}
+
+	for rn, orphans := range o.onRounds {
+		if orphans = keep(orphans); orphans == nil {
+			delete(o.onRounds, rn)
+			continue
+		}
+
+		o.onRounds[rn] = orphans
+	}
+
+	for id := range o.resolved {
+		if id.Round() < nr-o.expiry {
+			delete(o.resolved, id)
+		}
 	}
 }
@@ -2,6 +2,7 @@ package engine_test
 
 import (
 	"encoding/binary"
+	"math"
 	"sync"
 	"testing"
 	"time"
@@ -39,7 +40,7 @@ func TestOoOHandling(t *testing.T) {
 		defer mu.Unlock()
 		handled = append(handled, msg)
 	})
-	o1 := engine.NewOutOfOrder(h1, bc)
+	o1 := engine.NewOutOfOrder(h1, bc, nil)
 
 	msg1 := &engine.Msg{}
 	o1.Handle(msg1)
@@ -83,7 +84,7 @@ func TestOutOfOrderBeforeAnyHandle(t *testing.T) {
 		defer mu.Unlock()
 		handled = append(handled, msg)
 	})
-	o1 := engine.NewOutOfOrder(h1, bc)
+	o1 := engine.NewOutOfOrder(h1, bc, nil)
 
 	o1.Resolve(bid1)
 	msg2 := &engine.Msg{Block: &onl.Block{Prev: bid1}}
@@ -105,7 +106,7 @@ func TestOutOfOrderRoundAndBlock(t *testing.T) {
 			defer mu.Unlock()
 			handled = append(handled, msg)
 		})
-		o1 := engine.NewOutOfOrder(h1, bc)
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
 
 		msg2 := &engine.Msg{Block: &onl.Block{Round: 1, Prev: bid1}}
 		o1.Handle(msg2)
@@ -135,7 +136,7 @@ func TestOutOfOrderRoundAndBlock(t *testing.T) {
 			defer mu.Unlock()
 			handled = append(handled, msg)
 		})
-		o1 := engine.NewOutOfOrder(h1, bc)
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
 
 		msg2 := &engine.Msg{Block: &onl.Block{Round: 1, Prev: bid1}}
 		o1.Handle(msg2)
@@ -160,7 +161,7 @@ func TestOutOfOrderRoundAndBlock(t *testing.T) {
 func TestOutOfOrderConcurrency(t *testing.T) {
 	bc1 := broadcast.NewMem(100)
 	h1 := engine.HandlerFunc(func(msg *engine.Msg) {})
-	o1 := engine.NewOutOfOrder(h1, bc1)
+	o1 := engine.NewOutOfOrder(h1, bc1, nil)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -190,3 +191,204 @@ func TestOutOfOrderConcurrency(t *testing.T) {
 	wg.Wait()
 
 }
+
+func TestOutOfOrderForget(t *testing.T) {
+	bc := broadcast.NewMem(100)
+	var mu sync.Mutex
+	var handled []*engine.Msg
+	h1 := engine.HandlerFunc(func(msg *engine.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg)
+	})
+	o1 := engine.NewOutOfOrder(h1, bc, nil)
+
+	msg1 := &engine.Msg{Block: &onl.Block{Prev: bid1}}
+	o1.Handle(msg1)
+	o1.Forget(bid1)
+
+	o1.Resolve(bid1)
+	time.Sleep(time.Millisecond)
+	mu.Lock()
+	test.Equals(t, 0, len(handled)) //forgotten, should not be handled
+	mu.Unlock()
+}
+
+func TestOutOfOrderMultipleWaiting(t *testing.T) {
+	bc := broadcast.NewMem(100)
+	var mu sync.Mutex
+	var handled []*engine.Msg
+	h1 := engine.HandlerFunc(func(msg *engine.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg)
+	})
+	o1 := engine.NewOutOfOrder(h1, bc, nil)
+
+	msg1 := &engine.Msg{Block: &onl.Block{Prev: bid1, Timestamp: 1}}
+	msg2 := &engine.Msg{Block: &onl.Block{Prev: bid1, Timestamp: 2}}
+	o1.Handle(msg1)
+	o1.Handle(msg2)
+	o1.Handle(&engine.Msg{Block: &onl.Block{Prev: bid1, Timestamp: 1}}) //relayed again
+
+	n, size := o1.Orphans()
+	test.Equals(t, 2, n)
+	test.Equals(t, msg1.Block.Size()+msg2.Block.Size(), size)
+
+	o1.Resolve(bid1)
+	time.Sleep(time.Millisecond)
+	mu.Lock()
+	test.Equals(t, 2, len(handled)) //both should be handled
+	mu.Unlock()
+
+	n, size = o1.Orphans()
+	test.Equals(t, 0, n)
+	test.Equals(t, 0, size)
+}
+
+func TestOutOfOrderLimits(t *testing.T) {
+	bc := broadcast.NewMem(100)
+	var mu sync.Mutex
+	var handled []*engine.Msg
+	h1 := engine.HandlerFunc(func(msg *engine.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg)
+	})
+
+	blockMsg := func(peer string, ts uint64) (msg *engine.Msg) {
+		msg = &engine.Msg{Block: &onl.Block{Prev: bid1, Timestamp: ts}}
+		msg.SetPeer(peer)
+		return
+	}
+
+	t.Run("per peer and total", func(t *testing.T) {
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
+		o1.Limit(3, onl.MaxBlockSize, 2, 10)
+
+		o1.Handle(blockMsg("a", 1))
+		o1.Handle(blockMsg("a", 2))
+		o1.Handle(blockMsg("a", 3)) //peer limit
+		n, _ := o1.Orphans()
+		test.Equals(t, 2, n)
+
+		o1.Handle(blockMsg("b", 4))
+		o1.Handle(blockMsg("b", 5)) //total limit
+		n, _ = o1.Orphans()
+		test.Equals(t, 3, n)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
+		msg1 := blockMsg("a", 1)
+		o1.Limit(10, msg1.Block.Size(), 10, 10)
+
+		o1.Handle(msg1)
+		o1.Handle(blockMsg("a", 2))
+		n, size := o1.Orphans()
+		test.Equals(t, 1, n)
+		test.Equals(t, msg1.Block.Size(), size)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
+		o1.Limit(10, onl.MaxBlockSize, 10, 2)
+
+		o1.Handle(blockMsg("a", 1))
+		o1.Handle(&engine.Msg{Block: &onl.Block{Prev: onl.NilID, Round: 100}})
+		o1.ResolveRound(1)
+		o1.ResolveRound(2)
+		n, _ := o1.Orphans()
+		test.Equals(t, 2, n)
+
+		o1.ResolveRound(3)
+		n, _ = o1.Orphans()
+		test.Equals(t, 0, n) //waited too long
+
+		o1.Resolve(bid1)
+		o1.ResolveRound(100)
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		test.Equals(t, 0, len(handled)) //expired, should not be handled
+		mu.Unlock()
+	})
+
+	t.Run("per host", func(t *testing.T) {
+		o1 := engine.NewOutOfOrder(h1, bc, nil)
+		o1.Limit(10, onl.MaxBlockSize, 2, 10)
+
+		o1.Handle(blockMsg("10.0.0.1:3000", 1))
+		o1.Handle(blockMsg("10.0.0.1:3001", 2))
+		o1.Handle(blockMsg("10.0.0.1:3002", 3)) //reconnected, same host
+		n, _ := o1.Orphans()
+		test.Equals(t, 2, n)
+
+		o1.Handle(blockMsg("10.0.0.2:3000", 4))
+		n, _ = o1.Orphans()
+		test.Equals(t, 3, n)
+	})
+}
+
+func TestOutOfOrderForgetsResolved(t *testing.T) {
+	bc := broadcast.NewMem(100)
+	var mu sync.Mutex
+	var handled []*engine.Msg
+	h1 := engine.HandlerFunc(func(msg *engine.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg)
+	})
+
+	//a block id in round 1
+	var id onl.ID
+	binary.BigEndian.PutUint64(id[:], math.MaxUint64-1)
+
+	known := map[onl.ID]bool{}
+	o1 := engine.NewOutOfOrder(h1, bc, func(id onl.ID) bool { return known[id] })
+	o1.Limit(10, onl.MaxBlockSize, 10, 2)
+	o1.Resolve(id)
+
+	//after the expiry the resolved block is no longer remembered
+	o1.ResolveRound(4)
+	o1.Handle(&engine.Msg{Block: &onl.Block{Prev: id}})
+	n, _ := o1.Orphans()
+	test.Equals(t, 1, n)
+	o1.Forget(id)
+
+	//unless it is known, e.g. by being in the chain
+	known[id] = true
+	o1.Handle(&engine.Msg{Block: &onl.Block{Prev: id}})
+	n, _ = o1.Orphans()
+	test.Equals(t, 0, n)
+	time.Sleep(time.Millisecond)
+	mu.Lock()
+	test.Equals(t, 1, len(handled))
+	mu.Unlock()
+}
+
+//bcWriterFunc implements the broadcast writer as a function
+type bcWriterFunc func(msg *engine.Msg) error
+
+func (f bcWriterFunc) Write(msg *engine.Msg) error { return f(msg) }
+
+func TestOutOfOrderSyncBackoff(t *testing.T) {
+	var synced []uint64
+	var round uint64
+	bc := bcWriterFunc(func(msg *engine.Msg) error {
+		synced = append(synced, round)
+		return nil
+	})
+
+	o1 := engine.NewOutOfOrder(engine.HandlerFunc(func(msg *engine.Msg) {}), bc, nil)
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	missing := idn1.Mint(1, onl.NilID, onl.NilID, 1).Hash()
+	o1.Handle(&engine.Msg{Block: &onl.Block{Prev: missing, Round: 2}})
+
+	for round = 1; round <= 10; round++ {
+		o1.ResolveRound(round)
+	}
+
+	//requested again after waiting twice as long each time
+	test.Equals(t, []uint64{1, 2, 4, 8}, synced)
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/advanderveer/27067dd17/onl"
+)
+
+// Receipt describes the block on the tip that a write was included in
+type Receipt struct {
+	Nonce        onl.Nonce
+	Block        onl.ID
+	Round        uint64
+	Finalization float64
+}
+
+// errFound stops a walk once the block with the write was found
+var errFound = errors.New("found")
+
+// Await blocks until write 'w' was included in a block on the tip and that
+// block reached finalization 'finality'. It returns an error if the write can
+// no longer be included on the tip because it conflicts, expired or was dropped
+// from the pool before it was included.
+func (e *Engine) Await(ctx context.Context, w *onl.Write, finality float64) (rcpt *Receipt, err error) {
+
+	//subscribe before the first check so no change of the tip is missed
+	sub := e.chain.Subscribe(100)
+	defer sub.Close()
+
+	var tip onl.ID
+	for {
+
+		//expiry depends on the round, take the signal before checking it
+		roundc := e.roundDone()
+
+		//included writes leave the pool once they are finalized on the tip, the
+		//pool is checked first so such writes are found on the tip
+		pooled := e.pool.Has(w.Nonce)
+
+		//the state is only rebuild when the tip changed, else only the
+		//finalization of the block with the write can have changed
+		if curr := e.chain.Tip(); curr != tip {
+			tip = curr
+			rcpt, err = e.receipt(tip, w)
+		} else if rcpt != nil {
+			_, _, rcpt.Finalization, err = e.chain.Read(rcpt.Block)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rcpt == nil && w.Expired(e.clock.Round()) {
+			return nil, onl.ErrWriteExpired
+		}
+
+		if rcpt == nil && !pooled {
+			return nil, ErrWriteDropped
+		}
+
+		if rcpt != nil && rcpt.Finalization >= finality {
+			return rcpt, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-roundc:
+		case _, ok := <-sub.C():
+			if !ok {
+				return nil, fmt.Errorf("chain subscription was closed")
+			}
+		}
+	}
+}
+
+// receipt returns a receipt if the write was included on tip 'tip', or nil if
+// it can still be included
+func (e *Engine) receipt(tip onl.ID, w *onl.Write) (rcpt *Receipt, err error) {
+	_, state, err := e.chain.State(tip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tip state: %v", err)
+	}
+
+	if !state.Applied(w.Nonce) {
+
+		//a write that no longer applies on the tip will not be picked for blocks
+		err = state.Apply(w, true)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	//the write was applied, walk back to the block that included it
+	rcpt = &Receipt{Nonce: w.Nonce}
+	err = e.chain.Walk(tip, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+		for _, bw := range b.Writes {
+			if bw.Nonce == w.Nonce {
+				rcpt.Block, rcpt.Round = id, b.Round
+				return errFound
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		return nil, fmt.Errorf("write was applied but not found in any block on the tip")
+	} else if err != errFound {
+		return nil, fmt.Errorf("failed to find block with applied write: %v", err)
+	}
+
+	_, _, rcpt.Finalization, err = e.chain.Read(rcpt.Block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block with write: %v", err)
+	}
+
+	return rcpt, nil
+}
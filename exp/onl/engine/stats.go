@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/advanderveer/27067dd17/onl"
+)
+
+//Stats holds statistics about the engine and the chain it works with
+type Stats struct {
+	Round           uint64  //round the clock is in
+	TipRound        uint64  //round of the block on the tip
+	TipFinalization float64 //finalization of the block on the tip
+	PoolWrites      int     //writes in the mempool
+	PoolBytes       int     //encoded size of the writes in the mempool
+	Orphans         int     //messages waiting on a block or round
+	OrphanBytes     int     //encoded size of the waiting blocks
+
+	Chain onl.ChainStats
+}
+
+//Stats returns statistics about the engine
+func (e *Engine) Stats() (s *Stats, err error) {
+	tip := e.chain.Tip()
+	_, _, f, err := e.chain.Read(tip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	s = &Stats{
+		Round:           e.clock.Round(),
+		TipRound:        tip.Round(),
+		TipFinalization: f,
+		PoolWrites:      e.pool.Len(),
+		PoolBytes:       e.pool.Size(),
+		Chain:           e.chain.Stats(),
+	}
+
+	s.Orphans, s.OrphanBytes = e.ooo.Orphans()
+	return
+}
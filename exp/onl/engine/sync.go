@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"sync/atomic"
+
+	"github.com/advanderveer/27067dd17/onl"
+)
+
+const (
+	//CatchUpDistance is the number of rounds a block can be ahead of our tip
+	//before the engine starts catching up with headers first
+	CatchUpDistance = 8
+
+	//SyncBatchSize is the number of blocks that are requested per sync message
+	//while catching up
+	SyncBatchSize = 64
+
+	//SyncBatchesPerPeer is the number of batches that are requested from a
+	//single peer at the same time while catching up
+	SyncBatchesPerPeer = 2
+
+	//MaxSyncRounds is the maximum number of rounds a peer will push blocks for
+	//in response to a single ranged sync
+	MaxSyncRounds = 256
+)
+
+//source is a peer that send us headers while catching up, the blocks of the
+//headers are requested from it in batches
+type source struct {
+	reply func(msg *Msg) (err error)
+	n     int //blocks requested from it that didn't arrive yet
+}
+
+//batch of blocks that is requested from a source
+type batch struct {
+	src *source
+	ids []onl.ID
+}
+
+// SyncRounds asks peers for all blocks in the rounds from up to and including
+// to. Blocks are handled as they arrive, like any other block.
+func (e *Engine) SyncRounds(from, to uint64) (err error) {
+	return e.bc.Write(&Msg{SyncRounds: &SyncRounds{From: from, To: to}})
+}
+
+// CatchUp asks peers for the headers of the blocks between our tip and theirs.
+// Once the headers are verified the blocks themselves are requested in batches.
+// It is called automatically when blocks arrive that are far ahead of our tip.
+func (e *Engine) CatchUp() (err error) {
+	known, err := e.chain.Locator()
+	if err != nil {
+		return err
+	}
+
+	//blocks that were requested before but never arrived can be asked for again,
+	//possibly from other peers
+	e.fmu.Lock()
+	e.fetching = make(map[onl.ID]*source)
+	e.sources = make(map[string]*source)
+	e.queue = nil
+	e.fmu.Unlock()
+
+	return e.bc.Write(&Msg{HeadersReq: &HeadersReq{Known: known}})
+}
+
+//catchUpIfBehind starts catching up if block 'b' is far ahead of our tip, at
+//most once per round
+func (e *Engine) catchUpIfBehind(b *onl.Block) {
+	if b.Round <= e.chain.Tip().Round()+CatchUpDistance {
+		return
+	}
+
+	round := e.clock.Round()
+	if atomic.SwapUint64(&e.catchup, round) == round {
+		return //already catching up this round
+	}
+
+	e.logs.Printf("[INFO][%s][%d] received block from round %d, far ahead of our tip, catching up", e.idn, round, b.Round)
+	err := e.CatchUp()
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to start catching up: %v", e.idn, err)
+	}
+}
+
+func (e *Engine) handleSyncRounds(s *SyncRounds) {
+	if s.From > s.To {
+		return //empty range
+	}
+
+	to := s.To
+	if to-s.From >= MaxSyncRounds {
+		to = s.From + MaxSyncRounds - 1
+	}
+
+	err := e.chain.Range(s.From, to, func(id onl.ID, b *onl.Block) error {
+		return s.Push(b)
+	})
+
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to push blocks in rounds %d-%d as respons to a sync: %v", e.idn, s.From, to, err)
+	}
+}
+
+func (e *Engine) handleHeadersReq(r *HeadersReq) {
+	hdrs, err := e.chain.Headers(r.Known)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to read headers for peer: %v", e.idn, err)
+		return
+	}
+
+	if len(hdrs) < 1 {
+		return //peer is not behind us
+	}
+
+	err = r.Push(hdrs)
+	if err != nil {
+		e.logs.Printf("[ERRO][%s] failed to push %d headers as respons to a request: %v", e.idn, len(hdrs), err)
+	}
+}
+
+func (e *Engine) handleHeaders(msg *Msg) {
+	hdrs := msg.Headers
+	if len(hdrs) < 1 {
+		return
+	}
+
+	//check the chain of signatures and tokens before downloading any writes
+	err := e.chain.VerifyHeaders(hdrs)
+	if err != nil {
+		e.logs.Printf("[INFO][%s] received %d headers that failed to verify: %v", e.idn, len(hdrs), err)
+		return
+	}
+
+	//the headers build on a block we have, blocks waiting on it can be handled
+	e.ooo.Resolve(hdrs[0].Prev)
+
+	e.fmu.Lock()
+
+	//the peer has the blocks of the headers, they are requested from it
+	//directly. If the broadcast can't reply to the peer any peer may answer
+	if _, ok := e.sources[msg.Peer()]; !ok {
+		src := &source{reply: msg.Reply}
+		if !msg.CanReply() {
+			src.reply = e.bc.Write
+		}
+
+		e.sources[msg.Peer()] = src
+	}
+
+	//queue the blocks we don't have and didn't queue already
+	for _, h := range hdrs {
+		id := h.Hash()
+		if _, ok := e.fetching[id]; ok {
+			continue
+		}
+
+		if _, _, _, err = e.chain.Read(id); err == nil {
+			continue
+		}
+
+		e.fetching[id] = nil
+		e.queue = append(e.queue, id)
+	}
+
+	//the peer had more headers than it could send, the next ones are asked for
+	//once the blocks of these headers were appended and can be verified against
+	if len(hdrs) >= onl.MaxHeaders {
+		e.more = true
+	}
+
+	batches := e.dispatch()
+	e.fmu.Unlock()
+	e.request(batches)
+}
+
+//dispatch takes batches from the queue for each source that has room for
+//them, such that the blocks are fetched from several peers in parallel.
+//Assumes fmu to be locked.
+func (e *Engine) dispatch() (batches []batch) {
+	for _, src := range e.sources {
+		for src.n < SyncBatchesPerPeer*SyncBatchSize {
+			var ids []onl.ID
+			for len(e.queue) > 0 && len(ids) < SyncBatchSize {
+				id := e.queue[0]
+				e.queue = e.queue[1:]
+				if s, ok := e.fetching[id]; !ok || s != nil {
+					continue //arrived or requested already
+				}
+
+				e.fetching[id] = src
+				ids = append(ids, id)
+			}
+
+			if len(ids) < 1 {
+				return //queue is empty
+			}
+
+			src.n += len(ids)
+			batches = append(batches, batch{src, ids})
+		}
+	}
+
+	return
+}
+
+//request the batches from their sources
+func (e *Engine) request(batches []batch) {
+	for _, b := range batches {
+		go func(b batch) {
+			err := b.src.reply(&Msg{Sync: &Sync{IDs: b.ids}})
+			if err != nil {
+				e.logs.Printf("[ERRO][%s] failed to request %d blocks from peer: %v", e.idn, len(b.ids), err)
+			}
+		}(b)
+	}
+}
+
+//fetched marks a block as no longer being fetched, its source has room for
+//more batches. If it was the last one and there are more headers to fetch it
+//continues catching up.
+func (e *Engine) fetched(id onl.ID) {
+	e.fmu.Lock()
+	src, ok := e.fetching[id]
+	delete(e.fetching, id)
+	if src != nil {
+		src.n--
+	}
+
+	more := ok && e.more && len(e.fetching) < 1
+	if more {
+		e.more = false
+	}
+
+	batches := e.dispatch()
+	e.fmu.Unlock()
+	e.request(batches)
+
+	if more {
+		err := e.CatchUp()
+		if err != nil {
+			e.logs.Printf("[ERRO][%s] failed to continue catching up: %v", e.idn, err)
+		}
+	}
+}
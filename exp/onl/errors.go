@@ -11,11 +11,49 @@ var (
 	ErrStableNotInChain      = errors.New("stable random source not in chain")
 	ErrStateReconstruction   = errors.New("failed to reconstruct state")
 	ErrApplyConflict         = errors.New("conflict during apply")
+	ErrWriteExpired          = errors.New("write was included after the round it was valid until")
+	ErrWriteTooOld           = errors.New("write read from a state before the low-watermark, re-read and try again")
 	ErrNoTokenPK             = errors.New("no token pk committed")
 	ErrZeroRank              = errors.New("blocks has zero rank")
 	ErrRoundNrNotAfterPrev   = errors.New("round number wasn't after the prev's round number")
 	ErrTimestampNotAfterPrev = errors.New("timestamp didn't come after prev's timestamp")
 	ErrNotWeighted           = errors.New("block's round is not weighted yet")
 	ErrAppendConflict        = errors.New("concurrent append caused conflict")
+	ErrTokenPKNotStable      = errors.New("token pk was committed after the stable block")
+	ErrMemberLeft            = errors.New("proposer is no longer a member")
+	ErrLeaveBeforeBlock      = errors.New("leave round is before the block's round")
+	ErrLeaveTooFarAhead      = errors.New("leave round is too far after the block's round")
+	ErrStakeLocked           = errors.New("stake was released before the unbonding period passed")
+	ErrInvalidWriteSignature = errors.New("invalid write signature")
+	ErrUnauthorizedKey       = errors.New("write touches a key outside of its signer's keyspace")
+	ErrInvalidSystemKey      = errors.New("system key was changed outside of its rules")
+	ErrCurrencyNotConserved  = errors.New("write creates or destroys currency")
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrStakeAlreadyDeposited = errors.New("stake was already deposited")
+	ErrJoinFeeNotPaid        = errors.New("stake was deposited without paying the join fee")
+	ErrSelfTransfer          = errors.New("cannot transfer currency to the same account")
+	ErrZeroAmount            = errors.New("amount must be larger than zero")
+	ErrNotMember             = errors.New("not a member")
+	ErrAlreadyLeaving        = errors.New("member is already leaving")
+	ErrNotLeaving            = errors.New("member is not leaving")
+	ErrStillUnbonding        = errors.New("stake is still unbonding")
+	ErrTxConflict            = errors.New("transaction conflicted with a concurrent commit")
 	ErrAlreadyApplied        = errors.New("write was already applied to this state")
+	ErrTipNotFinalized       = errors.New("tip doesn't descend from the finalized block")
+	ErrNoFinalizedBlock      = errors.New("no block on the tip reached the finalization")
+	ErrRoundNotInChain       = errors.New("round is before the first block of the chain")
+	ErrKeyTooLong            = errors.New("write has a key that exceeds the maximum key length")
+	ErrValueTooLong          = errors.New("write has a value that exceeds the maximum value length")
+	ErrTooManyReadRows       = errors.New("write reads more than the maximum number of rows")
+	ErrTooManyWriteRows      = errors.New("write writes more than the maximum number of rows")
+	ErrHeadersNotLinked      = errors.New("headers don't form a chain on top of a known block")
+	ErrBlockTooLarge         = errors.New("encoded block exceeds the maximum block size")
+	ErrNotDataKeyOwner       = errors.New("only the owner can encrypt values and manage its data keys")
+	ErrNoDataKey             = errors.New("data key was not shared with this identity")
+	ErrDecryptValue          = errors.New("failed to decrypt value")
+	ErrInvalidReaderPK       = errors.New("reader pk cannot be converted to an encryption key")
+	ErrCheckpointCommitment  = errors.New("checkpoint doesn't match its commitment")
+	ErrCheckpointNotTrusted  = errors.New("checkpoint doesn't match the trusted hash")
+	ErrCheckpointNoBlock     = errors.New("checkpoint has no block")
+	ErrStateNotClosed        = errors.New("state was not closed, it should be removed and rebuild")
 )
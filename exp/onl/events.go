@@ -0,0 +1,263 @@
+package onl
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//FinalizationLevels are the levels of finalization for which a Finalized event
+//is published when a block reaches them
+var FinalizationLevels = []float64{0.5, 2.0 / 3, 1.0}
+
+//Event is published to subscribers when the chain changes
+type Event interface {
+	event()
+}
+
+//TipChanged is published when the heaviest tip of the chain changed
+type TipChanged struct {
+	Old ID
+	New ID
+}
+
+//Reorg is published (after TipChanged) when the new tip doesn't descend from
+//the old tip. Reverted holds the blocks from the old tip down to the common
+//ancestor, Applied holds the blocks from the common ancestor up to the new tip.
+//The writes of those blocks are listed in the same order, writes that are in
+//both branches (by nonce) are left out as they remain applied.
+type Reorg struct {
+	CommonAncestor ID
+	Reverted       []ID
+	Applied        []ID
+
+	RevertedWrites []*Write
+	AppliedWrites  []*Write
+}
+
+//Finalized is published when a block reached one of the FinalizationLevels
+type Finalized struct {
+	ID    ID
+	Level float64
+}
+
+func (TipChanged) event() {}
+func (Reorg) event()      {}
+func (Finalized) event()  {}
+
+//Subscription receives events from the chain. Events are never send while the
+//chain is appending, and when the buffer is full they are dropped instead of
+//waiting for the subscriber, unless the subscription is blocking.
+type Subscription struct {
+	c        chan Event
+	dropped  uint64
+	chain    *Chain
+	blocking bool
+
+	//done is closed first when the subscription closes, such that a blocked
+	//send gives up before the event channel is closed
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+//Subscribe to chain events, at most 'bufn' events are buffered
+func (c *Chain) Subscribe(bufn int) (sub *Subscription) {
+	return c.subscribe(bufn, false)
+}
+
+//SubscribeBlocking subscribes to chain events that are never dropped, when the
+//buffer is full the chain waits for the subscriber before it returns from
+//appending. The subscriber must keep receiving until it closes the subscription.
+func (c *Chain) SubscribeBlocking(bufn int) (sub *Subscription) {
+	return c.subscribe(bufn, true)
+}
+
+func (c *Chain) subscribe(bufn int, blocking bool) (sub *Subscription) {
+	sub = &Subscription{
+		c:        make(chan Event, bufn),
+		chain:    c,
+		blocking: blocking,
+		done:     make(chan struct{}),
+	}
+
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.subs[sub] = struct{}{}
+	return
+}
+
+//C returns the channel that events are send on, it is closed when the
+//subscription is closed
+func (sub *Subscription) C() <-chan Event { return sub.c }
+
+//Dropped returns how many events were dropped because the buffer was full
+func (sub *Subscription) Dropped() uint64 { return atomic.LoadUint64(&sub.dropped) }
+
+//Close the subscription
+func (sub *Subscription) Close() {
+	sub.chain.smu.Lock()
+	if _, ok := sub.chain.subs[sub]; !ok {
+		sub.chain.smu.Unlock()
+		return
+	}
+
+	delete(sub.chain.subs, sub)
+	sub.chain.smu.Unlock()
+
+	close(sub.done)
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.closed = true
+	close(sub.c)
+}
+
+//send the events to the subscriber, blocking subscribers are waited on until
+//they receive or close the subscription
+func (sub *Subscription) send(evs []Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+
+	for _, ev := range evs {
+		if sub.blocking {
+			select {
+			case sub.c <- ev:
+			case <-sub.done:
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+//publish the events to all subscribers, the subscribers are copied such that a
+//slow subscriber doesn't keep others from subscribing or closing
+func (c *Chain) publish(evs ...Event) {
+	c.smu.Lock()
+	subs := make([]*Subscription, 0, len(c.subs))
+	for sub := range c.subs {
+		subs = append(subs, sub)
+	}
+
+	c.smu.Unlock()
+	for _, sub := range subs {
+		sub.send(evs)
+	}
+}
+
+//tipEvents returns the events caused by the tip moving from 'old' to what the
+//transaction currently considers the tip
+func (c *Chain) tipEvents(tx Tx, old ID) (evs []Event, err error) {
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	if tip == old || old == NilID {
+		return
+	}
+
+	evs = append(evs, TipChanged{Old: old, New: tip})
+	reorg, err := c.reorg(tx, old, tip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine reorg: %v", err)
+	}
+
+	if len(reorg.Reverted) > 0 {
+		evs = append(evs, reorg)
+	}
+
+	return
+}
+
+//Reorg describes what changes when the tip moves from block 'old' to block
+//'tip'. If 'tip' descends from 'old' nothing is reverted.
+func (c *Chain) Reorg(old, tip ID) (r Reorg, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+	return c.reorg(tx, old, tip)
+}
+
+//reorg walks back from both tips until they meet at their common ancestor
+func (c *Chain) reorg(tx Tx, old, tip ID) (r Reorg, err error) {
+	var reverted, applied []*Block
+	for old != tip {
+		if old.Round() >= tip.Round() {
+			b, _, _, err := tx.Read(old)
+			if err != nil {
+				return r, err
+			}
+
+			r.Reverted = append(r.Reverted, old)
+			reverted = append(reverted, b)
+			old = b.Prev
+			continue
+		}
+
+		b, _, _, err := tx.Read(tip)
+		if err != nil {
+			return r, err
+		}
+
+		r.Applied = append(r.Applied, tip)
+		applied = append(applied, b)
+		tip = b.Prev
+	}
+
+	r.CommonAncestor = old
+
+	//applied blocks were collected walking back, list them in chain order
+	for i, j := 0, len(applied)-1; i < j; i, j = i+1, j-1 {
+		r.Applied[i], r.Applied[j] = r.Applied[j], r.Applied[i]
+		applied[i], applied[j] = applied[j], applied[i]
+	}
+
+	inApplied := make(map[Nonce]struct{})
+	for _, b := range applied {
+		for _, w := range b.Writes {
+			inApplied[w.Nonce] = struct{}{}
+		}
+	}
+
+	inReverted := make(map[Nonce]struct{})
+	for _, b := range reverted {
+		for _, w := range b.Writes {
+			inReverted[w.Nonce] = struct{}{}
+			if _, ok := inApplied[w.Nonce]; !ok {
+				r.RevertedWrites = append(r.RevertedWrites, w)
+			}
+		}
+	}
+
+	for _, b := range applied {
+		for _, w := range b.Writes {
+			if _, ok := inReverted[w.Nonce]; !ok {
+				r.AppliedWrites = append(r.AppliedWrites, w)
+			}
+		}
+	}
+
+	return
+}
+
+//finalized returns the events for the levels that were crossed when the
+//finalization of a block went from 'before' to 'after'
+func finalized(id ID, before, after float64) (evs []Event) {
+	for _, l := range FinalizationLevels {
+		if before < l && after >= l {
+			evs = append(evs, Finalized{ID: id, Level: l})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,292 @@
+package onl
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/advanderveer/27067dd17/onl/enc"
+	"github.com/advanderveer/27067dd17/vrf"
+	"github.com/advanderveer/27067dd17/vrf/ed25519"
+)
+
+//Header holds the data of a block without its writes, it commits to the writes
+//with their hash. A block's ID is the hash of its header such that the chain
+//of signatures and tokens can be verified before the writes are downloaded.
+type Header struct {
+	Round      uint64
+	Timestamp  uint64
+	Token      []byte
+	Proof      []byte
+	PK         PK
+	Prev       ID
+	WritesHash [sha256.Size]byte
+	Signature  [ed25519.SignatureSize]byte
+}
+
+//Header returns the header of the block
+func (b *Block) Header() (h *Header) {
+	h = &Header{
+		Round:     b.Round,
+		Timestamp: b.Timestamp,
+		Token:     b.Token,
+		Proof:     b.Proof,
+		PK:        b.PK,
+		Prev:      b.Prev,
+		Signature: b.Signature,
+	}
+
+	if b.whash != nil {
+		h.WritesHash = *b.whash
+		return
+	}
+
+	h.WritesHash = b.writesHash()
+	return
+}
+
+//writesHash hashes the encoded writes of the block
+func (b *Block) writesHash() [sha256.Size]byte {
+	e := enc.NewWriter(headerVersion)
+	e.Len(len(b.Writes))
+	for _, w := range b.Writes {
+		wd, err := w.MarshalBinary()
+		if err != nil {
+			panic("failed to encode write: " + err.Error())
+		}
+
+		e.Bytes(wd)
+	}
+
+	return sha256.Sum256(e.Data())
+}
+
+const headerVersion = 1
+
+//MarshalBinary encodes the header in its canonical format, the signature is
+//always the last part of the encoding
+func (h *Header) MarshalBinary() (d []byte, err error) {
+	e := enc.NewWriter(headerVersion)
+	e.Uint64(h.Round)
+	e.Uint64(h.Timestamp)
+	e.Bytes(h.Token)
+	e.Bytes(h.Proof)
+	e.Fixed(h.PK[:])
+	e.Fixed(h.Prev[:])
+	e.Fixed(h.WritesHash[:])
+	e.Fixed(h.Signature[:])
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes a header that was encoded by MarshalBinary
+func (h *Header) UnmarshalBinary(d []byte) (err error) {
+	r, _ := enc.NewReader(d, headerVersion)
+	h.Round = r.Uint64()
+	h.Timestamp = r.Uint64()
+	h.Token = r.Bytes()
+	h.Proof = r.Bytes()
+	r.Fixed(h.PK[:])
+	r.Fixed(h.Prev[:])
+	r.Fixed(h.WritesHash[:])
+	r.Fixed(h.Signature[:])
+	return r.Done()
+}
+
+//Hash returns the ID of the block the header belongs to. It is taken over the
+//encoded header without the signature.
+func (h *Header) Hash() (id ID) {
+	d, err := h.MarshalBinary()
+	if err != nil {
+		panic("failed to encode header: " + err.Error())
+	}
+
+	id = ID(sha256.Sum256(d[:len(d)-ed25519.SignatureSize]))
+
+	//prefix the ID with the round, allows round based sorting in the store
+	//@TODO (security) what does this the collission resistance 4,7e21 do to security
+	binary.BigEndian.PutUint64(id[:8], math.MaxUint64-h.Round)
+	return
+}
+
+//VerifySignature will check the signature of the header's block
+func (h *Header) VerifySignature() (ok bool) {
+	pk := [32]byte(h.PK)
+	return ed25519.Verify(&pk, h.Hash().Bytes(), &h.Signature)
+}
+
+//VerifyToken will verify the random function token of the header's block
+func (h *Header) VerifyToken(tokenPK []byte, stable ID) (ok bool) {
+	return vrf.Verify(tokenPK, seed(stable, h.PK, h.Round), h.Token, h.Proof)
+}
+
+//MaxHeaders is the maximum number of headers that are returned at once
+const MaxHeaders = 2048
+
+//Headers returns the headers of the blocks from the tip back to (but not
+//including) the first block that is in 'known', in chain order. If there are
+//more than MaxHeaders the ones closest to the known block are returned, the
+//headers of other blocks are never build. Blocks of the first release are not
+//identified by their header, the walk stops at them as well.
+func (c *Chain) Headers(known []ID) (hdrs []*Header, err error) {
+	isKnown := make(map[ID]struct{}, len(known))
+	for _, id := range known {
+		isKnown[id] = struct{}{}
+	}
+
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	//while walking back only the ids of the last MaxHeaders blocks are kept
+	var n int
+	ids := make([]ID, MaxHeaders)
+	if err = c.walk(tx, tip, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if _, ok := isKnown[id]; ok || b.legacy {
+			return errStopWalk
+		}
+
+		ids[n%MaxHeaders] = id
+		n++
+		return nil
+	}); err != nil && err != errStopWalk {
+		return nil, fmt.Errorf("failed to walk from tip: %v", err)
+	}
+
+	//walked back from the tip, list them in chain order
+	for i := n - 1; i >= 0 && i >= n-MaxHeaders; i-- {
+		b, _, _, err := tx.Read(ids[i%MaxHeaders])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block: %v", err)
+		}
+
+		hdrs = append(hdrs, b.Header())
+	}
+
+	return hdrs, nil
+}
+
+//Locator returns block IDs from the tip towards the genesis that are further
+//apart the older they get, the genesis is always the last. Peers use it to
+//find the most recent block they have in common with us.
+func (c *Chain) Locator() (ids []ID, err error) {
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	tip, _, err := tx.ReadTip()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip: %v", err)
+	}
+
+	var i, step int = 0, 1
+	if err = c.walk(tx, tip, func(id ID, b *Block, stk *Stakes, rank *big.Int) error {
+		if i%step == 0 {
+			ids = append(ids, id)
+			if len(ids) > 10 {
+				step *= 2
+			}
+		}
+
+		i++
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk from tip: %v", err)
+	}
+
+	if ids[len(ids)-1] != c.genesis.id {
+		ids = append(ids, c.genesis.id)
+	}
+
+	return
+}
+
+//VerifyHeaders checks that the headers form a chain on top of a block we know,
+//and that their signatures and tokens are valid. The token pk must have been
+//committed at or before the stable block, if that is one of the headers the
+//token pk may have been committed within the headers. Those tokens cannot be
+//verified without the writes, they are verified once the block is appended.
+func (c *Chain) VerifyHeaders(hdrs []*Header) (err error) {
+	if len(hdrs) < 1 {
+		return nil
+	}
+
+	tx := c.store.CreateTx(false)
+	defer tx.Discard()
+
+	base, _, _, err := tx.Read(hdrs[0].Prev)
+	if err != nil {
+		return ErrHeadersNotLinked
+	}
+
+	_, state, err := c.state(tx, hdrs[0].Prev)
+	if err != nil {
+		return ErrStateReconstruction
+	}
+
+	ids := make(map[ID]struct{}, len(hdrs))
+	prev, pround, pts := hdrs[0].Prev, base.Round, base.Timestamp
+	for i, h := range hdrs {
+		switch {
+		case h.Prev != prev:
+			return ErrHeadersNotLinked
+		case !h.VerifySignature():
+			return ErrInvalidSignature
+		case h.Round <= pround:
+			return ErrRoundNrNotAfterPrev
+		case h.Timestamp <= pts:
+			return ErrTimestampNotAfterPrev
+		}
+
+		stable, err := c.headerStable(tx, hdrs[0].Prev, hdrs[:i], h.Round)
+		if err != nil {
+			return err
+		}
+
+		prev, pround, pts = h.Hash(), h.Round, h.Timestamp
+		ids[prev] = struct{}{}
+		if _, ok := ids[stable]; ok {
+			continue //token pk may be committed within the headers
+		}
+
+		//any token pk committed within the headers would be after the stable
+		//block, so the token pk must be in the state we build on
+		var tpk []byte
+		if err = state.View(func(kv *KV) { _, tpk = kv.ReadStake(h.PK) }); err != nil {
+			return ErrStateReconstruction
+		}
+
+		if tpk == nil {
+			return ErrNoTokenPK
+		}
+
+		if !h.VerifyToken(tpk, stable) {
+			return ErrInvalidToken
+		}
+	}
+
+	return nil
+}
+
+//headerStable determines the stable block like stable does, but it starts by
+//walking back over headers of blocks that are not in the chain yet. Those
+//headers build on block 'base'.
+func (c *Chain) headerStable(tx Tx, base ID, hdrs []*Header, round uint64) (stable ID, err error) {
+	var max uint64
+	if round > c.depth {
+		max = round - c.depth
+	}
+
+	for i := len(hdrs) - 1; i >= 0; i-- {
+		stable = hdrs[i].Hash()
+		if hdrs[i].Round <= max {
+			return stable, nil
+		}
+	}
+
+	return c.stable(tx, base, round)
+}
@@ -0,0 +1,219 @@
+package onl_test
+
+import (
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/go-test"
+)
+
+func TestHeaderEncoding(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	st1, err := onl.NewState(nil)
+	test.Ok(t, err)
+	w1, err := st1.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		return kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	})
+	test.Ok(t, err)
+
+	test.Ok(t, w1.GenerateNonce())
+	w1.PK = idn1.PK()
+	idn1.SignWrite(w1)
+
+	b1 := idn1.Mint(1, bid1, bid2, 1)
+	b1.AppendWrite(w1)
+	idn1.Sign(b1)
+
+	h1 := b1.Header()
+	test.Equals(t, b1.Hash(), h1.Hash())
+	test.Equals(t, true, h1.VerifySignature())
+	test.Equals(t, true, h1.VerifyToken(idn1.TokenPK(), bid2))
+	test.Equals(t, false, h1.VerifyToken(idn1.TokenPK(), bid1))
+
+	d1, err := h1.MarshalBinary()
+	test.Ok(t, err)
+
+	h2 := &onl.Header{}
+	test.Ok(t, h2.UnmarshalBinary(d1))
+	test.Equals(t, h1, h2)
+
+	//the header commits to the writes
+	b1.Writes[0].Signature[0]++
+	test.Equals(t, false, b1.Header().WritesHash == h1.WritesHash)
+	test.Equals(t, false, b1.VerifySignature())
+}
+
+func TestChainHeaders(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+	}
+
+	s1, clean1 := onl.TempBadgerStore()
+	defer clean1()
+	c1, gen, err := onl.NewChain(s1, 0, genf)
+	test.Ok(t, err)
+
+	prev := gen
+	blocks := map[uint64]*onl.Block{}
+	for r := uint64(1); r <= 30; r++ {
+		stable, err := c1.Stable(prev, r)
+		test.Ok(t, err)
+
+		b := idn1.Mint(ts(), prev, stable, r)
+		idn1.Sign(b)
+		test.Ok(t, c1.Append(b))
+
+		prev = b.Hash()
+		blocks[r] = b
+	}
+
+	t.Run("headers from known blocks", func(t *testing.T) {
+		hdrs, err := c1.Headers([]onl.ID{gen})
+		test.Ok(t, err)
+		test.Equals(t, 30, len(hdrs))
+		test.Equals(t, blocks[1].Hash(), hdrs[0].Hash())
+		test.Equals(t, blocks[30].Hash(), hdrs[29].Hash())
+
+		hdrs, err = c1.Headers([]onl.ID{onl.NilID, blocks[26].Hash(), gen})
+		test.Ok(t, err)
+		test.Equals(t, 4, len(hdrs))
+		test.Equals(t, blocks[27].Hash(), hdrs[0].Hash())
+
+		hdrs, err = c1.Headers([]onl.ID{c1.Tip()})
+		test.Ok(t, err)
+		test.Equals(t, 0, len(hdrs))
+	})
+
+	t.Run("locator", func(t *testing.T) {
+		ids, err := c1.Locator()
+		test.Ok(t, err)
+		test.Equals(t, c1.Tip(), ids[0])
+		test.Equals(t, blocks[29].Hash(), ids[1])
+		test.Equals(t, gen, ids[len(ids)-1])
+		test.Assert(t, len(ids) < 31, "locator should skip blocks")
+	})
+
+	t.Run("range", func(t *testing.T) {
+		var rounds []uint64
+		test.Ok(t, c1.Range(2, 4, func(id onl.ID, b *onl.Block) error {
+			rounds = append(rounds, b.Round)
+			return nil
+		}))
+		test.Equals(t, []uint64{2, 3, 4}, rounds)
+
+		rounds = nil
+		test.Ok(t, c1.Range(29, 100, func(id onl.ID, b *onl.Block) error {
+			rounds = append(rounds, b.Round)
+			return nil
+		}))
+		test.Equals(t, []uint64{29, 30}, rounds)
+	})
+
+	s2, clean2 := onl.TempBadgerStore()
+	defer clean2()
+	c2, _, err := onl.NewChain(s2, 0, genf)
+	test.Ok(t, err)
+
+	ids, err := c2.Locator()
+	test.Ok(t, err)
+	hdrs, err := c1.Headers(ids)
+	test.Ok(t, err)
+	test.Equals(t, 30, len(hdrs))
+
+	t.Run("verify headers", func(t *testing.T) {
+		test.Ok(t, c2.VerifyHeaders(hdrs))
+		test.Equals(t, onl.ErrHeadersNotLinked, c2.VerifyHeaders(hdrs[1:]))
+
+		hdrs2 := append([]*onl.Header{}, hdrs[:3]...)
+		hdrs2[2], hdrs2[1] = hdrs2[1], hdrs2[2]
+		test.Equals(t, onl.ErrHeadersNotLinked, c2.VerifyHeaders(hdrs2))
+
+		h := *hdrs[2]
+		h.Signature[0]++
+		hdrs2[1], hdrs2[2] = hdrs[1], &h
+		test.Equals(t, onl.ErrInvalidSignature, c2.VerifyHeaders(hdrs2))
+	})
+
+	//with verified headers the blocks can be appended
+	for _, h := range hdrs {
+		b, _, _, err := c1.Read(h.Hash())
+		test.Ok(t, err)
+		test.Ok(t, c2.Append(b))
+	}
+
+	test.Equals(t, c1.Tip(), c2.Tip())
+}
+
+func TestVerifyHeadersWithNewTokenPK(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x02})
+	idn3 := onl.NewIdentity([]byte{0x03})
+	genf := func(kv *onl.KV) {
+		kv.CoinbaseTransfer(idn1.PK(), 1)
+		kv.DepositStake(idn1.PK(), 1, idn1.TokenPK())
+		kv.CoinbaseTransfer(idn2.PK(), 100)
+		kv.DepositStake(idn2.PK(), 1, idn3.TokenPK()) //commits to another token pk
+	}
+
+	s1, clean1 := onl.TempBadgerStore()
+	defer clean1()
+	c1, gen, err := onl.NewChain(s1, 0, genf)
+	test.Ok(t, err)
+
+	write := func(f func(kv *onl.KV) error) *onl.Write {
+		w, err := c1.Update(f)
+		test.Ok(t, err)
+		w.PK = idn2.PK()
+		test.Ok(t, w.GenerateNonce())
+		idn2.SignWrite(w)
+		return w
+	}
+
+	mint := func(idn *onl.Identity, r uint64, ws ...*onl.Write) {
+		stable, err := c1.Stable(c1.Tip(), r)
+		test.Ok(t, err)
+
+		b := idn.Mint(ts(), c1.Tip(), stable, r)
+		b.AppendWrite(ws...)
+		idn.Sign(b)
+		test.Ok(t, c1.Append(b))
+	}
+
+	//idn2 leaves, releases its stake and deposits again with its own token pk
+	mint(idn1, 1, write(func(kv *onl.KV) error { return kv.Leave(idn2.PK(), 2) }))
+	for r := uint64(2); r < 2+onl.UnbondingRounds; r++ {
+		mint(idn1, r)
+	}
+
+	r := 2 + onl.UnbondingRounds
+	mint(idn1, r, write(func(kv *onl.KV) error { return kv.Release(idn2.PK(), r) }))
+	mint(idn1, r+1, write(func(kv *onl.KV) error { return kv.Join(idn2.PK(), 1, idn2.TokenPK()) }))
+	for r = r + 2; r < 36; r++ {
+		mint(idn1, r)
+	}
+
+	mint(idn2, r)
+
+	s2, clean2 := onl.TempBadgerStore()
+	defer clean2()
+	c2, _, err := onl.NewChain(s2, 0, genf)
+	test.Ok(t, err)
+
+	ids, err := c2.Locator()
+	test.Ok(t, err)
+	hdrs, err := c1.Headers(ids)
+	test.Ok(t, err)
+	test.Equals(t, idn2.PK(), hdrs[len(hdrs)-1].PK)
+	test.Ok(t, c2.VerifyHeaders(hdrs))
+
+	t.Run("stable block before the token pk", func(t *testing.T) {
+		b := idn2.Mint(ts(), hdrs[1].Hash(), gen, 3)
+		idn2.Sign(b)
+
+		hdrs2 := append([]*onl.Header{}, hdrs[:2]...)
+		test.Equals(t, onl.ErrInvalidToken, c2.VerifyHeaders(append(hdrs2, b.Header())))
+	})
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/advanderveer/27067dd17/vrf"
 	"github.com/advanderveer/27067dd17/vrf/ed25519"
+	"github.com/advanderveer/27067dd17/vrf/ed25519/extra25519"
 )
 
 //Identity represents is an unique Sybil in network
@@ -76,6 +77,14 @@ func (idn *Identity) Sign(b *Block) {
 	b.Signature = *(ed25519.Sign(idn.signSK, b.Hash().Bytes()))
 }
 
+//curveSK returns the private key this identity decrypts with, it is derived
+//from the signing key
+func (idn *Identity) curveSK() (csk *[32]byte) {
+	csk = new([32]byte)
+	extra25519.PrivateKeyToCurve25519(csk, idn.signSK)
+	return
+}
+
 //SignWrite signs the write
 func (idn *Identity) SignWrite(w *Write) {
 	w.Signature = *(ed25519.Sign(idn.signSK, w.Hash().Bytes()))
@@ -11,31 +11,66 @@ const (
 	balanceKey = "_balance"
 	stakeKey   = "_stake"
 	tpkKey     = "_tpk"
+	leaveKey   = "_leave"
 )
 
+const (
+	// JoinFee is the administration fee that is paid to the treasury when
+	// joining as a member
+	JoinFee uint64 = 1
+
+	// UnbondingRounds is the number of rounds the stake of a member stays
+	// locked after it left, misbehaviour can still be punished during that time
+	UnbondingRounds uint64 = 20
+
+	// MaxLeaveRounds is how many rounds the leave round of a member may be
+	// after the round of the block that includes its leave
+	MaxLeaveRounds uint64 = 100
+
+	// WatermarkRounds is how many rounds before a block the state that a write
+	// read from may be, writes that read from an older state are too old
+	WatermarkRounds uint64 = 64
+
+	// BlockReward is the amount of new currency the proposer of a block is
+	// credited with, on top of the fees of the writes in the block. Apart from
+	// the genesis it is the only way currency is created.
+	BlockReward uint64 = 1
+
+	// TreasuryShare is the percentage of the block reward and fees that is
+	// credited to the treasury instead of the proposer
+	TreasuryShare uint64 = 10
+)
+
+// Treasury is the account that receives all administration fees
+var Treasury PK
+
 //KV abstraction build on top of our block chain
 type KV struct{ *ssi.Tx }
 
-// DepositStake locks currency as stake and commits a token pk
-func (kv *KV) DepositStake(owner PK, amount uint64, tpk []byte) {
+// DepositStake locks currency as stake and commits a token pk. Outside of the
+// genesis it is only authorized when the JoinFee is paid as well, see Join.
+func (kv *KV) DepositStake(owner PK, amount uint64, tpk []byte) (err error) {
+	if amount < 1 {
+		return ErrZeroAmount //zero stake would release it
+	}
 
 	//read balance
 	balk := append(owner[:], []byte(balanceKey)...)
 	balv := kv.Get(balk)
 	if len(balv) < 8 {
-		return //no balance, do nothing
+		return ErrInsufficientFunds //no balance
 	}
 
 	balance := binary.BigEndian.Uint64(balv)
 	if balance < amount {
-		return //nog enough balance, cannot do anything
+		return ErrInsufficientFunds
 	}
 
 	//read current stake and add amount
 	stakek := skey(owner)
 	stakev := kv.Get(stakek)
-	if len(stakev) >= 8 {
-		return // if stake is already set, do nothing
+	if len(stakev) >= 8 && binary.BigEndian.Uint64(stakev) > 0 {
+		return ErrStakeAlreadyDeposited
 	}
 
 	//reduce balance
@@ -48,6 +83,7 @@ func (kv *KV) DepositStake(owner PK, amount uint64, tpk []byte) {
 	binary.BigEndian.PutUint64(stakev, amount)
 	kv.Set(stakek, stakev)
 	kv.Set(tpkey(owner), tpk)
+	return nil
 }
 
 // ReadStake returns the depositted stake and the token key that was committed to
@@ -61,6 +97,82 @@ func (kv *KV) ReadStake(owner PK) (amount uint64, tpk []byte) {
 	return binary.BigEndian.Uint64(v), kv.Get(tpkey(owner))
 }
 
+// Join deposits stake and commits a token pk such that the owner can take part
+// in the protocol. It costs the JoinFee, which is paid to the treasury.
+func (kv *KV) Join(owner PK, amount uint64, tpk []byte) (err error) {
+	if amount < 1 {
+		return ErrZeroAmount
+	}
+
+	if stake, _ := kv.ReadStake(owner); stake > 0 {
+		return ErrStakeAlreadyDeposited //already a member, or still unbonding
+	}
+
+	if kv.AccountBalance(owner) < amount+JoinFee {
+		return ErrInsufficientFunds //not enough for the deposit and the fee
+	}
+
+	err = kv.TransferCurrency(owner, Treasury, JoinFee)
+	if err != nil {
+		return err
+	}
+
+	return kv.DepositStake(owner, amount, tpk)
+}
+
+// Leave stops the membership of the owner from round 'round' onwards. Blocks
+// that the owner proposes in or after that round are ignored. Its stake stays
+// locked until it is released after the unbonding period.
+//@TODO allow others to submit the leave of a member with proof of misbehaviour
+func (kv *KV) Leave(owner PK, round uint64) (err error) {
+	if stake, _ := kv.ReadStake(owner); stake < 1 {
+		return ErrNotMember
+	}
+
+	if _, ok := kv.ReadLeave(owner); ok {
+		return ErrAlreadyLeaving
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, round)
+	kv.Set(lkey(owner), v)
+	return nil
+}
+
+// ReadLeave returns the round from which the owner is no longer a member
+func (kv *KV) ReadLeave(owner PK) (round uint64, ok bool) {
+	v := kv.Get(lkey(owner))
+	if len(v) < 8 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(v), true
+}
+
+// Release returns the stake of a member that left to its balance, it only
+// does so when the unbonding period has passed in round 'round'.
+func (kv *KV) Release(owner PK, round uint64) (err error) {
+	left, ok := kv.ReadLeave(owner)
+	if !ok {
+		return ErrNotLeaving
+	}
+
+	if round < left+UnbondingRounds {
+		return ErrStillUnbonding
+	}
+
+	stakek := skey(owner)
+	stakev := kv.Get(stakek)
+	if len(stakev) < 8 {
+		return ErrNotMember //nothing to release
+	}
+
+	kv.CoinbaseTransfer(owner, binary.BigEndian.Uint64(stakev))
+	kv.Set(stakek, make([]byte, 8))
+	kv.Set(lkey(owner), nil)
+	return nil
+}
+
 // CoinbaseTransfer is currency that is minted out of nothing and transferred to a receiver
 func (kv *KV) CoinbaseTransfer(receiver PK, amount uint64) {
 	k := append(receiver[:], []byte(balanceKey)...)
@@ -78,27 +190,28 @@ func (kv *KV) CoinbaseTransfer(receiver PK, amount uint64) {
 }
 
 // TransferCurrency will move currency from one account to the other
-func (kv *KV) TransferCurrency(from, to PK, amount uint64) {
+func (kv *KV) TransferCurrency(from, to PK, amount uint64) (err error) {
 	if bytes.Equal(from[:], to[:]) {
-		return
+		return ErrSelfTransfer
 	}
 
 	//read from balance
 	balk := append(from[:], []byte(balanceKey)...)
 	balv := kv.Get(balk)
 	if len(balv) < 8 {
-		return //no balance, do nothing
+		return ErrInsufficientFunds //no balance
 	}
 
 	//check balance
 	balance := binary.BigEndian.Uint64(balv)
 	if balance < amount {
-		return //nog enough balance don't do anything
+		return ErrInsufficientFunds
 	}
 
 	kv.CoinbaseTransfer(to, amount)
 	binary.BigEndian.PutUint64(balv, balance-amount)
 	kv.Set(balk, balv)
+	return nil
 }
 
 // AccountBalance returns the current account balance of an identity
@@ -118,3 +231,22 @@ func skey(owner PK) []byte {
 func tpkey(owner PK) []byte {
 	return append(owner[:], []byte(tpkKey)...)
 }
+func lkey(owner PK) []byte {
+	return append(owner[:], []byte(leaveKey)...)
+}
+
+//systemKey returns the owner and the suffix of a system key, the suffix is
+//empty if the key is not a system key
+func systemKey(k []byte) (owner PK, suffix string) {
+	if len(k) <= len(owner) {
+		return
+	}
+
+	switch sfx := string(k[len(owner):]); sfx {
+	case balanceKey, stakeKey, tpkKey, leaveKey:
+		copy(owner[:], k)
+		return owner, sfx
+	}
+
+	return
+}
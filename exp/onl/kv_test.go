@@ -16,13 +16,13 @@ func TestKVOperations(t *testing.T) {
 	idn3 := onl.NewIdentity([]byte{0x03})
 
 	st1, _ := onl.NewState(nil)
-	w := st1.Update(func(kv *onl.KV) {
+	w, err := st1.Update(func(kv *onl.KV) error {
 
 		//try to read non-existing account
 		test.Equals(t, uint64(0), kv.AccountBalance(idn1.PK()))
 
 		//try to deposit on non-existing account
-		kv.DepositStake(idn1.PK(), 9, []byte{0x01})
+		test.Equals(t, onl.ErrInsufficientFunds, kv.DepositStake(idn1.PK(), 9, []byte{0x01}))
 		stake, tpk := kv.ReadStake(idn1.PK())
 		test.Equals(t, uint64(0), stake)
 		test.Equals(t, []byte(nil), tpk)
@@ -35,16 +35,17 @@ func TestKVOperations(t *testing.T) {
 		test.Equals(t, uint64(100), kv.AccountBalance(idn1.PK()))
 
 		//try to deposit more then balance has
-		kv.DepositStake(idn1.PK(), 999, []byte{0x01})
+		test.Equals(t, onl.ErrInsufficientFunds, kv.DepositStake(idn1.PK(), 999, []byte{0x01}))
 		stake, tpk = kv.ReadStake(idn1.PK())
 		test.Equals(t, uint64(0), stake)
 		test.Equals(t, []byte(nil), tpk)
 
 		//deposit currency as stake
-		kv.DepositStake(idn1.PK(), 9, idn1.TokenPK())
+		test.Ok(t, kv.DepositStake(idn1.PK(), 9, idn1.TokenPK()))
 
 		//second deposit should do nothing
-		kv.DepositStake(idn1.PK(), 1, []byte{0x01})
+		test.Equals(t, onl.ErrStakeAlreadyDeposited, kv.DepositStake(idn1.PK(), 1, []byte{0x01}))
+		test.Equals(t, onl.ErrZeroAmount, kv.DepositStake(idn1.PK(), 0, []byte{0x01}))
 
 		//read the deposit
 		stake, tpk = kv.ReadStake(idn1.PK())
@@ -55,26 +56,41 @@ func TestKVOperations(t *testing.T) {
 		test.Equals(t, uint64(91), kv.AccountBalance(idn1.PK()))
 
 		//transfer to some other account
-		kv.TransferCurrency(idn1.PK(), idn2.PK(), 50)
+		test.Ok(t, kv.TransferCurrency(idn1.PK(), idn2.PK(), 50))
 
 		//read balance of receiving account
 		test.Equals(t, uint64(41), kv.AccountBalance(idn1.PK()))
 		test.Equals(t, uint64(50), kv.AccountBalance(idn2.PK()))
 
 		//tranfer while send doesn't have enough balance shouldn't change anything
-		kv.TransferCurrency(idn1.PK(), idn2.PK(), 150)
+		test.Equals(t, onl.ErrInsufficientFunds, kv.TransferCurrency(idn1.PK(), idn2.PK(), 150))
 		test.Equals(t, uint64(50), kv.AccountBalance(idn2.PK()))
 
 		//transferring from non-existing shouldn't change anything
-		kv.TransferCurrency(idn3.PK(), idn2.PK(), 1)
+		test.Equals(t, onl.ErrInsufficientFunds, kv.TransferCurrency(idn3.PK(), idn2.PK(), 1))
 		test.Equals(t, uint64(50), kv.AccountBalance(idn2.PK()))
 
 		//tranfer to itself shouldn't do anthing
-		kv.TransferCurrency(idn2.PK(), idn2.PK(), 150)
+		test.Equals(t, onl.ErrSelfTransfer, kv.TransferCurrency(idn2.PK(), idn2.PK(), 150))
 		test.Equals(t, uint64(50), kv.AccountBalance(idn2.PK()))
+		return nil
 	})
+	test.Ok(t, err)
 
-	test.Ok(t, st1.Apply(w, false))
+	//currency can only be created by trusted writes, like those of the genesis
+	test.Equals(t, onl.ErrInvalidWriteSignature, st1.Apply(w, false))
+	_, err = onl.NewState([][]*onl.Write{{w}})
+	test.Ok(t, err)
+
+	t.Run("error discards the write", func(t *testing.T) {
+		w, err := st1.Update(func(kv *onl.KV) error {
+			kv.CoinbaseTransfer(idn3.PK(), 1)
+			return kv.TransferCurrency(idn3.PK(), idn2.PK(), 2)
+		})
+
+		test.Equals(t, onl.ErrInsufficientFunds, err)
+		test.Equals(t, (*onl.Write)(nil), w)
+	})
 
 	t.Run("check evaluation if write is stake deposit", func(t *testing.T) {
 		test.Equals(t, true, w.HasDepositFor(idn1.PK()))
@@ -84,6 +100,97 @@ func TestKVOperations(t *testing.T) {
 	})
 }
 
+func TestKVMembership(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+
+	st1, _ := onl.NewState(nil)
+	w, err := st1.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(idn1.PK(), 10)
+
+		//not enough balance to also pay the fee
+		test.Equals(t, onl.ErrInsufficientFunds, kv.Join(idn1.PK(), 10, idn1.TokenPK()))
+		stake, _ := kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(0), stake)
+
+		//join pays the fee to the treasury
+		test.Ok(t, kv.Join(idn1.PK(), 5, idn1.TokenPK()))
+		stake, tpk := kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(5), stake)
+		test.Equals(t, idn1.TokenPK(), tpk)
+		test.Equals(t, uint64(4), kv.AccountBalance(idn1.PK()))
+		test.Equals(t, onl.JoinFee, kv.AccountBalance(onl.Treasury))
+
+		//joining again does nothing
+		test.Equals(t, onl.ErrStakeAlreadyDeposited, kv.Join(idn1.PK(), 1, idn1.TokenPK()))
+		stake, _ = kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(5), stake)
+
+		//release without leaving does nothing
+		test.Equals(t, onl.ErrNotLeaving, kv.Release(idn1.PK(), 100))
+		stake, _ = kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(5), stake)
+
+		//leave, the first leave is kept
+		test.Ok(t, kv.Leave(idn1.PK(), 10))
+		test.Equals(t, onl.ErrAlreadyLeaving, kv.Leave(idn1.PK(), 20))
+		left, ok := kv.ReadLeave(idn1.PK())
+		test.Equals(t, true, ok)
+		test.Equals(t, uint64(10), left)
+
+		//cannot re-join or release while unbonding
+		test.Equals(t, onl.ErrStakeAlreadyDeposited, kv.Join(idn1.PK(), 1, idn1.TokenPK()))
+		test.Equals(t, onl.ErrStillUnbonding, kv.Release(idn1.PK(), 10+onl.UnbondingRounds-1))
+		stake, _ = kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(5), stake)
+
+		//release after unbonding
+		test.Ok(t, kv.Release(idn1.PK(), 10+onl.UnbondingRounds))
+		stake, _ = kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(0), stake)
+		test.Equals(t, uint64(9), kv.AccountBalance(idn1.PK()))
+		_, ok = kv.ReadLeave(idn1.PK())
+		test.Equals(t, false, ok)
+
+		//can join again
+		test.Ok(t, kv.Join(idn1.PK(), 1, idn1.TokenPK()))
+		stake, _ = kv.ReadStake(idn1.PK())
+		test.Equals(t, uint64(1), stake)
+		test.Equals(t, onl.ErrNotMember, kv.Leave(onl.Treasury, 1))
+		return nil
+	})
+	test.Ok(t, err)
+
+	_, err = onl.NewState([][]*onl.Write{{w}})
+	test.Ok(t, err)
+	test.Equals(t, map[onl.PK]uint64{}, w.StakeLeaves())
+}
+
+func TestKVScan(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk := idn1.PK()
+
+	st1, _ := onl.NewState(nil)
+	w, err := st1.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(pk, 10)
+		return kv.DepositStake(pk, 1, idn1.TokenPK())
+	})
+	test.Ok(t, err)
+
+	st1, err = onl.NewState([][]*onl.Write{{w}})
+	test.Ok(t, err)
+
+	//list all keys of the identity without knowing them up front
+	var ks []string
+	st1.View(func(kv *onl.KV) {
+		kv.Scan(pk[:], func(k, v []byte) bool {
+			ks = append(ks, string(k[len(pk):]))
+			return false
+		})
+	})
+
+	test.Equals(t, []string{"_balance", "_stake", "_tpk"}, ks)
+}
+
 // Imagine random concurrent operations being performed on any of a set of states.
 // We expected that once they are serialized onto all states that the SSI algorithm
 // should take care of removing conflicting operations and resulting in a consistent
@@ -105,21 +212,22 @@ func TestMultipleStateKVFuzzing(t *testing.T) {
 		idns[i] = onl.NewIdentity(idb)
 	}
 
+	//create a genesis write with start balances
+	gst, err := onl.NewState(nil)
+	test.Ok(t, err)
+	gw, err := gst.Update(func(kv *onl.KV) error {
+		for _, idn := range idns {
+			kv.CoinbaseTransfer(idn.PK(), startBalance)
+		}
+		return nil
+	})
+	test.Ok(t, err)
+
 	//create states
 	states := make([]*onl.State, nStates)
 	for i := 0; i < nStates; i++ {
-		states[i], err = onl.NewState(nil)
+		states[i], err = onl.NewState([][]*onl.Write{{gw}})
 		test.Ok(t, err)
-
-		//with start balance
-		for _, idn := range idns {
-			w := states[i].Update(func(kv *onl.KV) {
-				kv.CoinbaseTransfer(idn.PK(), startBalance)
-			})
-
-			test.Ok(t, w.GenerateNonce())
-			test.Ok(t, states[i].Apply(w, false))
-		}
 	}
 
 	//create random writes on random states
@@ -133,18 +241,26 @@ func TestMultipleStateKVFuzzing(t *testing.T) {
 			defer wg.Done()
 
 			//perform random ops
-			writes <- state.Update(func(kv *onl.KV) {
+			from := idns[rand.Intn(nIdentities)]
+			w, err := state.Update(func(kv *onl.KV) error {
 				amount := rand.Intn(maxTransfer)
-				from := idns[rand.Intn(nIdentities)]
-
 				if amount%depositFreq == 0 {
-					kv.DepositStake(from.PK(), uint64(amount), nil)
-				} else {
-					to := idns[rand.Intn(nIdentities)]
-					kv.TransferCurrency(from.PK(), to.PK(), uint64(amount))
+					return kv.Join(from.PK(), uint64(amount), nil)
 				}
+
+				to := idns[rand.Intn(nIdentities)]
+				return kv.TransferCurrency(from.PK(), to.PK(), uint64(amount))
 			})
 
+			//ops that fail are discarded
+			if err == nil && w != nil {
+				w.PK = from.PK()
+				test.Ok(t, w.GenerateNonce())
+				from.SignWrite(w)
+			}
+
+			writes <- w
+
 		}(i, state)
 	}
 
@@ -153,11 +269,6 @@ func TestMultipleStateKVFuzzing(t *testing.T) {
 	//applying them on all state shoudn't invalidate the system
 	var i int
 	for w := range writes {
-
-		if w != nil {
-			test.Ok(t, w.GenerateNonce())
-		}
-
 		for _, state := range states {
 			err := state.Apply(w, false)
 			if err != nil && err != onl.ErrApplyConflict {
@@ -183,6 +294,9 @@ func TestMultipleStateKVFuzzing(t *testing.T) {
 				totals[i] += bal
 			})
 		}
+
+		//join fees are paid to the treasury
+		state.View(func(kv *onl.KV) { totals[i] += kv.AccountBalance(onl.Treasury) })
 	}
 
 	//each state should end up without any currency missing
@@ -0,0 +1,226 @@
+package onl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/advanderveer/27067dd17/onl/ssi"
+	"github.com/advanderveer/27067dd17/vrf/ed25519"
+)
+
+//The first release stored records as gob encoded structs and identified blocks
+//and writes by hashing their fields. Stores written by it are still read, the
+//blocks and writes keep the identifier they were stored and signed with.
+
+//legacyBlockVersion prefixes the gob encoding of a legacy block such that it
+//can be rewritten to the store and send to peers without losing its identity
+const legacyBlockVersion = 0
+
+//legacyTxData mirrors the transaction data of the first release, the current
+//types implement their own encoding that gob would use instead
+type legacyTxData struct {
+	TimeStart  uint64
+	TimeCommit uint64
+	ReadRows   ssi.KeySet
+	WriteRows  ssi.KeyChangeSet
+}
+
+//legacyWrite mirrors a write of the first release
+type legacyWrite struct {
+	TxData    *legacyTxData
+	PK        PK
+	Nonce     Nonce
+	Signature [ed25519.SignatureSize]byte
+}
+
+//legacyBlock mirrors a block of the first release
+type legacyBlock struct {
+	Round     uint64
+	Timestamp uint64
+	Token     []byte
+	Proof     []byte
+	PK        PK
+	Prev      ID
+	Signature [ed25519.SignatureSize]byte
+	Writes    []*legacyWrite
+}
+
+//legacyRecord mirrors a store record of the first release
+type legacyRecord struct {
+	Block  *legacyBlock
+	Stakes *Stakes
+	Rank   *big.Int
+}
+
+//decodeLegacy decodes a gob encoded record of the first release
+func decodeLegacy(d []byte) (b *Block, stk *Stakes, rank *big.Int, err error) {
+	rec := &legacyRecord{}
+	err = gob.NewDecoder(bytes.NewReader(d)).Decode(rec)
+	if err != nil || rec.Block == nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode block data: %v", err)
+	}
+
+	stk = rec.Stakes
+	if stk == nil {
+		stk = NewStakes(0)
+	}
+
+	if stk.Votes == nil {
+		stk.Votes = make(map[PK]uint64)
+	}
+
+	if stk.Leaving == nil {
+		stk.Leaving = make(map[uint64]uint64)
+	}
+
+	return rec.Block.block(), stk, rec.Rank, nil
+}
+
+func (lb *legacyBlock) block() (b *Block) {
+	b = &Block{
+		Round:     lb.Round,
+		Timestamp: lb.Timestamp,
+		Token:     lb.Token,
+		Proof:     lb.Proof,
+		PK:        lb.PK,
+		Prev:      lb.Prev,
+		Signature: lb.Signature,
+		legacy:    true,
+	}
+
+	for _, lw := range lb.Writes {
+		w := &Write{PK: lw.PK, Nonce: lw.Nonce, Signature: lw.Signature, legacy: true}
+		w.TxData = &ssi.TxData{}
+		if lw.TxData != nil {
+			w.TimeStart = lw.TxData.TimeStart
+			w.TimeCommit = lw.TxData.TimeCommit
+			w.ReadRows = lw.TxData.ReadRows
+			w.WriteRows = lw.TxData.WriteRows
+		}
+
+		b.Writes = append(b.Writes, w)
+	}
+
+	return
+}
+
+//marshalLegacy encodes a block of the first release with gob
+func (b *Block) marshalLegacy() (d []byte, err error) {
+	lb := &legacyBlock{
+		Round:     b.Round,
+		Timestamp: b.Timestamp,
+		Token:     b.Token,
+		Proof:     b.Proof,
+		PK:        b.PK,
+		Prev:      b.Prev,
+		Signature: b.Signature,
+	}
+
+	for _, w := range b.Writes {
+		lw := &legacyWrite{PK: w.PK, Nonce: w.Nonce, Signature: w.Signature}
+		if w.TxData != nil {
+			lw.TxData = &legacyTxData{
+				TimeStart:  w.TimeStart,
+				TimeCommit: w.TimeCommit,
+				ReadRows:   w.ReadRows,
+				WriteRows:  w.WriteRows,
+			}
+		}
+
+		lb.Writes = append(lb.Writes, lw)
+	}
+
+	buf := bytes.NewBuffer([]byte{legacyBlockVersion})
+	if err = gob.NewEncoder(buf).Encode(lb); err != nil {
+		return nil, fmt.Errorf("failed to encode legacy block: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+//unmarshalLegacy decodes a block that was encoded by marshalLegacy
+func (b *Block) unmarshalLegacy(d []byte) (err error) {
+	lb := &legacyBlock{}
+	if err = gob.NewDecoder(bytes.NewReader(d)).Decode(lb); err != nil {
+		return fmt.Errorf("failed to decode legacy block: %v", err)
+	}
+
+	*b = *lb.block()
+	return nil
+}
+
+//legacyHash identifies a block of the first release by the hash of its fields
+//and the hashes and signatures of its writes
+func (b *Block) legacyHash() (id ID) {
+	tsb := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsb, b.Timestamp)
+	roundb := make([]byte, 8)
+	binary.BigEndian.PutUint64(roundb, math.MaxUint64-b.Round)
+
+	var wrshs [][]byte
+	for _, wr := range b.Writes {
+		wrsh := wr.Hash()
+		wrshs = append(wrshs, wrsh[:])
+		wrshs = append(wrshs, wr.Signature[:])
+	}
+
+	id = ID(sha256.Sum256(bytes.Join([][]byte{
+		b.Prev.Bytes(),
+		b.PK[:],
+		b.Proof,
+		b.Token,
+		tsb,
+		roundb,
+		bytes.Join(wrshs, nil),
+	}, nil)))
+
+	copy(id[:8], roundb)
+	return
+}
+
+//legacyHash identifies a write of the first release by the hash of its fields
+//and its rows, sorted by key hash
+func (w *Write) legacyHash() (id WID) {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, w.TimeStart)
+	binary.Write(h, binary.BigEndian, w.TimeCommit)
+	binary.Write(h, binary.BigEndian, w.Nonce)
+	binary.Write(h, binary.BigEndian, w.PK)
+
+	rr := make([]ssi.KH, 0, len(w.ReadRows))
+	for k := range w.ReadRows {
+		rr = append(rr, k)
+	}
+
+	sort.Slice(rr, func(i, j int) bool {
+		return bytes.Compare(rr[i][:], rr[j][:]) < 0
+	})
+
+	for _, k := range rr {
+		binary.Write(h, binary.BigEndian, k[:])
+	}
+
+	wr := make([]ssi.KH, 0, len(w.WriteRows))
+	for k := range w.WriteRows {
+		wr = append(wr, k)
+	}
+
+	sort.Slice(wr, func(i, j int) bool {
+		return bytes.Compare(wr[i][:], wr[j][:]) < 0
+	})
+
+	for _, k := range wr {
+		binary.Write(h, binary.BigEndian, k[:])
+		binary.Write(h, binary.BigEndian, w.WriteRows[k].K)
+		binary.Write(h, binary.BigEndian, w.WriteRows[k].V)
+	}
+
+	copy(id[:], h.Sum(nil))
+	return
+}
@@ -0,0 +1,365 @@
+package ssi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+const (
+	dataPrefix = 'd' //key-value pairs
+	timeKey    = 't' //oracle time of the last write
+	lowKey     = 'l' //low-watermark of the oracle at the last write
+)
+
+//BadgerStore stores the data of a database on disk such that it survives
+//restarts and can exceed the available memory. Data is written at the oracle
+//time it was committed at, views read the data as of a time such that they
+//never hold on to a badger transaction.
+type BadgerStore struct {
+	db *badger.ManagedDB
+
+	//time of the last write, and the low-watermark: versions before it may be
+	//discarded by badger so views of an earlier time can no longer be read
+	time uint64
+	low  uint64
+	mu   sync.RWMutex
+}
+
+//NewBadgerStore opens (or creates) a disk backed store in directory 'dir'
+func NewBadgerStore(dir string) (s *BadgerStore, err error) {
+	s = &BadgerStore{}
+
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	s.db, err = badger.OpenManaged(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %v", err)
+	}
+
+	txn := s.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+
+	s.time, err = readUint64(txn, timeKey)
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	s.low, err = readUint64(txn, lowKey)
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	s.db.SetDiscardTs(s.low)
+	return
+}
+
+//OpenDB opens a database that stores its data in directory 'dir'. The status
+//oracle is restored from the versions of the stored keys: the time of the last
+//commit, the low-watermark as it was at the last commit and every key that was
+//committed after it.
+//@TODO restoring the oracle walks all the keys, this could be limited to the
+//keys that were committed after the low-watermark
+func OpenDB(dir string) (db *DB, err error) {
+	s, err := NewBadgerStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	oracle := NewOracle()
+	if s.time > oracle.time {
+		oracle.time = s.time
+	}
+
+	oracle.low = s.low
+	txn := s.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	keys := oracle.keys.Txn()
+	for iter.Seek([]byte{dataPrefix}); iter.ValidForPrefix([]byte{dataPrefix}); iter.Next() {
+		item := iter.Item()
+		if item.Version() <= oracle.low {
+			continue //evicted
+		}
+
+		k := item.KeyCopy(nil)[1:]
+		oracle.commits[keyHash(k)] = item.Version()
+		keys.Insert(k, item.Version())
+	}
+
+	oracle.keys = keys.Commit()
+	return newDB(oracle, s), nil
+}
+
+//OpenDBFromSnapshot opens a database in directory 'dir' that holds the oracle
+//time and entries that were returned by a snapshot, the directory must not
+//hold a database yet. Entries are written at the time they were committed at.
+func OpenDBFromSnapshot(dir string, time uint64, entries []*Entry) (db *DB, err error) {
+	s, err := NewBadgerStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.time > 0 {
+		s.db.Close()
+		return nil, fmt.Errorf("directory already holds a database")
+	}
+
+	bytime := make(map[uint64]KeyChangeSet)
+	for _, e := range entries {
+		t := e.T
+		if t < 1 {
+			t = 1 //evicted, never conflicts
+		}
+
+		if bytime[t] == nil {
+			bytime[t] = make(KeyChangeSet)
+		}
+
+		bytime[t].Add(e.K, e.V)
+	}
+
+	for t, changes := range bytime {
+		err = s.write(changes, t, false)
+		if err != nil {
+			s.db.Close()
+			return nil, err
+		}
+	}
+
+	err = s.write(nil, time, true)
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	s.db.Close()
+	return OpenDB(dir)
+}
+
+//readUint64 reads a uint64 value at key 'k', it is zero if it doesn't exist
+func readUint64(txn *badger.Txn, k byte) (v uint64, err error) {
+	item, err := txn.Get([]byte{k})
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read key '%c': %v", k, err)
+	}
+
+	val, err := item.Value()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read value of key '%c': %v", k, err)
+	}
+
+	if len(val) != 8 {
+		return 0, fmt.Errorf("invalid value length of key '%c': %d", k, len(val))
+	}
+
+	return binary.BigEndian.Uint64(val), nil
+}
+
+//View returns a read-only view on the data as of the last write
+func (s *BadgerStore) View() View {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &badgerView{s: s, time: s.time}
+}
+
+//Write the changes in a single badger transaction, committed at 'time'
+func (s *BadgerStore) Write(changes KeyChangeSet, time uint64) (err error) {
+	return s.write(changes, time, true)
+}
+
+//Evict allows badger to discard versions of the data before the low-watermark
+//'low', it is stored with the next write.
+func (s *BadgerStore) Evict(low uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if low > s.low {
+		s.low = low
+		s.db.SetDiscardTs(low)
+	}
+}
+
+//write the changes at version 'time', if 'meta' is true the time and the
+//low-watermark are written as well. Transactions that grow too big for badger
+//are committed in parts at the same version.
+func (s *BadgerStore) write(changes KeyChangeSet, time uint64, meta bool) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn := s.db.NewTransactionAt(s.time, true)
+	defer func() { txn.Discard() }()
+
+	set := func(k, v []byte) (err error) {
+		err = txn.Set(k, v)
+		if err == badger.ErrTxnTooBig {
+			err = txn.CommitAt(time, nil)
+			if err != nil {
+				return fmt.Errorf("failed to commit part: %v", err)
+			}
+
+			txn = s.db.NewTransactionAt(s.time, true)
+			err = txn.Set(k, v)
+		}
+
+		return
+	}
+
+	for _, c := range changes {
+		err = set(dkey(c.K), c.V)
+		if err != nil {
+			return fmt.Errorf("failed to set key: %v", err)
+		}
+	}
+
+	if meta {
+		tv := make([]byte, 8)
+		binary.BigEndian.PutUint64(tv, time)
+		err = set([]byte{timeKey}, tv)
+		if err != nil {
+			return fmt.Errorf("failed to set time: %v", err)
+		}
+
+		lv := make([]byte, 8)
+		binary.BigEndian.PutUint64(lv, s.low)
+		err = set([]byte{lowKey}, lv)
+		if err != nil {
+			return fmt.Errorf("failed to set low-watermark: %v", err)
+		}
+	}
+
+	err = txn.CommitAt(time, nil)
+	if err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+
+	if meta && time > s.time {
+		s.time = time
+	}
+
+	return
+}
+
+//Clone returns a store that keeps writes in memory on top of a view of the
+//data at this point in time, the original store must remain open.
+//@TODO clones that see a lot of writes may grow larger then the memory allows
+func (s *BadgerStore) Clone() Store {
+	return &overlayStore{base: s.View(), top: iradix.New()}
+}
+
+//Close the underlying badger database
+func (s *BadgerStore) Close() (err error) {
+	return s.db.Close()
+}
+
+//badgerView reads the data as it was at a time, each read uses its own badger
+//transaction that is discarded when the read is done. The first error that is
+//encountered is kept, reads return nothing after it.
+type badgerView struct {
+	s    *BadgerStore
+	time uint64
+	err  error
+	mu   sync.Mutex
+}
+
+//txn returns a read-only transaction at the time of the view, or nil if the
+//data can no longer be read
+func (v *badgerView) txn() *badger.Txn {
+	if v.Err() != nil {
+		return nil
+	}
+
+	v.s.mu.RLock()
+	defer v.s.mu.RUnlock()
+	if v.time < v.s.low {
+		v.fail(ErrTooOld) //versions may have been discarded
+		return nil
+	}
+
+	return v.s.db.NewTransactionAt(v.time, false)
+}
+
+//fail keeps the first error the view encountered
+func (v *badgerView) fail(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err == nil {
+		v.err = err
+	}
+}
+
+func (v *badgerView) Err() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+func (v *badgerView) Get(k []byte) ([]byte, bool) {
+	txn := v.txn()
+	if txn == nil {
+		return nil, false
+	}
+
+	defer txn.Discard()
+	item, err := txn.Get(dkey(k))
+	if err == badger.ErrKeyNotFound {
+		return nil, false
+	} else if err != nil {
+		v.fail(fmt.Errorf("failed to read key from disk: %v", err))
+		return nil, false
+	}
+
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		v.fail(fmt.Errorf("failed to read value from disk: %v", err))
+		return nil, false
+	}
+
+	return val, true
+}
+
+func (v *badgerView) Walk(r Range, f func(k, v []byte) bool) {
+	txn := v.txn()
+	if txn == nil {
+		return
+	}
+
+	defer txn.Discard()
+	iter := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer iter.Close()
+
+	for iter.Seek(dkey(r.Start)); iter.ValidForPrefix([]byte{dataPrefix}); iter.Next() {
+		item := iter.Item()
+		k := item.Key()[1:]
+		if !r.Contains(k) {
+			return //passed the end
+		}
+
+		val, err := item.Value()
+		if err != nil {
+			v.fail(fmt.Errorf("failed to read value from disk: %v", err))
+			return
+		}
+
+		if f(k, val) {
+			return
+		}
+	}
+}
+
+func dkey(k []byte) []byte {
+	return append([]byte{dataPrefix}, k...)
+}
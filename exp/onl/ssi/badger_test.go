@@ -0,0 +1,155 @@
+package ssi
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	test "github.com/advanderveer/go-test"
+)
+
+func TestBadgerDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssi_")
+	test.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db1, err := OpenDB(dir)
+	test.Ok(t, err)
+
+	tx1 := db1.NewTx()
+	tx1.Set([]byte("alex_a"), int64b(1))
+	tx1.Set([]byte("bob"), []byte{})
+	test.Ok(t, tx1.Commit())
+	test.Equals(t, uint64(2), tx1.data.TimeCommit)
+
+	//own writes are read before the stored data, also when scanning
+	tx2 := db1.NewTx()
+	tx2.Set([]byte("alex_b"), int64b(2))
+	tx2.Set([]byte("alex_a"), int64b(3))
+	test.Equals(t, int64b(3), tx2.Get([]byte("alex_a")))
+	test.Equals(t, []byte{}, tx2.Get([]byte("bob")))
+	test.Equals(t, []byte(nil), tx2.Get([]byte("carl")))
+
+	var vs [][]byte
+	tx2.Scan([]byte("alex_"), func(k, v []byte) bool {
+		vs = append(vs, v)
+		return false
+	})
+
+	test.Equals(t, [][]byte{int64b(3), int64b(2)}, vs)
+
+	//same snapshot-isolation semantics as the in-memory database
+	tx3 := db1.NewTx()
+	tx3.Get([]byte("alex_b"))
+	tx3.Set([]byte("carl"), int64b(1))
+	test.Ok(t, db1.Commit(tx2.Data(), false))
+	test.Equals(t, ErrConflict, db1.Commit(tx3.Data(), false))
+
+	t.Run("clone", func(t *testing.T) {
+		db2 := db1.Clone()
+		tx4 := db2.NewTx()
+		tx4.Set([]byte("alex_c"), int64b(4))
+		test.Ok(t, tx4.Commit())
+
+		//the clone is independent, but sees the data of the original
+		var ks []string
+		db2.NewTx().Scan([]byte("alex_"), func(k, v []byte) bool {
+			ks = append(ks, string(k))
+			return false
+		})
+
+		test.Equals(t, []string{"alex_a", "alex_b", "alex_c"}, ks)
+		test.Equals(t, []byte(nil), db1.NewTx().Get([]byte("alex_c")))
+
+		time, entries, err := db2.Snapshot()
+		test.Ok(t, err)
+		test.Equals(t, uint64(4), time)
+		test.Equals(t, 4, len(entries))
+	})
+
+	t.Run("re-open", func(t *testing.T) {
+		tx5 := db1.NewTx()
+		tx5.Get([]byte("alex_a"))
+		tx5.Set([]byte("carl"), int64b(1))
+		tx5.data.TimeStart = 2
+
+		tx6 := db1.NewTx()
+		tx6.Get([]byte("bob"))
+		tx6.Set([]byte("dave"), int64b(1))
+		tx6.data.TimeStart = 2
+		test.Ok(t, db1.Close())
+
+		db3, err := OpenDB(dir)
+		test.Ok(t, err)
+
+		//data, time and the commits of the oracle survive
+		tx7 := db3.NewTx()
+		test.Equals(t, uint64(3), tx7.data.TimeStart)
+		test.Equals(t, int64b(3), tx7.Get([]byte("alex_a")))
+		test.Equals(t, ErrConflict, db3.Commit(tx5.Data(), false))
+		test.Ok(t, db3.Commit(tx6.Data(), false))
+
+		tx8 := db3.NewTx()
+		tx7.Set([]byte("carl"), int64b(1))
+		test.Ok(t, tx7.Commit())
+		test.Equals(t, int64b(1), db3.NewTx().Get([]byte("carl")))
+
+		//views from before the low-watermark can no longer be read
+		db3.Evict()
+		test.Equals(t, []byte(nil), tx8.Get([]byte("carl")))
+		test.Equals(t, ErrTooOld, tx8.Err())
+		test.Equals(t, ErrTooOld, tx8.Commit())
+
+		//the low-watermark is stored with the next write
+		tx9 := db3.NewTx()
+		tx9.Set([]byte("eve"), int64b(1))
+		test.Ok(t, tx9.Commit())
+		test.Ok(t, db3.Close())
+
+		db4, err := OpenDB(dir)
+		test.Ok(t, err)
+		defer db4.Close()
+
+		curr, low := db4.Time()
+		test.Equals(t, uint64(6), curr)
+		test.Equals(t, uint64(5), low)
+		test.Equals(t, ErrTooOld, db4.Commit(tx6.Data(), true))
+	})
+}
+
+func TestBadgerDBFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssi_")
+	test.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	db1 := NewDB()
+	tx1 := db1.NewTx()
+	tx1.Set([]byte("alex"), int64b(1))
+	test.Ok(t, tx1.Commit())
+	tx2 := db1.NewTx()
+	tx2.Set([]byte("bob"), int64b(2))
+	test.Ok(t, tx2.Commit())
+
+	time, entries, err := db1.Snapshot()
+	test.Ok(t, err)
+
+	db2, err := OpenDBFromSnapshot(dir, time, entries)
+	test.Ok(t, err)
+
+	//commit times are restored, reading with an old start time conflicts
+	tx3 := db2.NewTx()
+	test.Equals(t, uint64(3), tx3.data.TimeStart)
+	test.Equals(t, int64b(2), tx3.Get([]byte("bob")))
+	tx3.data.TimeStart = 2
+	tx3.Set([]byte("carl"), int64b(3))
+	test.Equals(t, ErrConflict, tx3.Commit())
+
+	time2, entries2, err := db2.Snapshot()
+	test.Ok(t, err)
+	test.Equals(t, time, time2)
+	test.Equals(t, entries, entries2)
+	test.Ok(t, db2.Close())
+
+	_, err = OpenDBFromSnapshot(dir, time, entries)
+	test.Assert(t, err != nil, "should not open from snapshot twice")
+}
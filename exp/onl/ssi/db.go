@@ -1,73 +1,137 @@
 package ssi
 
 import (
+	"sync"
+
 	iradix "github.com/hashicorp/go-immutable-radix"
 )
 
-//DB creates the database
+//DB creates the database. It starts no goroutines of its own, operations are
+//serialized with a lock such that databases that are no longer used can simply
+//be garbage collected.
 type DB struct {
-	txReqs     chan *txReq     //transaction starts
-	commitReqs chan *commitReq //transaction commits
-
 	oracle *Oracle
-	store  *iradix.Tree
+	store  Store
+	mu     sync.Mutex
 }
 
-//NewDB sets up the database
+//NewDB sets up a database that keeps its data in memory
 func NewDB() (db *DB) {
-	db = &DB{
-		txReqs:     make(chan *txReq),
-		commitReqs: make(chan *commitReq),
+	return newDB(NewOracle(), &memStore{iradix.New()})
+}
+
+func newDB(oracle *Oracle, store Store) (db *DB) {
+	return &DB{oracle: oracle, store: store}
+}
 
-		oracle: NewOracle(),
-		store:  iradix.New(),
+//NewTx creates an new transaction
+func (db *DB) NewTx() *Tx {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return &Tx{
+		c:      db,
+		view:   db.store.View(), //fetch a poin-in-time view
+		writes: iradix.New().Txn(),
+		data: &TxData{
+			TimeStart: db.oracle.Curr(), //pick up a read time stamp
+			ReadRows:  make(KeySet),
+			WriteRows: make(KeyChangeSet),
+		},
 	}
+}
 
-	go func() {
-		for {
-
-			select {
-			case req := <-db.txReqs:
-				tx := &Tx{
-					c:        db,
-					snapshot: db.store.Txn(), //fetch a poin-in-time copy
-					data: &TxData{
-						TimeStart: db.oracle.Curr(), //pick up a read time stamp
-						ReadRows:  make(KeySet),
-						WriteRows: make(KeyChangeSet),
-					},
-				}
-
-				req.tx <- tx
-			case req := <-db.commitReqs:
-
-				//commit to the oracle for a timestamp
-				tc := db.oracle.Commit(req.rr, req.rw.KeySet(), req.ts)
-				if tc == 0 {
-					req.tc <- tc //no commit time, must be a conflict
-					break
-				}
-
-				//no conflict, if its not a dry run, go ahead and write changes to the store
-				if !req.dry {
-					for _, change := range req.rw {
-						db.store, _, _ = db.store.Insert(change.K, change.V) //write actual changes for new reads
-					}
-				}
-
-				req.tc <- tc
-			}
-		}
-	}()
+//Clone returns a copy of the database that can be committed to independently
+//of this one. Stored data is shared where possible, the commits of the status
+//oracle are copied.
+func (db *DB) Clone() *DB {
+	oracle, store := db.copy()
+	return newDB(oracle, store)
+}
 
-	return
+//Snapshot returns the current time of the oracle and every key-value pair in
+//the database, in key order, with the time it was last committed at.
+func (db *DB) Snapshot() (time uint64, entries []*Entry, err error) {
+	oracle, store := db.copy()
+	view := store.View()
+	view.Walk(Range{}, func(k, v []byte) bool {
+		e := &Entry{K: make([]byte, len(k)), V: make([]byte, len(v))}
+		copy(e.K, k)
+		copy(e.V, v)
+		e.T = oracle.commits[keyHash(k)]
+
+		entries = append(entries, e)
+		return false
+	})
+
+	if err = view.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return oracle.time, entries, nil
 }
 
-//NewTx creates an new transaction
-func (db *DB) NewTx() *Tx {
-	req := &txReq{tx: make(chan *Tx)}
-	db.txReqs <- req
-	return <-req.tx
+//NewDBFromSnapshot sets up a database from the oracle time and entries that
+//were returned by a snapshot.
+func NewDBFromSnapshot(time uint64, entries []*Entry) (db *DB) {
+	oracle := NewOracle()
+	oracle.time = time
+
+	txn := iradix.New().Txn()
+	keys := iradix.New().Txn()
+	for _, e := range entries {
+		k := make([]byte, len(e.K))
+		copy(k, e.K)
+		v := make([]byte, len(e.V))
+		copy(v, e.V)
+
+		txn.Insert(k, v)
+		oracle.commits[keyHash(k)] = e.T
+		keys.Insert(k, e.T)
+	}
+
+	oracle.keys = keys.Commit()
+
+	return newDB(oracle, &memStore{txn.Commit()})
+}
+
+//Evict raises the low-watermark of the status oracle to its current time such
+//that it forgets about all commits so far. Transactions that started before
+//this point will fail to commit with ErrTooOld.
+func (db *DB) Evict() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.oracle.Evict(db.oracle.Curr())
+	db.store.Evict(db.oracle.Low())
+}
+
+//EvictTo raises the low-watermark of the status oracle to time 'wm', commits at
+//or before it are forgotten.
+func (db *DB) EvictTo(wm uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.oracle.Evict(wm)
+	db.store.Evict(db.oracle.Low())
+}
+
+//Time returns the current time and the low-watermark of the status oracle
+func (db *DB) Time() (curr, low uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.oracle.Curr(), db.oracle.Low()
+}
+
+//Close the database and its store, it should no longer be used afterwards
+func (db *DB) Close() (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.store.Close()
+}
+
+//copy the oracle, the store is immutable so it can be shared
+func (db *DB) copy() (oracle *Oracle, store Store) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.oracle.Clone(), db.store.Clone()
 }
 
 //Commit a transaction with just it's data portion.
@@ -76,34 +140,57 @@ func (db *DB) Commit(txd *TxData, dry bool) (err error) {
 		return nil //nothing to commit
 	}
 
-	req := &commitReq{
-		dry: dry,
-		tc:  make(chan uint64),
-		rr:  txd.ReadRows,
-		rw:  txd.WriteRows,
-		ts:  txd.TimeStart,
-	}
+	txd.TimeCommit, err = db.commit(txd, dry, false)
+	return
+}
 
-	db.commitReqs <- req
-	txd.TimeCommit = <-req.tc
-	if txd.TimeCommit == 0 {
-		return ErrConflict
+//Replay commits transaction data that was already checked for conflicts by
+//another database. If it started before the watermark it is only checked
+//against the commits that were not evicted.
+func (db *DB) Replay(txd *TxData) (err error) {
+	if len(txd.WriteRows) < 1 {
+		return nil //nothing to commit
 	}
 
+	txd.TimeCommit, err = db.commit(txd, false, true)
 	return
 }
 
-//tx req is send when a user requests a new transaction
-type txReq struct {
-	tx chan *Tx
+//Conflicts returns ErrConflict if committing the transaction data would
+//conflict, or ErrTooOld if it can no longer be checked, without committing
+func (db *DB) Conflicts(txd *TxData) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.oracle.Conflicts(txd.ReadRows, txd.ReadRanges, txd.TimeStart)
 }
 
-//commitReq is send when a user wants to commit a transaction
-type commitReq struct {
-	dry bool
-	rw  KeyChangeSet
-	rr  KeySet
+//commit checks the data for conflicts and, unless it is a dry run, writes it
+//to the store. It returns the commit time, or zero if it was not committed.
+func (db *DB) commit(txd *TxData, dry, replay bool) (tc uint64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	//replayed transactions were checked before, only check them against the
+	//commits the oracle still knows about
+	ts := txd.TimeStart
+	if replay && ts < db.oracle.Low() {
+		ts = db.oracle.Low()
+	}
+
+	//check for conflicts first, the store may fail to write
+	err = db.oracle.Conflicts(txd.ReadRows, txd.ReadRanges, ts)
+	if err != nil {
+		return 0, err //conflict or too old
+	}
+
+	//no conflict, if its not a dry run, go ahead and write changes to the store
+	if !dry {
+		err = db.store.Write(txd.WriteRows, db.oracle.Curr()+1) //write actual changes for new reads
+		if err != nil {
+			return 0, err
+		}
+	}
 
-	ts uint64
-	tc chan uint64
+	//mark the commit in the oracle for a timestamp
+	return db.oracle.mark(txd.WriteRows), nil
 }
@@ -1,11 +1,24 @@
 package ssi
 
 import (
+	"runtime"
 	"testing"
 
 	test "github.com/advanderveer/go-test"
 )
 
+func TestDBClonesStartNoGoroutines(t *testing.T) {
+	n := runtime.NumGoroutine()
+	db := NewDB()
+	for i := 0; i < 100; i++ {
+		tx := db.Clone().NewTx()
+		tx.Set([]byte("alex"), int64b(int64(i)))
+		test.Ok(t, tx.Commit())
+	}
+
+	test.Equals(t, n, runtime.NumGoroutine())
+}
+
 func TestBasicTimestamping(t *testing.T) {
 	db := NewDB()
 	tx := db.NewTx()
@@ -115,3 +128,214 @@ func TestValueChangeOutsideTx(t *testing.T) {
 		test.Equals(t, []byte{0x02}, tx.Get([]byte("bob")))
 	})
 }
+
+func TestClone(t *testing.T) {
+	db1 := NewDB()
+	tx1 := db1.NewTx()
+	tx1.Set([]byte("alex"), int64b(100))
+	test.Ok(t, tx1.Commit())
+
+	db2 := db1.Clone()
+	tx2 := db2.NewTx()
+	test.Equals(t, uint64(2), tx2.data.TimeStart) //oracle time is copied
+	test.Equals(t, int64b(100), tx2.Get([]byte("alex")))
+
+	tx2.Set([]byte("bob"), int64b(1))
+	test.Ok(t, tx2.Commit())
+
+	//clone should be independent of the original
+	tx3 := db1.NewTx()
+	test.Equals(t, uint64(2), tx3.data.TimeStart)
+	test.Equals(t, []byte(nil), tx3.Get([]byte("bob")))
+
+	//commits should be copied, reading from key written before the clone
+	//with an old start time should still conflict
+	tx4 := db2.NewTx()
+	tx4.Get([]byte("alex"))
+	tx4.Set([]byte("carl"), int64b(1))
+	tx4.data.TimeStart = 1
+	test.Equals(t, ErrConflict, db2.Commit(tx4.Data(), true))
+}
+
+func TestSnapshotting(t *testing.T) {
+	db1 := NewDB()
+	tx1 := db1.NewTx()
+	tx1.Set([]byte("bob"), int64b(1))
+	tx1.Set([]byte("alex"), int64b(100))
+	test.Ok(t, tx1.Commit())
+
+	time, entries, err := db1.Snapshot()
+	test.Ok(t, err)
+	test.Equals(t, uint64(2), time)
+	test.Equals(t, []*Entry{
+		{K: []byte("alex"), V: int64b(100), T: 2},
+		{K: []byte("bob"), V: int64b(1), T: 2},
+	}, entries)
+
+	db2 := NewDBFromSnapshot(time, entries)
+	tx2 := db2.NewTx()
+	test.Equals(t, uint64(2), tx2.data.TimeStart)
+	test.Equals(t, int64b(100), tx2.Get([]byte("alex")))
+
+	//commit times should be restored, reading with an old start time conflicts
+	tx2.Set([]byte("carl"), int64b(1))
+	tx2.data.TimeStart = 1
+	test.Equals(t, ErrConflict, db2.Commit(tx2.Data(), true))
+}
+
+func TestScanning(t *testing.T) {
+	db := NewDB()
+	tx1 := db.NewTx()
+	tx1.Set([]byte("alex_a"), int64b(1))
+	tx1.Set([]byte("alex_b"), int64b(2))
+	tx1.Set([]byte("bob_a"), int64b(3))
+	test.Ok(t, tx1.Commit())
+
+	tx2 := db.NewTx()
+	tx2.Set([]byte("alex_c"), int64b(4)) //own writes are scanned as well
+
+	var ks []string
+	tx2.Scan([]byte("alex_"), func(k, v []byte) bool {
+		ks = append(ks, string(k))
+		return false
+	})
+
+	test.Equals(t, []string{"alex_a", "alex_b", "alex_c"}, ks)
+	test.Equals(t, []Range{PrefixRange([]byte("alex_"))}, tx2.data.ReadRanges)
+
+	ks = nil
+	tx2.Range([]byte("alex_b"), []byte("bob_a"), func(k, v []byte) bool {
+		ks = append(ks, string(k))
+		return false
+	})
+
+	test.Equals(t, []string{"alex_b", "alex_c"}, ks)
+
+	ks = nil
+	tx2.Range(nil, nil, func(k, v []byte) bool {
+		ks = append(ks, string(k))
+		return len(ks) == 2
+	})
+
+	test.Equals(t, []string{"alex_a", "alex_b"}, ks)
+
+	t.Run("encoding", func(t *testing.T) {
+		d, err := tx2.data.MarshalBinary()
+		test.Ok(t, err)
+
+		txd := &TxData{}
+		test.Ok(t, txd.UnmarshalBinary(d))
+		test.Equals(t, tx2.data.ReadRanges, txd.ReadRanges)
+	})
+
+}
+
+func TestPhantomConflict(t *testing.T) {
+	db := NewDB()
+	tx1 := db.NewTx()
+	tx2 := db.NewTx()
+	tx3 := db.NewTx()
+
+	//tx1 lists the keys of alex, finds nothing and writes elsewhere
+	tx1.Scan([]byte("alex_"), func(k, v []byte) bool { return false })
+	tx1.Set([]byte("count"), int64b(0))
+
+	//tx2 concurrently inserts a key for alex
+	tx2.Set([]byte("alex_a"), int64b(1))
+	test.Ok(t, tx2.Commit())
+
+	//the insert happened in the scanned range, so tx1 read a phantom
+	test.Equals(t, ErrConflict, db.Commit(tx1.Data(), true))
+
+	//a concurrent insert outside of the range doesn't conflict
+	tx3.Scan([]byte("bob_"), func(k, v []byte) bool { return false })
+	tx3.Set([]byte("count"), int64b(0))
+	test.Ok(t, db.Commit(tx3.Data(), true))
+
+	t.Run("after snapshotting", func(t *testing.T) {
+		time, entries, err := db.Snapshot()
+		test.Ok(t, err)
+
+		db2 := NewDBFromSnapshot(time, entries)
+		tx4 := db2.NewTx()
+		tx4.Scan([]byte("alex_"), func(k, v []byte) bool { return false })
+		tx4.Set([]byte("count"), int64b(0))
+		tx4.data.TimeStart = 1
+		test.Equals(t, ErrConflict, db2.Commit(tx4.Data(), true))
+	})
+}
+
+func TestWatermark(t *testing.T) {
+	db := NewDB()
+	tx1 := db.NewTx()
+	tx1.Set([]byte("alex"), int64b(100))
+	test.Ok(t, tx1.Commit())
+
+	tx2 := db.NewTx()
+	tx2.Set([]byte("bob"), int64b(1))
+	test.Ok(t, tx2.Commit())
+
+	//a transaction that started before the commits still conflicts
+	tx3 := db.NewTx()
+	tx3.Get([]byte("alex"))
+	tx3.Set([]byte("carl"), int64b(1))
+	tx3.data.TimeStart = 1
+	test.Equals(t, ErrConflict, db.Commit(tx3.Data(), true))
+
+	//after eviction the oracle no longer knows and rejects it as too old
+	db.Evict()
+	test.Equals(t, ErrTooOld, db.Commit(tx3.Data(), true))
+	test.Equals(t, ErrTooOld, db.Conflicts(tx3.Data()))
+
+	oracle, _ := db.copy()
+	test.Equals(t, uint64(3), oracle.Low())
+	test.Equals(t, 0, len(oracle.commits))
+	test.Equals(t, 0, oracle.keys.Len())
+
+	//transactions that started at the watermark are fine
+	tx4 := db.NewTx()
+	tx4.Get([]byte("alex"))
+	tx4.Set([]byte("carl"), int64b(1))
+	test.Ok(t, tx4.Commit())
+
+	//replayed transactions are only checked against the commits that are left
+	tx3.data.TimeStart = 1
+	test.Ok(t, db.Replay(tx3.Data()))
+	tx5 := db.NewTx()
+	tx5.Get([]byte("carl"))
+	tx5.Set([]byte("dirk"), int64b(1))
+	tx5.data.TimeStart = 1
+	test.Equals(t, ErrConflict, db.Replay(tx5.Data()))
+
+	t.Run("clone keeps the watermark", func(t *testing.T) {
+		tx6 := db.Clone().NewTx()
+		tx6.Set([]byte("dirk"), int64b(1))
+		tx6.data.TimeStart = 2
+		test.Equals(t, ErrTooOld, db.Clone().Commit(tx6.Data(), true))
+	})
+
+	t.Run("cannot evict the future", func(t *testing.T) {
+		o := NewOracle()
+		o.Evict(100)
+		test.Equals(t, uint64(1), o.Low())
+		o.Evict(0)
+		test.Equals(t, uint64(1), o.Low())
+	})
+
+	t.Run("evict to a time", func(t *testing.T) {
+		db := NewDB()
+		for _, k := range []string{"alex", "bob"} {
+			tx := db.NewTx()
+			tx.Set([]byte(k), int64b(1))
+			test.Ok(t, tx.Commit())
+		}
+
+		db.EvictTo(2)
+		curr, low := db.Time()
+		test.Equals(t, uint64(3), curr)
+		test.Equals(t, uint64(2), low)
+
+		oracle, _ := db.copy()
+		test.Equals(t, 1, len(oracle.commits))
+	})
+}
@@ -5,4 +5,8 @@ import "errors"
 var (
 	//ErrConflict is returned when the a conclicting transaction was detected
 	ErrConflict = errors.New("conflict: other transactions committed concurrently and modified this transaction read data")
+
+	//ErrTooOld is returned when the transaction started before the low-watermark
+	//of the status oracle, it should be re-read and tried again
+	ErrTooOld = errors.New("too old: transaction started before the low-watermark, re-read and try again")
 )
@@ -1,8 +1,11 @@
 package ssi
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
 )
 
 //KH is the key hash, cryptographically secure
@@ -14,6 +17,13 @@ type Change struct {
 	V []byte
 }
 
+//Entry is a stored key-value pair and the time it was last committed at
+type Entry struct {
+	K []byte
+	V []byte
+	T uint64
+}
+
 //KeyChangeSet is a set of transaction keys with their values
 type KeyChangeSet map[KH]*Change
 
@@ -44,6 +54,69 @@ func (ks KeySet) Add(k []byte) {
 	ks[keyHash(k)] = struct{}{}
 }
 
+//Range is a range of keys from Start (inclusive) up to End (exclusive), an
+//empty End means the range has no upper bound
+type Range struct {
+	Start []byte
+	End   []byte
+}
+
+//PrefixRange returns the range of all keys that start with 'prefix'
+func PrefixRange(prefix []byte) (r Range) {
+	r.Start = append(r.Start, prefix...)
+
+	//the end is the prefix incremented by one, if it consists of only 0xff it
+	//has no upper bound
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			r.End = make([]byte, i+1)
+			copy(r.End, prefix)
+			r.End[i]++
+			break
+		}
+	}
+
+	return
+}
+
+//Contains returns whether key 'k' falls within the range
+func (r Range) Contains(k []byte) bool {
+	if bytes.Compare(k, r.Start) < 0 {
+		return false
+	}
+
+	return len(r.End) == 0 || bytes.Compare(k, r.End) < 0
+}
+
+//Walk calls 'f' for each key in the node that falls in the range, in key
+//order, until it returns true
+func (r Range) Walk(n *iradix.Node, f func(k []byte, v interface{}) bool) {
+	var prefix []byte
+	if len(r.End) > 0 {
+		prefix = r.Start[:commonPrefix(r.Start, r.End)]
+	}
+
+	n.WalkPrefix(prefix, func(k []byte, v interface{}) bool {
+		if bytes.Compare(k, r.Start) < 0 {
+			return false
+		}
+
+		if len(r.End) > 0 && bytes.Compare(k, r.End) >= 0 {
+			return true //passed the end
+		}
+
+		return f(k, v)
+	})
+}
+
+func commonPrefix(a, b []byte) (n int) {
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return
+}
+
 func keyHash(k []byte) (kh KH) {
 	//@TODO document what effect do collisions have? Logic sugges that the hash
 	//then covers (in effect) more then one actual key, this means that any reads
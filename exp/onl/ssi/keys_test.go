@@ -22,3 +22,27 @@ func TestKeySets(t *testing.T) {
 	test.Equals(t, 2, len(s2))
 
 }
+
+func TestRanges(t *testing.T) {
+	test.Equals(t, Range{Start: []byte("ab"), End: []byte("ac")}, PrefixRange([]byte("ab")))
+	test.Equals(t, Range{Start: []byte{0x01, 0xff}, End: []byte{0x02}}, PrefixRange([]byte{0x01, 0xff}))
+	test.Equals(t, Range{Start: []byte{0xff}}, PrefixRange([]byte{0xff}))
+	test.Equals(t, Range{}, PrefixRange(nil))
+
+	r := PrefixRange([]byte("ab"))
+	test.Equals(t, true, r.Contains([]byte("ab")))
+	test.Equals(t, true, r.Contains([]byte("abz")))
+	test.Equals(t, false, r.Contains([]byte("a")))
+	test.Equals(t, false, r.Contains([]byte("ac")))
+	test.Equals(t, true, Range{Start: []byte("b")}.Contains([]byte("zzz")))
+
+	txd := &TxData{}
+	txd.addReadRange(Range{Start: []byte("b"), End: []byte("c")})
+	txd.addReadRange(Range{Start: []byte("a"), End: []byte("b")})
+	txd.addReadRange(Range{Start: []byte("b"), End: []byte("d")})
+	txd.addReadRange(Range{Start: []byte("b"), End: []byte("bb")})
+	test.Equals(t, []Range{
+		{Start: []byte("a"), End: []byte("b")},
+		{Start: []byte("b"), End: []byte("d")},
+	}, txd.ReadRanges)
+}
@@ -1,9 +1,21 @@
 package ssi
 
+import (
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
 //Oracle represents the status oracle in "A critique of snapshot isolation" [M Yabandeh, 2012]
 type Oracle struct {
 	time    uint64
 	commits map[KH]uint64
+
+	//low is the watermark, commits at or below it are evicted and transactions
+	//that started before it can no longer be checked for conflicts
+	low uint64
+
+	//keys holds the last commit time of each written key in key order such
+	//that scanned ranges can be checked for conflicts
+	keys *iradix.Tree
 }
 
 //NewOracle creates the status oracle
@@ -11,33 +23,113 @@ func NewOracle() *Oracle {
 	return &Oracle{
 		time:    1,
 		commits: make(map[KH]uint64),
+		keys:    iradix.New(),
 	}
 }
 
+//Clone returns a copy of the oracle with the same time and commits
+func (o *Oracle) Clone() (c *Oracle) {
+	c = &Oracle{
+		time:    o.time,
+		low:     o.low,
+		commits: make(map[KH]uint64, len(o.commits)),
+		keys:    o.keys, //immutable, can be shared
+	}
+
+	for k, t := range o.commits {
+		c.commits[k] = t
+	}
+
+	return
+}
+
 //Curr returns the current time kept by the status oracle
 func (o *Oracle) Curr() uint64 {
 	return o.time
 }
 
-//Commit will check if concurrent transactions we're committed that wrote to the
-//keys this commit wrote to check for conflicts.
-func (o *Oracle) Commit(rr, rw KeySet, ts uint64) (tc uint64) {
+//Low returns the low-watermark of the status oracle
+func (o *Oracle) Low() uint64 {
+	return o.low
+}
 
-	//if if there were any transactions that committed after the start (ts)
-	//of this transaction and that wrote to the the rows that this transaction
-	//has read from
+//Evict raises the low-watermark to 'wm' and forgets about all commits at or
+//below it. Transactions that started before the watermark will be rejected
+//from then on, which bounds the memory the oracle needs to recent commits.
+func (o *Oracle) Evict(wm uint64) {
+	if wm > o.time {
+		wm = o.time //cannot evict commits that didn't happen yet
+	}
 
-	for r := range rr {
-		if o.commits[r] > ts {
-			return 0 //conflict
+	if wm <= o.low {
+		return
+	}
+
+	o.low = wm
+	txn := o.keys.Txn()
+	o.keys.Root().Walk(func(k []byte, v interface{}) bool {
+		if v.(uint64) <= wm {
+			txn.Delete(k)
+			delete(o.commits, keyHash(k))
 		}
+
+		return false
+	})
+
+	o.keys = txn.Commit()
+}
+
+//Commit will check if concurrent transactions we're committed that wrote to the
+//keys or ranges this commit read from to check for conflicts.
+func (o *Oracle) Commit(rr KeySet, rranges []Range, rw KeyChangeSet, ts uint64) (tc uint64, err error) {
+	err = o.Conflicts(rr, rranges, ts)
+	if err != nil {
+		return 0, err
 	}
 
-	//if not, we mark commits with their new write time
+	return o.mark(rw), nil
+}
+
+//mark the written keys with a new commit time
+func (o *Oracle) mark(rw KeyChangeSet) uint64 {
 	o.time++
-	for r := range rw {
+	txn := o.keys.Txn()
+	for r, c := range rw {
 		o.commits[r] = o.time //keep the last committed time
+		txn.Insert(c.K, o.time)
 	}
 
+	o.keys = txn.Commit()
 	return o.time
 }
+
+//Conflicts returns an error if any transaction committed after the start (ts)
+//of this transaction and wrote to the rows or ranges that it has read from. If
+//the transaction started before the watermark this can no longer be checked.
+func (o *Oracle) Conflicts(rr KeySet, rranges []Range, ts uint64) error {
+	if ts < o.low {
+		return ErrTooOld
+	}
+
+	for r := range rr {
+		if o.commits[r] > ts {
+			return ErrConflict
+		}
+	}
+
+	//the same goes for keys in the ranges it scanned, this includes keys that
+	//didn't exist when they were scanned (phantoms)
+	for _, rng := range rranges {
+		conflict := false
+		rng.Walk(o.keys.Root(), func(k []byte, v interface{}) bool {
+			conflict = v.(uint64) > ts
+			return conflict
+		})
+
+		if conflict {
+			return ErrConflict
+		}
+	}
+
+	return nil
+}
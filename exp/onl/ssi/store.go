@@ -0,0 +1,161 @@
+package ssi
+
+import (
+	"bytes"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+//Store holds the committed key-value pairs of a database. It is only written
+//to by the database itself, views can be read concurrently.
+type Store interface {
+
+	//View returns a read-only, point-in-time view of the committed data
+	View() View
+
+	//Write the changes and the oracle time they were committed at, either all
+	//of them are written or none are
+	Write(changes KeyChangeSet, time uint64) (err error)
+
+	//Evict is called when the low-watermark of the oracle is raised to 'low',
+	//views from before it no longer need to be readable
+	Evict(low uint64)
+
+	//Clone returns a store that starts out with the same data but can be
+	//written to independently of this one
+	Clone() Store
+
+	//Close the store, views of it should no longer be read
+	Close() (err error)
+}
+
+//View is a read-only, point-in-time view of the data in a store. The keys and
+//values it provides should not be modified.
+type View interface {
+
+	//Get the value at key 'k', ok is false if it doesn't exist
+	Get(k []byte) (v []byte, ok bool)
+
+	//Walk calls 'f' for each key in the range, in key order, until it returns
+	//true. The key and value are only valid during the call.
+	Walk(r Range, f func(k, v []byte) bool)
+
+	//Err returns the first error the view encountered while reading, reads
+	//return nothing after it
+	Err() error
+}
+
+//memStore keeps all data in memory, in an immutable radix tree such that its
+//views and clones can share it
+type memStore struct{ tree *iradix.Tree }
+
+func (s *memStore) View() View   { return &memView{s.tree} }
+func (s *memStore) Clone() Store { return &memStore{s.tree} }
+func (s *memStore) Close() error { return nil }
+func (s *memStore) Evict(uint64) {}
+
+func (s *memStore) Write(changes KeyChangeSet, time uint64) (err error) {
+	txn := s.tree.Txn()
+	for _, c := range changes {
+		txn.Insert(c.K, c.V)
+	}
+
+	s.tree = txn.Commit()
+	return
+}
+
+//memView is a view on an immutable radix tree
+type memView struct{ tree *iradix.Tree }
+
+func (v *memView) Get(k []byte) ([]byte, bool) {
+	vraw, ok := v.tree.Get(k)
+	if !ok {
+		return nil, false
+	}
+
+	return vraw.([]byte), true
+}
+
+func (v *memView) Walk(r Range, f func(k, v []byte) bool) {
+	r.Walk(v.tree.Root(), func(k []byte, vraw interface{}) bool {
+		return f(k, vraw.([]byte))
+	})
+}
+
+func (v *memView) Err() error { return nil }
+
+//overlayStore keeps writes in memory on top of a read-only view, it is used to
+//clone stores that cannot be copied cheaply
+type overlayStore struct {
+	base View
+	top  *iradix.Tree
+}
+
+func (s *overlayStore) View() View   { return &overlayView{s.base, s.top.Root()} }
+func (s *overlayStore) Clone() Store { return &overlayStore{s.base, s.top} }
+func (s *overlayStore) Close() error { return nil }
+func (s *overlayStore) Evict(uint64) {}
+
+func (s *overlayStore) Write(changes KeyChangeSet, time uint64) (err error) {
+	txn := s.top.Txn()
+	for _, c := range changes {
+		txn.Insert(c.K, c.V)
+	}
+
+	s.top = txn.Commit()
+	return
+}
+
+//overlayView reads key-values from the top before reading them from the base
+type overlayView struct {
+	base View
+	top  *iradix.Node
+}
+
+func (v *overlayView) Get(k []byte) ([]byte, bool) {
+	vraw, ok := v.top.Get(k)
+	if ok {
+		return vraw.([]byte), true
+	}
+
+	return v.base.Get(k)
+}
+
+func (v *overlayView) Walk(r Range, f func(k, v []byte) bool) {
+	walkMerged(r, v.base, v.top, f)
+}
+
+func (v *overlayView) Err() error { return v.base.Err() }
+
+//walkMerged walks the range of the base view and the top node in key order,
+//values in the top take precedence over those with the same key in the base
+func walkMerged(r Range, base View, top *iradix.Node, f func(k, v []byte) bool) {
+	var tks, tvs [][]byte
+	r.Walk(top, func(k []byte, vraw interface{}) bool {
+		tks = append(tks, k)
+		tvs = append(tvs, vraw.([]byte))
+		return false
+	})
+
+	var i int
+	var stop bool
+	base.Walk(r, func(k, v []byte) bool {
+		for ; i < len(tks) && bytes.Compare(tks[i], k) < 0; i++ {
+			if stop = f(tks[i], tvs[i]); stop {
+				return true
+			}
+		}
+
+		if i < len(tks) && bytes.Equal(tks[i], k) {
+			v = tvs[i]
+			i++
+		}
+
+		stop = f(k, v)
+		return stop
+	})
+
+	for ; !stop && i < len(tks); i++ {
+		stop = f(tks[i], tvs[i])
+	}
+}
@@ -1,6 +1,10 @@
 package ssi
 
 import (
+	"bytes"
+	"sort"
+
+	"github.com/advanderveer/27067dd17/onl/enc"
 	iradix "github.com/hashicorp/go-immutable-radix"
 )
 
@@ -11,17 +15,114 @@ type Committer interface {
 
 //TxData holds the transportable portion of the transaction
 type TxData struct {
-	TimeStart  uint64
+	TimeStart uint64
+
+	//TimeCommit is assigned by the database that commits the data, it is local
+	//to that database and therefore not part of the encoding
 	TimeCommit uint64
 	ReadRows   KeySet
 	WriteRows  KeyChangeSet
+
+	//ReadRanges are the key ranges that were scanned, sorted by their start. A
+	//concurrent write to any key in them is a conflict, even if the key didn't
+	//exist when it was scanned.
+	ReadRanges []Range
+}
+
+const txDataVersion = 2
+
+//MarshalBinary encodes the data canonically: rows are sorted by their key hash
+//and the key hash of write rows is not encoded as it follows from the key
+func (txd *TxData) MarshalBinary() (d []byte, err error) {
+	w := enc.NewWriter(txDataVersion)
+	w.Uint64(txd.TimeStart)
+
+	rr := make([]KH, 0, len(txd.ReadRows))
+	for kh := range txd.ReadRows {
+		rr = append(rr, kh)
+	}
+
+	sortKHs(rr)
+	w.Len(len(rr))
+	for _, kh := range rr {
+		w.Fixed(kh[:])
+	}
+
+	wr := make([]KH, 0, len(txd.WriteRows))
+	for kh := range txd.WriteRows {
+		wr = append(wr, kh)
+	}
+
+	sortKHs(wr)
+	w.Len(len(wr))
+	for _, kh := range wr {
+		w.Bytes(txd.WriteRows[kh].K)
+		w.Bytes(txd.WriteRows[kh].V)
+	}
+
+	w.Len(len(txd.ReadRanges))
+	for _, r := range txd.ReadRanges {
+		w.Bytes(r.Start)
+		w.Bytes(r.End)
+	}
+
+	return w.Data(), nil
+}
+
+//UnmarshalBinary decodes data that was encoded by MarshalBinary, rows that are
+//not in their canonical order are rejected.
+func (txd *TxData) UnmarshalBinary(d []byte) (err error) {
+	r, _ := enc.NewReader(d, txDataVersion)
+	txd.TimeStart = r.Uint64()
+	txd.TimeCommit = 0
+
+	n := r.Len()
+	txd.ReadRows = make(KeySet, n)
+	var prev []byte
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var kh KH
+		r.Fixed(kh[:])
+		r.Ascending(prev, kh[:])
+		txd.ReadRows[kh] = struct{}{}
+		prev = kh[:]
+	}
+
+	n = r.Len()
+	txd.WriteRows = make(KeyChangeSet, n)
+	prev = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		c := &Change{K: r.Bytes(), V: r.Bytes()}
+		kh := keyHash(c.K)
+		r.Ascending(prev, kh[:])
+		txd.WriteRows[kh] = c
+		prev = kh[:]
+	}
+
+	n = r.Len()
+	txd.ReadRanges = nil
+	prev = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		rng := Range{Start: r.Bytes(), End: r.Bytes()}
+		r.Ascending(prev, rng.Start)
+		txd.ReadRanges = append(txd.ReadRanges, rng)
+		prev = append([]byte{}, rng.Start...)
+	}
+
+	return r.Done()
+}
+
+func sortKHs(khs []KH) {
+	sort.Slice(khs, func(i, j int) bool {
+		return bytes.Compare(khs[i][:], khs[j][:]) < 0
+	})
 }
 
 //Tx is a transaction
 type Tx struct {
-	c        Committer
-	snapshot *iradix.Txn
-	data     *TxData
+	c      Committer
+	view   View        //committed data when the transaction started
+	writes *iradix.Txn //own writes, read before the view
+	data   *TxData
 }
 
 //Set key 'k' to value 'v'
@@ -29,33 +130,90 @@ func (tx *Tx) Set(k, v []byte) {
 	tx.data.WriteRows.Add(k, v)
 
 	//we need to copy the data else changing the array outside
-	//of the tx changes it in the snapshot
+	//of the tx changes it in the transaction
 	kd := make([]byte, len(k))
 	copy(kd, k)
 	vd := make([]byte, len(v))
 	copy(vd, v)
 
-	tx.snapshot.Insert(kd, vd)
+	tx.writes.Insert(kd, vd)
 }
 
 //Get the value 'v' at key 'k'
 func (tx *Tx) Get(k []byte) (v []byte) {
 	tx.data.ReadRows.Add(k)
-	vraw, ok := tx.snapshot.Get(k)
-	if !ok {
+	var vraw []byte
+	if wraw, ok := tx.writes.Get(k); ok {
+		vraw = wraw.([]byte)
+	} else if vraw, ok = tx.view.Get(k); !ok {
 		return nil
 	}
 
 	//make sure to copy
-	v = make([]byte, len(vraw.([]byte)))
-	copy(v, vraw.([]byte))
+	v = make([]byte, len(vraw))
+	copy(v, vraw)
 	return
 }
 
+//Range calls 'f' for every key-value pair from 'start' up to 'end' in key
+//order, until it returns true. The whole range is read, a concurrent write to
+//any key in it will cause a conflict.
+func (tx *Tx) Range(start, end []byte, f func(k, v []byte) bool) {
+	tx.scan(Range{Start: append([]byte(nil), start...), End: append([]byte(nil), end...)}, f)
+}
+
+//Scan calls 'f' for every key-value pair with the provided prefix, in key
+//order, until it returns true
+func (tx *Tx) Scan(prefix []byte, f func(k, v []byte) bool) {
+	tx.scan(PrefixRange(prefix), f)
+}
+
+func (tx *Tx) scan(r Range, f func(k, v []byte) bool) {
+	tx.data.addReadRange(r)
+	walkMerged(r, tx.view, tx.writes.Root(), func(k, vraw []byte) bool {
+
+		//make sure to copy
+		kc := make([]byte, len(k))
+		copy(kc, k)
+		v := make([]byte, len(vraw))
+		copy(v, vraw)
+		return f(kc, v)
+	})
+}
+
+//addReadRange adds a range while keeping them sorted by start, ranges with the
+//same start are merged
+func (txd *TxData) addReadRange(r Range) {
+	i := sort.Search(len(txd.ReadRanges), func(i int) bool {
+		return bytes.Compare(txd.ReadRanges[i].Start, r.Start) >= 0
+	})
+
+	if i < len(txd.ReadRanges) && bytes.Equal(txd.ReadRanges[i].Start, r.Start) {
+		curr := txd.ReadRanges[i]
+		if len(curr.End) > 0 && (len(r.End) == 0 || bytes.Compare(r.End, curr.End) > 0) {
+			txd.ReadRanges[i].End = r.End
+		}
+
+		return
+	}
+
+	txd.ReadRanges = append(txd.ReadRanges, Range{})
+	copy(txd.ReadRanges[i+1:], txd.ReadRanges[i:])
+	txd.ReadRanges[i] = r
+}
+
 //Data returns the underlying data, suitable for transport
 func (tx *Tx) Data() *TxData { return tx.data }
 
-//Commit the transaction
-func (tx *Tx) Commit() error {
+//Err returns the first error that was encountered while reading committed
+//data, reads returned nothing after it
+func (tx *Tx) Err() error { return tx.view.Err() }
+
+//Commit the transaction, it fails if reading committed data failed
+func (tx *Tx) Commit() (err error) {
+	if err = tx.Err(); err != nil {
+		return err
+	}
+
 	return tx.c.Commit(tx.Data(), false)
 }
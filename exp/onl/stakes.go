@@ -9,11 +9,16 @@ type Stakes struct {
 
 	//Votes hold the current voting state of a block
 	Votes map[PK]uint64
+
+	//Leaving holds, per leave round, the stake of members that leave in a round
+	//after this block. It still counts towards the sum until a block in or after
+	//that round builds on this block.
+	Leaving map[uint64]uint64
 }
 
 //NewStakes initializes a stakes struct
 func NewStakes(sum uint64) *Stakes {
-	return &Stakes{Sum: sum, Votes: make(map[PK]uint64)}
+	return &Stakes{Sum: sum, Votes: make(map[PK]uint64), Leaving: make(map[uint64]uint64)}
 }
 
 //Finalization returns a measure of finalization with a maximum of 1.0 where
@@ -1,9 +1,16 @@
 package onl
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
+	"github.com/advanderveer/27067dd17/onl/enc"
 	"github.com/advanderveer/27067dd17/onl/ssi"
 )
 
@@ -15,9 +22,25 @@ type State struct {
 
 	writes map[Nonce]struct{}
 	mu     sync.RWMutex
+
+	//time of the status oracle after each block, by round and in order, that
+	//is recent enough to raise the low-watermark to later on
+	marks []mark
+
+	//directory of a state that is kept on disk, and the block it is at as
+	//it is set by the chain
+	dir   string
+	block ID
+}
+
+//mark is the time of the status oracle after the block of a round
+type mark struct {
+	round uint64
+	time  uint64
 }
 
-// NewState initialized a state, reconstructing from any existing state from the log
+// NewState initialized a state, reconstructing from any existing state from the
+// log. Writes in the log are trusted and therefore not authorized again.
 func NewState(log [][]*Write) (s *State, err error) {
 	s = &State{
 		db:     ssi.NewDB(),
@@ -26,7 +49,7 @@ func NewState(log [][]*Write) (s *State, err error) {
 
 	for _, ws := range log {
 		for _, w := range ws {
-			err = s.Apply(w, false)
+			err = s.apply(w, false, false)
 			if err != nil {
 				return nil, err
 			}
@@ -36,12 +59,224 @@ func NewState(log [][]*Write) (s *State, err error) {
 	return
 }
 
+// NewStateFromSnapshot restores a state from a snapshot
+func NewStateFromSnapshot(time uint64, entries []*ssi.Entry, nonces []Nonce) (s *State) {
+	s = &State{
+		db:     ssi.NewDBFromSnapshot(time, entries),
+		writes: make(map[Nonce]struct{}, len(nonces)),
+	}
+
+	for _, n := range nonces {
+		s.writes[n] = struct{}{}
+	}
+
+	return
+}
+
+//stateVersion is the version of the file that a state that is kept on disk
+//stores its block, watermark and nonces in
+const stateVersion = 1
+
+// OpenState opens the state that is kept on disk in directory 'dir', or creates
+// an empty one. The data is stored as it is committed, the nonces and the
+// watermark are stored when the state is closed. A state that was not closed
+// fails to open with ErrStateNotClosed, it should be removed and rebuild.
+//@TODO the nonces of all applied writes are still kept in memory
+func OpenState(dir string) (s *State, err error) {
+	db, err := ssi.OpenDB(filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %v", err)
+	}
+
+	s = &State{db: db, writes: make(map[Nonce]struct{}), dir: dir}
+	err = s.load()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// OpenStateFromSnapshot creates a state in directory 'dir' from a snapshot, the
+// directory must not hold a state yet
+func OpenStateFromSnapshot(dir string, time uint64, entries []*ssi.Entry, nonces []Nonce) (s *State, err error) {
+	if _, err = os.Stat(filepath.Join(dir, "state")); err == nil {
+		return nil, fmt.Errorf("directory already holds a state")
+	}
+
+	db, err := ssi.OpenDBFromSnapshot(filepath.Join(dir, "data"), time, entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db from snapshot: %v", err)
+	}
+
+	s = &State{db: db, writes: make(map[Nonce]struct{}, len(nonces)), dir: dir}
+	for _, n := range nonces {
+		s.writes[n] = struct{}{}
+	}
+
+	return
+}
+
+//removeState removes the files of a state that is kept on disk in 'dir'
+func removeState(dir string) (err error) {
+	for _, name := range []string{"data", "state", "state.tmp"} {
+		err = os.RemoveAll(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+//load what was stored when the state was closed, it is removed afterwards such
+//that a state that is not closed again cannot be opened
+func (s *State) load() (err error) {
+	path := filepath.Join(s.dir, "state")
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if curr, _ := s.db.Time(); curr > 1 {
+			return ErrStateNotClosed //data was committed after it was opened
+		}
+
+		return nil //new state
+	} else if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	r, _ := enc.NewReader(d, stateVersion)
+	r.Fixed(s.block[:])
+	low := r.Uint64()
+	marks := decodeRounds(r)
+	n := r.Len()
+	var prev []byte
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var nonce Nonce
+		r.Fixed(nonce[:])
+		r.Ascending(prev, nonce[:])
+		s.writes[nonce] = struct{}{}
+		prev = nonce[:]
+	}
+
+	err = r.Done()
+	if err != nil {
+		return fmt.Errorf("failed to decode state file: %v", err)
+	}
+
+	s.restoreWatermark(low, marks)
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove state file: %v", err)
+	}
+
+	return
+}
+
+//store the block, watermark and nonces of a state that is kept on disk, it
+//is written to a temporary file first such that it is never stored partially
+func (s *State) store() (err error) {
+	_, low := s.db.Time()
+	marks := make(map[uint64]uint64, len(s.marks))
+	for _, m := range s.marks {
+		marks[m.round] = m.time
+	}
+
+	e := enc.NewWriter(stateVersion)
+	e.Fixed(s.block[:])
+	e.Uint64(low)
+	encodeRounds(e, marks)
+	nonces := s.nonces()
+	e.Len(len(nonces))
+	for _, n := range nonces {
+		e.Fixed(n[:])
+	}
+
+	path := filepath.Join(s.dir, "state")
+	err = ioutil.WriteFile(path+".tmp", e.Data(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to move state file: %v", err)
+	}
+
+	return
+}
+
+//Close the state, it should no longer be used. A state that is kept on disk
+//stores what it needs to be opened again.
+func (s *State) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		err = s.store()
+		if err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+
+	return s.db.Close()
+}
+
+//Snapshot returns the state's time, all its key-value entries and the (sorted)
+//nonces of the writes that were applied to it.
+func (s *State) Snapshot() (time uint64, entries []*ssi.Entry, nonces []Nonce, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	time, entries, err = s.db.Snapshot()
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to snapshot db: %v", err)
+	}
+
+	return time, entries, s.nonces(), nil
+}
+
+//nonces returns the nonces of the applied writes in order
+func (s *State) nonces() (nonces []Nonce) {
+	for n := range s.writes {
+		nonces = append(nonces, n)
+	}
+
+	sort.Slice(nonces, func(i, j int) bool {
+		return bytes.Compare(nonces[i][:], nonces[j][:]) < 0
+	})
+
+	return
+}
+
+//Clone returns a copy of the state that can be applied to independently
+func (s *State) Clone() (c *State) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c = &State{
+		db:     s.db.Clone(),
+		writes: make(map[Nonce]struct{}, len(s.writes)),
+		marks:  append([]mark(nil), s.marks...),
+	}
+
+	for n := range s.writes {
+		c.writes[n] = struct{}{}
+	}
+
+	return
+}
+
 //Apply will try to perform the write while making sure no other reads have been
 //performed concurrently. It can be applied in a dry run, which only pretends that
 //the data would be added but isn't actually. This method is also called in the
 //process of replicating block writes. If apply returns an error it will not be
 //accepted by peers.
 func (s *State) Apply(w *Write, dry bool) (err error) {
+	return s.apply(w, dry, true)
+}
+
+func (s *State) apply(w *Write, dry, authorize bool) (err error) {
 	if w == nil {
 		return //nil writes can happen if update calls result in zero writes
 	}
@@ -54,50 +289,362 @@ func (s *State) Apply(w *Write, dry bool) (err error) {
 		return ErrAlreadyApplied
 	}
 
-	//@TODO validate how keys are written, authentication and authorization
-	//@TODO prevent editing of system keys like "balance" and "stake"
-	//@TODO enforce special rules such as balance not becoming negative
-	//@TODO some operations can only be done in the genesis block
+	//check who wrote it and whether it was allowed to write what it wrote, the
+	//values it read must still be current so a conflict is reported first
 	//@TODO some operations can only be done with proof of misbehaviour
-	//@TODO validate max key and value lengths
-	//@TODO check signature
+	if authorize {
+		w.RLock()
+		err = w.CheckLimits()
+		if err != nil {
+			w.RUnlock()
+			return err
+		}
+
+		switch s.db.Conflicts(w.TxData) {
+		case ssi.ErrConflict:
+			err = ErrApplyConflict
+		case ssi.ErrTooOld:
+			err = ErrWriteTooOld
+		default:
+			err = s.authorize(w)
+		}
+
+		w.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	//the signer must be able to pay the fee after the write is applied, this is
+	//checked first so a write is never applied without its fee
+	w.RLock()
+	bal, err := s.feeBalance(w)
+	w.RUnlock()
+	if err != nil {
+		return err
+	}
 
 	//commit to ssi db, or return conflict
 	//@TODO we lock the write here because in some conditions it is simultaneously
 	//being written (read) to the broadcast. This solution is rather in-elegant and
 	//we rather solve the root cause of that issue
+	//trusted writes were checked before, possibly before the watermark was raised
 	w.Lock()
-	err = s.db.Commit(w.TxData, dry)
+	if authorize || dry {
+		err = s.db.Commit(w.TxData, dry)
+	} else {
+		err = s.db.Replay(w.TxData)
+	}
+
 	w.Unlock()
 	if err == ssi.ErrConflict {
 		return ErrApplyConflict
 	}
 
+	if err == ssi.ErrTooOld {
+		return ErrWriteTooOld
+	}
+
 	if err != nil {
 		return fmt.Errorf("failed to commit: %v", err)
 	}
 
+	if dry {
+		return
+	}
+
+	//deduct the fee, it is credited to the proposer when the block is rewarded
+	if w.Fee > 0 {
+		tx := s.db.NewTx()
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, bal)
+		tx.Set(append(w.PK[:], []byte(balanceKey)...), v)
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit fee: %v", err)
+		}
+	}
+
 	//mark this write as part of the state
-	if !dry {
-		s.writes[w.Nonce] = struct{}{}
+	s.writes[w.Nonce] = struct{}{}
+	return
+}
+
+//feeBalance returns the balance the signer of a write has left after the
+//write was applied and its fee is paid
+func (s *State) feeBalance(w *Write) (bal uint64, err error) {
+	if w.Fee < 1 {
+		return 0, nil
+	}
+
+	balk := append(w.PK[:], []byte(balanceKey)...)
+	tx := s.db.NewTx()
+	v := tx.Get(balk)
+	if err = tx.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read balance: %v", err)
+	}
+
+	for _, wr := range w.WriteRows {
+		if bytes.Equal(wr.K, balk) {
+			v = wr.V //the write changes the balance itself
+		}
+	}
+
+	if len(v) >= 8 {
+		bal = binary.BigEndian.Uint64(v)
+	}
+
+	if bal < w.Fee {
+		return 0, ErrInsufficientFunds
+	}
+
+	return bal - w.Fee, nil
+}
+
+//reward credits the proposer of block 'b' with the block reward and the fees
+//of the block's writes, a share of which is credited to the treasury. It is
+//applied after the block's writes, the genesis block is not rewarded. The fees
+//were deducted from the writers so only the block reward is new currency, it
+//is the only currency that is created outside of the genesis.
+func (s *State) reward(b *Block) (err error) {
+	if b.Round < 1 {
+		return nil
+	}
+
+	total := BlockReward
+	for _, w := range b.Writes {
+		total += w.Fee
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.db.NewTx()
+	kv := &KV{tx}
+	treasury := total * TreasuryShare / 100
+	kv.CoinbaseTransfer(b.PK, total-treasury)
+	kv.CoinbaseTransfer(Treasury, treasury)
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit block reward: %v", err)
 	}
 
 	return
 }
 
-//View data from the state, any writes will be ignored
-func (s *State) View(f func(kv *KV)) {
-	f(&KV{s.db.NewTx()})
+//authorize checks the write's signature and makes sure it only writes in the
+//keyspace of its signer. System keys can only change as the KV helpers change
+//them and currency cannot be created, that only happens in the genesis and as
+//the block reward (see reward). Stake can only be deposited when the JoinFee is
+//paid to the treasury, as Join does.
+func (s *State) authorize(w *Write) (err error) {
+	if !w.VerifySignature() {
+		return ErrInvalidWriteSignature
+	}
+
+	//the current values, to compare the new values against, if they could not
+	//be read that is reported instead
+	tx := s.db.NewTx()
+	defer func() {
+		if terr := tx.Err(); terr != nil {
+			err = fmt.Errorf("failed to read state: %v", terr)
+		}
+	}()
+
+	deposits := w.StakeDeposits()
+
+	//the amount of currency (balance and stake) that is added and removed, the
+	//number of deposits and what was paid to the treasury for them
+	var add, rem, joins, paid uint64
+	for _, wr := range w.WriteRows {
+		owner, sysk := systemKey(wr.K)
+		switch {
+		case sysk == "" && !bytes.HasPrefix(wr.K, w.PK[:]):
+			return ErrUnauthorizedKey
+		case sysk == "":
+			continue //regular key in the signer's keyspace
+		case sysk != balanceKey && owner != w.PK:
+			return ErrUnauthorizedKey //only the balance of others can be written
+		}
+
+		curr := tx.Get(wr.K)
+		stake, _ := (&KV{tx}).ReadStake(owner)
+		_, leaving := (&KV{tx}).ReadLeave(owner)
+		amount, staking := deposits[owner]
+		switch sysk {
+		case balanceKey, stakeKey:
+			if len(wr.V) != 8 {
+				return ErrInvalidSystemKey
+			}
+
+		case tpkKey:
+			if stake > 0 || !staking || amount < 1 {
+				return ErrInvalidSystemKey //only committed when depositing
+			}
+
+			continue //not currency
+
+		case leaveKey:
+			switch {
+			case len(wr.V) == 8 && stake > 0 && !leaving: //leave
+			case len(wr.V) == 0 && leaving && staking && amount == 0: //release
+			default:
+				return ErrInvalidSystemKey
+			}
+
+			continue //not currency
+		}
+
+		var cv, nv uint64
+		if len(curr) >= 8 {
+			cv = binary.BigEndian.Uint64(curr)
+		}
+
+		nv = binary.BigEndian.Uint64(wr.V)
+		switch {
+		case sysk == balanceKey && nv < cv && owner != w.PK:
+			return ErrInvalidSystemKey //only the owner can spend its balance
+		case sysk == balanceKey && nv > cv && owner == Treasury:
+			paid += nv - cv
+		case sysk == stakeKey && cv == 0 && nv > 0 && w.CommitsTokenPK(owner): //deposit
+			joins++
+		case sysk == stakeKey && cv > 0 && nv == 0 && leaving: //release
+		case sysk == stakeKey:
+			return ErrInvalidSystemKey
+		}
+
+		if nv > cv {
+			if add+(nv-cv) < add {
+				return ErrCurrencyNotConserved
+			}
+
+			add += nv - cv
+		} else {
+			rem += cv - nv
+		}
+	}
+
+	if add != rem {
+		return ErrCurrencyNotConserved
+	}
+
+	if paid < joins*JoinFee {
+		return ErrJoinFeeNotPaid
+	}
+
+	return nil
 }
 
-//Update the state at the current height of the chain and return a write that
-//can be broadcasted to others to reach consensus on.
-func (s *State) Update(f func(kv *KV)) (w *Write) {
+//Evict raises the low-watermark of the state to its current time, this bounds
+//the memory needed for conflict detection. Writes that read from an earlier
+//state will fail to apply with ErrWriteTooOld and should be re-done.
+func (s *State) Evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Evict()
+}
+
+//Raise the low-watermark before the writes of a block in round 'round' are
+//applied. It is raised to the time after the newest block that is at least
+//WatermarkRounds before it, this only depends on the chain such that every
+//member rejects the same writes as too old.
+func (s *State) Raise(round uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := -1
+	for j, m := range s.marks {
+		if m.round+WatermarkRounds > round {
+			break
+		}
+
+		i = j
+	}
+
+	if i < 0 {
+		return
+	}
+
+	s.db.EvictTo(s.marks[i].time)
+	s.marks = s.marks[i+1:]
+}
+
+//mark remembers the time of the status oracle after the block of round 'round'
+//was applied, the low-watermark is raised to it later on
+func (s *State) mark(round uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	curr, _ := s.db.Time()
+	s.marks = append(s.marks, mark{round: round, time: curr})
+}
+
+//watermark returns the low-watermark and the times the low-watermark can still
+//be raised to, by round
+func (s *State) watermark() (low uint64, marks map[uint64]uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, low = s.db.Time()
+	marks = make(map[uint64]uint64, len(s.marks))
+	for _, m := range s.marks {
+		marks[m.round] = m.time
+	}
+
+	return
+}
+
+//restoreWatermark restores what was returned by watermark
+func (s *State) restoreWatermark(low uint64, marks map[uint64]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.db.EvictTo(low)
+	s.marks = s.marks[:0]
+	for round, time := range marks {
+		s.marks = append(s.marks, mark{round: round, time: time})
+	}
+
+	sort.Slice(s.marks, func(i, j int) bool { return s.marks[i].round < s.marks[j].round })
+}
+
+//Applied returns whether a write with the provided nonce was applied to the state
+func (s *State) Applied(n Nonce) (ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok = s.writes[n]
+	return
+}
+
+//View data from the state, any writes will be ignored. An error is returned if
+//the data could not be read, what 'f' read should not be used then.
+func (s *State) View(f func(kv *KV)) (err error) {
 	tx := s.db.NewTx()
 	f(&KV{tx})
+	if err = tx.Err(); err != nil {
+		return fmt.Errorf("failed to read state: %v", err)
+	}
+
+	return
+}
+
+//Update the state at the current height of the chain and return a write that
+//can be broadcasted to others to reach consensus on. If 'f' returns an error
+//the transaction is discarded and the error is returned.
+func (s *State) Update(f func(kv *KV) error) (w *Write, err error) {
+	tx := s.db.NewTx()
+	err = f(&KV{tx})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+
 	w = &Write{TxData: tx.Data()}
 	if len(w.TxData.WriteRows) < 1 {
-		return nil //no write rows means an empty op, make it nil
+		return nil, nil //no write rows means an empty op, make it nil
 	}
 
 	return
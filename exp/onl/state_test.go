@@ -1,6 +1,9 @@
 package onl_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/advanderveer/27067dd17/onl"
@@ -14,9 +17,11 @@ func TestBasicStateHandling(t *testing.T) {
 	//nil writes to apply should be no-op
 	test.Ok(t, s1.Apply(nil, false))
 
-	w1 := s1.Update(func(kv *onl.KV) {
+	w1, err := s1.Update(func(kv *onl.KV) error {
 		kv.Set([]byte{0x01}, []byte{0x02})
+		return nil
 	})
+	test.Ok(t, err)
 
 	s2, err := onl.NewState([][]*onl.Write{{w1}})
 	test.Ok(t, err)
@@ -28,12 +33,225 @@ func TestBasicStateHandling(t *testing.T) {
 	})
 
 	//create a write that reads from the key writtine by 'w1', should conflict
-	w2 := s1.Update(func(kv *onl.KV) {
+	w2, err := s1.Update(func(kv *onl.KV) error {
 		kv.Set([]byte{0x02}, kv.Get([]byte{0x01}))
+		return nil
 	})
+	test.Ok(t, err)
 
 	test.Ok(t, w2.GenerateNonce())
 	_, err = onl.NewState([][]*onl.Write{{w1, w2}})
 	test.Equals(t, onl.ErrApplyConflict, err) //yep, conflicts
 
 }
+
+func TestStateCloning(t *testing.T) {
+	s1, err := onl.NewState(nil)
+	test.Ok(t, err)
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk := idn1.PK()
+	w1, err := s1.Update(func(kv *onl.KV) error {
+		kv.Set(append(pk[:], 0x01), []byte{0x02})
+		return nil
+	})
+	test.Ok(t, err)
+
+	w1.PK = idn1.PK()
+	idn1.SignWrite(w1)
+	test.Ok(t, s1.Apply(w1, false))
+
+	s2 := s1.Clone()
+	test.Equals(t, onl.ErrAlreadyApplied, s2.Apply(w1, false))
+
+	w2, err := s2.Update(func(kv *onl.KV) error {
+		kv.Set(append(pk[:], 0x02), []byte{0x03})
+		return nil
+	})
+	test.Ok(t, err)
+
+	w2.PK = idn1.PK()
+	test.Ok(t, w2.GenerateNonce())
+	idn1.SignWrite(w2)
+	test.Ok(t, s2.Apply(w2, false))
+
+	//the original state should not see writes applied to the clone
+	s1.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x02}, kv.Get(append(pk[:], 0x01)))
+		test.Equals(t, []byte(nil), kv.Get(append(pk[:], 0x02)))
+	})
+
+	s2.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x03}, kv.Get(append(pk[:], 0x02)))
+	})
+}
+
+func TestStateAuthorization(t *testing.T) {
+	idn1 := onl.NewIdentity([]byte{0x01})
+	idn2 := onl.NewIdentity([]byte{0x02})
+	pk1, pk2 := idn1.PK(), idn2.PK()
+
+	gs, err := onl.NewState(nil)
+	test.Ok(t, err)
+	gw, err := gs.Update(func(kv *onl.KV) error {
+		kv.CoinbaseTransfer(pk1, 10)
+		kv.CoinbaseTransfer(pk2, 10)
+		return kv.DepositStake(pk2, 1, idn2.TokenPK())
+	})
+	test.Ok(t, err)
+
+	s1, err := onl.NewState([][]*onl.Write{{gw}})
+	test.Ok(t, err)
+
+	apply := func(idn *onl.Identity, f func(kv *onl.KV) error) error {
+		w, err := s1.Update(f)
+		test.Ok(t, err)
+		w.PK = idn.PK()
+		test.Ok(t, w.GenerateNonce())
+		idn.SignWrite(w)
+		return s1.Clone().Apply(w, false)
+	}
+
+	t.Run("unsigned write", func(t *testing.T) {
+		w, err := s1.Update(func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x01), []byte{0x01}); return nil })
+		test.Ok(t, err)
+		w.PK = pk1
+		test.Ok(t, w.GenerateNonce())
+		test.Equals(t, onl.ErrInvalidWriteSignature, s1.Apply(w, false))
+	})
+
+	t.Run("keyspaces", func(t *testing.T) {
+		test.Ok(t, apply(idn1, func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x01), []byte{0x01}); return nil }))
+		test.Equals(t, onl.ErrUnauthorizedKey, apply(idn1, func(kv *onl.KV) error { kv.Set(append(pk2[:], 0x01), []byte{0x01}); return nil }))
+		test.Equals(t, onl.ErrUnauthorizedKey, apply(idn1, func(kv *onl.KV) error { kv.Set([]byte{0x01}, []byte{0x01}); return nil }))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		test.Equals(t, onl.ErrValueTooLong, apply(idn1, func(kv *onl.KV) error {
+			kv.Set(append(pk1[:], 0x01), make([]byte, onl.MaxValueLen+1))
+			return nil
+		}))
+	})
+
+	t.Run("currency", func(t *testing.T) {
+		test.Ok(t, apply(idn1, func(kv *onl.KV) error { return kv.TransferCurrency(pk1, pk2, 5) }))
+		test.Ok(t, apply(idn1, func(kv *onl.KV) error { return kv.Join(pk1, 5, idn1.TokenPK()) }))
+		test.Equals(t, onl.ErrJoinFeeNotPaid, apply(idn1, func(kv *onl.KV) error { return kv.DepositStake(pk1, 5, idn1.TokenPK()) }))
+		test.Equals(t, onl.ErrCurrencyNotConserved, apply(idn1, func(kv *onl.KV) error { kv.CoinbaseTransfer(pk1, 5); return nil }))
+		test.Equals(t, onl.ErrCurrencyNotConserved, apply(idn1, func(kv *onl.KV) error { kv.CoinbaseTransfer(pk2, 5); return nil }))
+		test.Equals(t, onl.ErrInvalidSystemKey, apply(idn1, func(kv *onl.KV) error { return kv.TransferCurrency(pk2, pk1, 5) }))
+	})
+
+	t.Run("system keys", func(t *testing.T) {
+		test.Equals(t, onl.ErrInvalidSystemKey, apply(idn1, func(kv *onl.KV) error {
+			kv.Set(append(pk1[:], []byte("_balance")...), []byte{0x01})
+			return nil
+		}))
+
+		test.Equals(t, onl.ErrInvalidSystemKey, apply(idn2, func(kv *onl.KV) error {
+			kv.Set(append(pk2[:], []byte("_tpk")...), idn1.TokenPK())
+			return nil
+		}))
+
+		test.Equals(t, onl.ErrInvalidSystemKey, apply(idn2, func(kv *onl.KV) error {
+			kv.Set(append(pk2[:], []byte("_stake")...), make([]byte, 8))
+			return nil
+		}))
+
+		test.Ok(t, apply(idn2, func(kv *onl.KV) error { return kv.Leave(pk2, 1) }))
+	})
+
+	t.Run("fees", func(t *testing.T) {
+		s2 := s1.Clone()
+		pay := func(fee uint64, f func(kv *onl.KV) error) error {
+			w, err := s2.Update(f)
+			test.Ok(t, err)
+			w.PK, w.Fee = pk1, fee
+			test.Ok(t, w.GenerateNonce())
+			idn1.SignWrite(w)
+			return s2.Apply(w, false)
+		}
+
+		set := func(kv *onl.KV) error { kv.Set(append(pk1[:], 0x01), []byte{0x01}); return nil }
+		test.Ok(t, pay(3, set))
+		test.Equals(t, onl.ErrInsufficientFunds, pay(8, set))
+
+		//the fee is paid from what is left after the write
+		test.Equals(t, onl.ErrInsufficientFunds, pay(3, func(kv *onl.KV) error { return kv.TransferCurrency(pk1, pk2, 5) }))
+		s2.View(func(kv *onl.KV) {
+			test.Equals(t, uint64(7), kv.AccountBalance(pk1))
+			test.Equals(t, uint64(9), kv.AccountBalance(pk2))
+		})
+	})
+}
+
+func TestStateEviction(t *testing.T) {
+	s1, err := onl.NewState(nil)
+	test.Ok(t, err)
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk := idn1.PK()
+	sign := func(w *onl.Write) *onl.Write {
+		w.PK = pk
+		test.Ok(t, w.GenerateNonce())
+		idn1.SignWrite(w)
+		return w
+	}
+
+	w1, err := s1.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], 0x01), []byte{0x01}); return nil })
+	test.Ok(t, err)
+	w2, err := s1.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], 0x02), []byte{0x02}); return nil })
+	test.Ok(t, err)
+
+	test.Ok(t, s1.Apply(sign(w1), false))
+	s1.Evict()
+
+	//the second write read from before the watermark
+	test.Equals(t, onl.ErrWriteTooOld, s1.Apply(sign(w2), false))
+
+	//clones keep the watermark
+	test.Equals(t, onl.ErrWriteTooOld, s1.Clone().Apply(w2, true))
+}
+
+func TestStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onl_")
+	test.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s1, err := onl.OpenState(dir)
+	test.Ok(t, err)
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	pk := idn1.PK()
+	w1, err := s1.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], 0x01), []byte{0x01}); return nil })
+	test.Ok(t, err)
+	w2, err := s1.Update(func(kv *onl.KV) error { kv.Set(append(pk[:], 0x02), []byte{0x02}); return nil })
+	test.Ok(t, err)
+
+	w1.PK = pk
+	test.Ok(t, w1.GenerateNonce())
+	idn1.SignWrite(w1)
+	test.Ok(t, s1.Apply(w1, false))
+	s1.Evict()
+	test.Ok(t, s1.Close())
+
+	//data, nonces and the watermark survive re-opening
+	s2, err := onl.OpenState(dir)
+	test.Ok(t, err)
+	test.Ok(t, s2.View(func(kv *onl.KV) {
+		test.Equals(t, []byte{0x01}, kv.Get(append(pk[:], 0x01)))
+	}))
+
+	test.Equals(t, onl.ErrAlreadyApplied, s2.Apply(w1, false))
+	w2.PK = pk
+	test.Ok(t, w2.GenerateNonce())
+	idn1.SignWrite(w2)
+	test.Equals(t, onl.ErrWriteTooOld, s2.Apply(w2, false))
+	test.Ok(t, s2.Close())
+
+	t.Run("not closed", func(t *testing.T) {
+		test.Ok(t, os.Remove(filepath.Join(dir, "state")))
+		_, err := onl.OpenState(dir)
+		test.Equals(t, onl.ErrStateNotClosed, err)
+	})
+}
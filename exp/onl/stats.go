@@ -0,0 +1,85 @@
+package onl
+
+import (
+	"sync"
+	"time"
+)
+
+//rejections maps the errors that blocks are rejected with to the reason they
+//are counted by, other errors are counted as "other"
+var rejections = map[error]string{
+	ErrInvalidSignature:      "signature",
+	ErrInvalidWriteSignature: "signature",
+	ErrInvalidToken:          "token",
+	ErrNoTokenPK:             "token",
+	ErrTokenPKNotStable:      "token",
+	ErrZeroRank:              "token",
+	ErrZeroRound:             "order",
+	ErrTimestampNotAfterPrev: "order",
+	ErrRoundNrNotAfterPrev:   "order",
+	ErrBlockNotExist:         "unknown",
+	ErrStableNotInChain:      "unknown",
+	ErrBlockTooLarge:         "size",
+	ErrMemberLeft:            "member",
+	ErrWriteExpired:          "writes",
+	ErrWriteTooOld:           "writes",
+	ErrApplyConflict:         "writes",
+	ErrInsufficientFunds:     "writes",
+	ErrAppendConflict:        "conflict",
+	ErrStateReconstruction:   "state",
+}
+
+//ChainStats holds statistics about the blocks that were appended to the chain
+type ChainStats struct {
+	Appended      uint64            //blocks that were appended
+	Rejected      map[string]uint64 //blocks that were rejected, by reason
+	AppendSeconds float64           //time spent appending blocks, including rejected ones
+}
+
+//chainStats collects the chain statistics
+type chainStats struct {
+	ChainStats
+	mu sync.Mutex
+}
+
+func newChainStats() *chainStats {
+	return &chainStats{ChainStats: ChainStats{Rejected: make(map[string]uint64)}}
+}
+
+//append records the outcome of appending a block, blocks that we have already
+//are not counted as they are received from every peer
+func (s *chainStats) append(err error, took time.Duration) {
+	if err == ErrBlockExist {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.AppendSeconds += took.Seconds()
+	if err == nil {
+		s.Appended++
+		return
+	}
+
+	reason, ok := rejections[err]
+	if !ok {
+		reason = "other"
+	}
+
+	s.Rejected[reason]++
+}
+
+//Stats returns statistics about the blocks appended to the chain
+func (c *Chain) Stats() (s ChainStats) {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	s = c.stats.ChainStats
+	s.Rejected = make(map[string]uint64, len(c.stats.Rejected))
+	for label, n := range c.stats.Rejected {
+		s.Rejected[label] = n
+	}
+
+	return
+}
@@ -3,13 +3,14 @@ package onl
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"math/big"
 	"os"
+	"sort"
 
+	"github.com/advanderveer/27067dd17/onl/enc"
 	"github.com/dgraph-io/badger"
 )
 
@@ -24,9 +25,13 @@ type Tx interface {
 	ReadTip() (tip ID, tipw uint64, err error)
 	WriteTip(tip ID, tipw uint64) (err error)
 
+	ReadWeight(id ID) (w uint64, err error)
+	WriteWeight(id ID, w uint64) (err error)
+
 	Write(b *Block, stk *Stakes, rank *big.Int) (err error)
 	Read(id ID) (b *Block, stk *Stakes, rank *big.Int, err error)
 	Round(nr uint64, f func(id ID, b *Block, stk *Stakes, rank *big.Int) error) (err error)
+	Delete(id ID) (err error)
 	MaxRound() (nr uint64)
 	MinRound() (nr uint64)
 
@@ -79,6 +84,38 @@ func (tx *BadgerTx) WriteTip(tip ID, tipw uint64) (err error) {
 	return
 }
 
+//ReadWeight reads the sum weight of the block with the provided id
+func (tx *BadgerTx) ReadWeight(id ID) (w uint64, err error) {
+	it, err := tx.btx.Get(weightKey(id))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return 0, ErrNotWeighted
+		}
+
+		return 0, fmt.Errorf("failed to read weight key: %v", err)
+	}
+
+	val, err := it.Value()
+	if err != nil {
+		return 0, fmt.Errorf("unable to read weight value: %v", err)
+	}
+
+	return binary.BigEndian.Uint64(val), nil
+}
+
+//WriteWeight persists the sum weight of the block with the provided id
+func (tx *BadgerTx) WriteWeight(id ID, w uint64) (err error) {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, w)
+
+	err = tx.btx.Set(weightKey(id), val)
+	if err != nil {
+		return fmt.Errorf("failed to set weight key: %v", err)
+	}
+
+	return
+}
+
 //MinRound returns the minimum round stored in the chain
 func (tx *BadgerTx) MinRound() (nr uint64) {
 	opt := badger.DefaultIteratorOptions
@@ -154,16 +191,12 @@ func (tx *BadgerTx) Round(nr uint64, f func(id ID, b *Block, stk *Stakes, rank *
 
 //Write block info and replace any existing info
 func (tx *BadgerTx) Write(b *Block, stk *Stakes, rank *big.Int) (err error) {
-	buf := bytes.NewBuffer(nil)
-	if err = gob.NewEncoder(buf).Encode(&struct {
-		*Block
-		*Stakes
-		Rank *big.Int
-	}{b, stk, rank}); err != nil {
-		return fmt.Errorf("failed to encode block data: %v", err)
+	d, err := encode(b, stk, rank)
+	if err != nil {
+		return err
 	}
 
-	err = tx.btx.Set(id2key(b.Hash()), buf.Bytes())
+	err = tx.btx.Set(id2key(b.Hash()), d)
 	if err != nil {
 		return fmt.Errorf("failed to set key data: %v", err)
 	}
@@ -171,32 +204,106 @@ func (tx *BadgerTx) Write(b *Block, stk *Stakes, rank *big.Int) (err error) {
 	return
 }
 
-func decode(d []byte) (b *Block, stk *Stakes, rank *big.Int, err error) {
-	bb := &struct {
-		*Block
-		*Stakes
-		Rank *big.Int
-	}{}
+const recordVersion = 2
 
-	err = gob.NewDecoder(bytes.NewReader(d)).Decode(bb)
+//encode the block with the stakes and rank as observed by this member
+func encode(b *Block, stk *Stakes, rank *big.Int) (d []byte, err error) {
+	bd, err := b.MarshalBinary()
 	if err != nil {
+		return nil, fmt.Errorf("failed to encode block data: %v", err)
+	}
+
+	if stk == nil {
+		stk = NewStakes(0)
+	}
+
+	if rank == nil {
+		rank = big.NewInt(0)
+	}
+
+	pks := make([]PK, 0, len(stk.Votes))
+	for pk := range stk.Votes {
+		pks = append(pks, pk)
+	}
+
+	sort.Slice(pks, func(i, j int) bool {
+		return bytes.Compare(pks[i][:], pks[j][:]) < 0
+	})
+
+	e := enc.NewWriter(recordVersion)
+	e.Bytes(bd)
+	e.Uint64(stk.Sum)
+	e.Len(len(pks))
+	for _, pk := range pks {
+		e.Fixed(pk[:])
+		e.Uint64(stk.Votes[pk])
+	}
+
+	e.Bytes(rank.Bytes())
+
+	rounds := make([]uint64, 0, len(stk.Leaving))
+	for round := range stk.Leaving {
+		rounds = append(rounds, round)
+	}
+
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	e.Len(len(rounds))
+	for _, round := range rounds {
+		e.Uint64(round)
+		e.Uint64(stk.Leaving[round])
+	}
+
+	return e.Data(), nil
+}
+
+//decode a record, records written by the first release are gob encoded
+func decode(d []byte) (b *Block, stk *Stakes, rank *big.Int, err error) {
+	if len(d) > 0 && d[0] != recordVersion {
+		return decodeLegacy(d)
+	}
+
+	r, _ := enc.NewReader(d, recordVersion)
+	bd := r.Bytes()
+	stk = NewStakes(r.Uint64())
+
+	n := r.Len()
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var pk PK
+		r.Fixed(pk[:])
+		stk.Votes[pk] = r.Uint64()
+	}
+
+	rank = new(big.Int).SetBytes(r.Bytes())
+	n = r.Len()
+	for i := 0; i < n && r.Err() == nil; i++ {
+		round := r.Uint64()
+		stk.Leaving[round] = r.Uint64()
+	}
+
+	if err = r.Done(); err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to decode block data: %v", err)
 	}
 
-	if bb.Stakes == nil {
-		bb.Stakes = NewStakes(0)
+	b = &Block{}
+	if err = b.UnmarshalBinary(bd); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode block data: %v", err)
 	}
 
-	return bb.Block, bb.Stakes, bb.Rank, nil
+	return b, stk, rank, nil
 }
 
 const blockBucket = "b/"
 const metaBucket = "m/"
+const weightBucket = "w/"
 
 func tipKey() []byte {
 	return append([]byte(metaBucket), []byte("tip")...)
 }
 
+func weightKey(id ID) []byte {
+	return append([]byte(weightBucket), id.Bytes()...)
+}
+
 func roundPrefix(nr uint64) (prefix []byte) {
 	prefix = make([]byte, 8)
 	binary.BigEndian.PutUint64(prefix, math.MaxUint64-nr)
@@ -233,11 +340,34 @@ func (tx *BadgerTx) Read(id ID) (b *Block, stk *Stakes, rank *big.Int, err error
 	return decode(d)
 }
 
+//Delete a block and its weight from the store
+func (tx *BadgerTx) Delete(id ID) (err error) {
+	err = tx.btx.Delete(id2key(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete block key: %v", err)
+	}
+
+	err = tx.btx.Delete(weightKey(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete weight key: %v", err)
+	}
+
+	return
+}
+
 //Discard any tx resources
 func (tx *BadgerTx) Discard() { tx.btx.Discard() }
 
-//Commit the transaction
-func (tx *BadgerTx) Commit() (err error) { return tx.btx.Commit(nil) }
+//Commit the transaction, returns ErrTxConflict if a concurrent transaction
+//modified data that was read by this transaction
+func (tx *BadgerTx) Commit() (err error) {
+	err = tx.btx.Commit(nil)
+	if err == badger.ErrConflict {
+		return ErrTxConflict
+	}
+
+	return
+}
 
 //TempBadgerStore will return a temporary store that will be fully cleaned up when
 //the 'clean' func is called. The database is not closed prior to removal and it
@@ -1,81 +1,88 @@
 package onl_test
 
 import (
-	"errors"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/27067dd17/onl/storetest"
 	"github.com/advanderveer/go-test"
 )
 
 var _ onl.Store = &onl.BadgerStore{}
+var _ onl.Store = &onl.BoltStore{}
 
-func TestBadgerReadWriteStore(t *testing.T) {
-	s, clean := onl.TempBadgerStore()
-	defer clean()
-
-	idn1 := onl.NewIdentity([]byte{0x01})
-	b1 := idn1.Mint(1, bid1, bid2, 1)
-	b2 := idn1.Mint(2, b1.Hash(), b1.Hash(), 2)
+func TestBadgerStore(t *testing.T) {
+	storetest.Run(t, func() (onl.Store, func()) { return onl.TempBadgerStore() })
+}
 
-	tx := s.CreateTx(true)
-	defer tx.Discard()
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, func() (onl.Store, func()) { return onl.TempBoltStore() })
+}
 
-	t.Run("tip should be zero values", func(t *testing.T) {
-		tip1, tipw1, err := tx.ReadTip()
-		test.Ok(t, err)
-		test.Equals(t, onl.NilID, tip1)
-		test.Equals(t, uint64(0), tipw1)
+//baselineStore opens a copy of a store that was written by the first release,
+//which stored gob encoded records and no weights
+func baselineStore(t *testing.T) (store *onl.BadgerStore, clean func()) {
+	dir, err := ioutil.TempDir("", "onl_")
+	test.Ok(t, err)
 
-		test.Ok(t, tx.WriteTip(bid1, 100))
-		tip2, tipw2, err := tx.ReadTip()
+	fis, err := ioutil.ReadDir(filepath.Join("testdata", "baseline"))
+	test.Ok(t, err)
+	for _, fi := range fis {
+		d, err := ioutil.ReadFile(filepath.Join("testdata", "baseline", fi.Name()))
 		test.Ok(t, err)
+		test.Ok(t, ioutil.WriteFile(filepath.Join(dir, fi.Name()), d, 0644))
+	}
 
-		test.Equals(t, bid1, tip2)
-		test.Equals(t, uint64(100), tipw2)
-	})
-
-	test.Equals(t, uint64(0), tx.MinRound())
-	test.Equals(t, uint64(0), tx.MaxRound())
-
-	test.Ok(t, tx.Write(b2, nil, big.NewInt(2)))
-	test.Ok(t, tx.Write(b1, nil, big.NewInt(1)))
-	test.Ok(t, tx.Commit())
-
-	tx = s.CreateTx(false)
-	defer tx.Discard()
-
-	test.Equals(t, uint64(1), tx.MinRound())
-	test.Equals(t, uint64(2), tx.MaxRound())
-
-	b2, _, rank1, err := tx.Read(b1.Hash())
+	store, err = onl.NewBadgerStore(dir)
 	test.Ok(t, err)
-	test.Equals(t, b1, b2)
-	test.Equals(t, "1", rank1.String())
-	test.Ok(t, tx.Commit())
-
-	t.Run("test block not exist", func(t *testing.T) {
-		tx = s.CreateTx(false)
-		defer tx.Discard()
-		_, _, _, err = tx.Read(bid1)
-		test.Equals(t, onl.ErrBlockNotExist, err)
-	})
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
 
-	t.Run("test round reading", func(t *testing.T) {
-		tx = s.CreateTx(false)
-		defer tx.Discard()
+func TestBaselineStore(t *testing.T) {
+	store, clean := baselineStore(t)
+	defer clean()
 
-		test.Ok(t, tx.Round(1, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
-			test.Equals(t, b2.Hash(), id)
-			test.Equals(t, b2, b)
+	idn := onl.NewIdentity([]byte{0x01})
+	chain, gen, err := onl.NewChain(store, 0)
+	test.Ok(t, err)
+	test.Equals(t, gen, chain.Genesis().Hash())
+
+	//blocks and writes keep the identifier they were signed with
+	walk := func() (n int) {
+		test.Ok(t, chain.Walk(chain.Tip(), func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+			test.Equals(t, id, b.Hash())
+			//the first release set the commit time of writes after they were
+			//signed, only blocks without writes can still be verified
+			if b.Round > 0 && len(b.Writes) < 1 {
+				test.Equals(t, true, b.VerifySignature())
+			}
+
+			n++
 			return nil
 		}))
 
-		err1 := errors.New("foo")
-		test.Equals(t, err1, tx.Round(1, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
-			return err1
-		}))
-	})
+		return
+	}
 
+	test.Equals(t, 3, walk())
+	test.Ok(t, chain.View(func(kv *onl.KV) {
+		pk := idn.PK()
+		test.Equals(t, []byte{0x02}, kv.Get(append(pk[:], 0x01)))
+	}))
+
+	//new blocks can be appended, the votes rewrite the baseline records
+	b1, _, _, err := chain.Read(chain.Tip())
+	test.Ok(t, err)
+	b3 := idn.Mint(3, b1.Hash(), gen, 3)
+	idn.Sign(b3)
+	test.Ok(t, chain.Append(b3))
+	test.Equals(t, b3.Hash(), chain.Tip())
+	test.Equals(t, 4, walk())
 }
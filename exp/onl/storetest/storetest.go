@@ -0,0 +1,277 @@
+// Package storetest provides a conformance suite that any onl.Store
+// implementation should pass.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/advanderveer/27067dd17/onl"
+	"github.com/advanderveer/go-test"
+)
+
+//Run the conformance suite, 'newStore' is called for each test to create a new
+//empty store and a function that cleans it up again.
+func Run(t *testing.T, newStore func() (s onl.Store, clean func())) {
+	t.Run("read write", func(t *testing.T) { testReadWrite(t, newStore) })
+	t.Run("round order", func(t *testing.T) { testRoundOrder(t, newStore) })
+	t.Run("discard", func(t *testing.T) { testDiscard(t, newStore) })
+	t.Run("conflict", func(t *testing.T) { testConflict(t, newStore) })
+}
+
+func testReadWrite(t *testing.T, newStore func() (s onl.Store, clean func())) {
+	s, clean := newStore()
+	defer clean()
+
+	bid1 := onl.ID{}
+	bid2 := onl.ID{0x01}
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	b1 := idn1.Mint(1, bid1, bid2, 1)
+	b2 := idn1.Mint(2, b1.Hash(), b1.Hash(), 2)
+
+	tx := s.CreateTx(true)
+	defer tx.Discard()
+
+	t.Run("tip should be zero values", func(t *testing.T) {
+		tip1, tipw1, err := tx.ReadTip()
+		test.Ok(t, err)
+		test.Equals(t, onl.NilID, tip1)
+		test.Equals(t, uint64(0), tipw1)
+
+		test.Ok(t, tx.WriteTip(bid1, 100))
+		tip2, tipw2, err := tx.ReadTip()
+		test.Ok(t, err)
+
+		test.Equals(t, bid1, tip2)
+		test.Equals(t, uint64(100), tipw2)
+	})
+
+	t.Run("weights should be stored per block", func(t *testing.T) {
+		_, err := tx.ReadWeight(bid1)
+		test.Equals(t, onl.ErrNotWeighted, err)
+
+		test.Ok(t, tx.WriteWeight(bid1, 100))
+		test.OkEquals(t, uint64(100))(tx.ReadWeight(bid1))
+
+		_, err = tx.ReadWeight(bid2)
+		test.Equals(t, onl.ErrNotWeighted, err)
+	})
+
+	test.Equals(t, uint64(0), tx.MinRound())
+	test.Equals(t, uint64(0), tx.MaxRound())
+
+	stk := onl.NewStakes(2)
+	stk.Votes[idn1.PK()] = 1
+	stk.Leaving[5] = 1
+	test.Ok(t, tx.Write(b2, stk, big.NewInt(2)))
+	test.Ok(t, tx.Write(b1, nil, big.NewInt(1)))
+	test.Ok(t, tx.Commit())
+
+	tx = s.CreateTx(false)
+	defer tx.Discard()
+
+	test.Equals(t, uint64(1), tx.MinRound())
+	test.Equals(t, uint64(2), tx.MaxRound())
+
+	tip, tipw, err := tx.ReadTip()
+	test.Ok(t, err)
+	test.Equals(t, bid1, tip)
+	test.Equals(t, uint64(100), tipw)
+
+	b3, stk1, rank1, err := tx.Read(b1.Hash())
+	test.Ok(t, err)
+	test.Equals(t, b1, b3)
+	test.Equals(t, uint64(0), stk1.Sum)
+	test.Equals(t, "1", rank1.String())
+
+	_, stk2, _, err := tx.Read(b2.Hash())
+	test.Ok(t, err)
+	test.Equals(t, stk, stk2)
+	test.Ok(t, tx.Commit())
+
+	t.Run("test block not exist", func(t *testing.T) {
+		tx := s.CreateTx(false)
+		defer tx.Discard()
+		_, _, _, err := tx.Read(bid1)
+		test.Equals(t, onl.ErrBlockNotExist, err)
+	})
+
+	t.Run("test round reading", func(t *testing.T) {
+		tx := s.CreateTx(false)
+		defer tx.Discard()
+
+		var n int
+		test.Ok(t, tx.Round(1, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+			test.Equals(t, b1.Hash(), id)
+			test.Equals(t, b1, b)
+			n++
+			return nil
+		}))
+		test.Equals(t, 1, n)
+
+		err1 := errors.New("foo")
+		test.Equals(t, err1, tx.Round(1, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+			return err1
+		}))
+
+		test.Ok(t, tx.Round(3, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+			t.Fatal("round 3 should have no blocks")
+			return nil
+		}))
+	})
+
+	t.Run("test deleting", func(t *testing.T) {
+		tx := s.CreateTx(true)
+		defer tx.Discard()
+
+		test.Ok(t, tx.WriteWeight(b1.Hash(), 1))
+		test.Ok(t, tx.Delete(b1.Hash()))
+		test.Ok(t, tx.Commit())
+
+		tx = s.CreateTx(false)
+		defer tx.Discard()
+		_, _, _, err := tx.Read(b1.Hash())
+		test.Equals(t, onl.ErrBlockNotExist, err)
+		_, err = tx.ReadWeight(b1.Hash())
+		test.Equals(t, onl.ErrNotWeighted, err)
+		test.Equals(t, uint64(2), tx.MinRound())
+		test.Equals(t, uint64(2), tx.MaxRound())
+	})
+}
+
+func testRoundOrder(t *testing.T, newStore func() (s onl.Store, clean func())) {
+	s, clean := newStore()
+	defer clean()
+
+	tx := s.CreateTx(true)
+	defer tx.Discard()
+
+	//a couple of blocks in round 2, surrounded by other rounds
+	var ids []onl.ID
+	for i := byte(1); i < 6; i++ {
+		idn := onl.NewIdentity([]byte{i})
+		for r := uint64(1); r < 4; r++ {
+			b := idn.Mint(r, onl.NilID, onl.NilID, r)
+			test.Ok(t, tx.Write(b, nil, big.NewInt(1)))
+			if r == 2 {
+				ids = append(ids, b.Hash())
+			}
+		}
+	}
+
+	test.Ok(t, tx.Commit())
+
+	tx = s.CreateTx(false)
+	defer tx.Discard()
+
+	var read []onl.ID
+	test.Ok(t, tx.Round(2, func(id onl.ID, b *onl.Block, stk *onl.Stakes, rank *big.Int) error {
+		test.Equals(t, uint64(2), b.Round)
+		read = append(read, id)
+		return nil
+	}))
+
+	test.Equals(t, len(ids), len(read))
+	for i := 1; i < len(read); i++ {
+		test.Assert(t, bytes.Compare(read[i-1][:], read[i][:]) < 0, "round should be read in lexicographic order of the id")
+	}
+
+	test.Equals(t, uint64(1), tx.MinRound())
+	test.Equals(t, uint64(3), tx.MaxRound())
+}
+
+func testDiscard(t *testing.T, newStore func() (s onl.Store, clean func())) {
+	s, clean := newStore()
+	defer clean()
+
+	idn1 := onl.NewIdentity([]byte{0x01})
+	b1 := idn1.Mint(1, onl.NilID, onl.NilID, 1)
+
+	//writes of a discarded transaction should not be visible
+	tx := s.CreateTx(true)
+	test.Ok(t, tx.WriteTip(b1.Hash(), 1))
+	test.Ok(t, tx.WriteWeight(b1.Hash(), 1))
+	test.Ok(t, tx.Write(b1, nil, big.NewInt(1)))
+	tx.Discard()
+
+	tx = s.CreateTx(false)
+	tip, _, err := tx.ReadTip()
+	test.Ok(t, err)
+	test.Equals(t, onl.NilID, tip)
+	_, err = tx.ReadWeight(b1.Hash())
+	test.Equals(t, onl.ErrNotWeighted, err)
+	_, _, _, err = tx.Read(b1.Hash())
+	test.Equals(t, onl.ErrBlockNotExist, err)
+	test.Equals(t, uint64(0), tx.MaxRound())
+
+	//committing a read-only transaction is allowed
+	test.Ok(t, tx.Commit())
+	tx.Discard()
+
+	//discarding after a commit should be a no-op
+	tx = s.CreateTx(true)
+	test.Ok(t, tx.Write(b1, nil, big.NewInt(1)))
+	test.Ok(t, tx.Commit())
+	tx.Discard()
+
+	tx = s.CreateTx(false)
+	defer tx.Discard()
+	_, _, _, err = tx.Read(b1.Hash())
+	test.Ok(t, err)
+}
+
+func testConflict(t *testing.T, newStore func() (s onl.Store, clean func())) {
+	s, clean := newStore()
+	defer clean()
+
+	//concurrent read-modify-write cycles on the tip should never lose an
+	//update: either the store serializes them or the commit fails with
+	//ErrTxConflict and the cycle is retried
+	n := 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				tx := s.CreateTx(true)
+				tip, tipw, err := tx.ReadTip()
+				if err != nil {
+					tx.Discard()
+					t.Error(err)
+					return
+				}
+
+				if err = tx.WriteTip(tip, tipw+1); err != nil {
+					tx.Discard()
+					t.Error(err)
+					return
+				}
+
+				err = tx.Commit()
+				tx.Discard()
+				if err == onl.ErrTxConflict {
+					continue
+				}
+
+				if err != nil {
+					t.Error(err)
+				}
+
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	tx := s.CreateTx(false)
+	defer tx.Discard()
+	_, tipw, err := tx.ReadTip()
+	test.Ok(t, err)
+	test.Equals(t, uint64(n), tipw)
+}
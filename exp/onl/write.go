@@ -5,13 +5,28 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
-	"sort"
 	"sync"
 
+	"github.com/advanderveer/27067dd17/onl/enc"
 	"github.com/advanderveer/27067dd17/onl/ssi"
 	"github.com/advanderveer/27067dd17/vrf/ed25519"
 )
 
+const (
+	// MaxKeyLen is the maximum length of a key that a write reads or writes, it
+	// also applies to the start and end of the ranges it scanned
+	MaxKeyLen = 256
+
+	// MaxValueLen is the maximum length of a value that a write writes
+	MaxValueLen = 64 * 1024
+
+	// MaxReadRows is the maximum number of rows and ranges a write reads
+	MaxReadRows = 1024
+
+	// MaxWriteRows is the maximum number of rows a write writes
+	MaxWriteRows = 256
+)
+
 //WID uniquely identifies a write
 type WID [sha256.Size]byte
 
@@ -34,12 +49,24 @@ type Write struct {
 	//it (either in the current mempool or in the chain) the write will not be accepted.
 	Nonce Nonce
 
+	//ValidUntil is the last round in which the write can be included in a block,
+	//after that it is definitely not going to make it into the chain. Zero
+	//means that the write is valid indefinitely.
+	ValidUntil uint64
+
+	//Fee is the amount of currency that the signer pays to the proposer of the
+	//block that includes the write, it is deducted from the signer's balance
+	Fee uint64
+
 	//Signature of the block, signed by the identity of PK such that it can be verified
 	//that the block has not been tampered with
 	Signature [ed25519.SignatureSize]byte
 
 	//@TODO we rather get rid of the lock
 	mu sync.RWMutex
+
+	//legacy is set for writes of the first release, see legacy.go
+	legacy bool
 }
 
 //Lock the write
@@ -71,7 +98,7 @@ func (w *Write) StakeDeposits() (deposits map[PK]uint64) {
 			continue //not a stake key
 		}
 
-		if bytes.Equal(wr.K[32:], []byte(stakeKey)) {
+		if bytes.Equal(wr.K[32:], []byte(stakeKey)) && len(wr.V) >= 8 {
 			var pk PK
 			copy(pk[:], wr.K[:32])
 			deposits[pk] = binary.BigEndian.Uint64(wr.V)
@@ -81,6 +108,38 @@ func (w *Write) StakeDeposits() (deposits map[PK]uint64) {
 	return
 }
 
+// StakeLeaves returns the round from which members leave, for each member that
+// leaves in this write
+func (w *Write) StakeLeaves() (leaves map[PK]uint64) {
+	leaves = make(map[PK]uint64)
+	for _, wr := range w.TxData.WriteRows {
+		if len(wr.K) != 32+len(leaveKey) || len(wr.V) < 8 {
+			continue //not a leave, or a leave that is reset
+		}
+
+		if bytes.Equal(wr.K[32:], []byte(leaveKey)) {
+			var pk PK
+			copy(pk[:], wr.K[:32])
+			leaves[pk] = binary.BigEndian.Uint64(wr.V)
+		}
+	}
+
+	return
+}
+
+// CommitsTokenPK returns whether this write (re)commits the token pk of the
+// provided primary key
+func (w *Write) CommitsTokenPK(pk PK) bool {
+	k := tpkey(pk)
+	for _, wr := range w.TxData.WriteRows {
+		if bytes.Equal(wr.K, k) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // HasDepositFor returns whether this write writs a deposit of at least one for
 // the provided primary key
 func (w *Write) HasDepositFor(pk PK) bool {
@@ -88,46 +147,107 @@ func (w *Write) HasDepositFor(pk PK) bool {
 	return deposit > 0
 }
 
-//Hash the operation
-func (w *Write) Hash() (id WID) {
-	h := sha256.New()
-	binary.Write(h, binary.BigEndian, w.TimeStart)
-	binary.Write(h, binary.BigEndian, w.TimeCommit)
-	binary.Write(h, binary.BigEndian, w.Nonce)
-	binary.Write(h, binary.BigEndian, w.PK)
-
-	//read rows, sorted
-	rr := make([]ssi.KH, 0, len(w.ReadRows))
-	for k := range w.ReadRows {
-		rr = append(rr, k)
+// CheckLimits returns an error if the write exceeds any of the protocol limits
+// on its size, such writes are not accepted by peers
+func (w *Write) CheckLimits() (err error) {
+	if len(w.ReadRows)+len(w.ReadRanges) > MaxReadRows {
+		return ErrTooManyReadRows
+	}
+
+	if len(w.WriteRows) > MaxWriteRows {
+		return ErrTooManyWriteRows
 	}
 
-	sort.Slice(rr, func(i, j int) bool {
-		return bytes.Compare(rr[i][:], rr[j][:]) < 0
-	})
+	for _, r := range w.ReadRanges {
+		if len(r.Start) > MaxKeyLen || len(r.End) > MaxKeyLen {
+			return ErrKeyTooLong
+		}
+	}
 
-	for _, k := range rr {
-		binary.Write(h, binary.BigEndian, k[:])
+	for _, wr := range w.WriteRows {
+		if len(wr.K) > MaxKeyLen {
+			return ErrKeyTooLong
+		}
+
+		if len(wr.V) > MaxValueLen {
+			return ErrValueTooLong
+		}
 	}
 
-	//Write rows, sorted
-	wr := make([]ssi.KH, 0, len(w.WriteRows))
-	for k := range w.WriteRows {
-		wr = append(wr, k)
+	return nil
+}
+
+// Expired returns whether the write can no longer be included in a block of
+// round 'round'
+func (w *Write) Expired(round uint64) bool {
+	return w.ValidUntil > 0 && round > w.ValidUntil
+}
+
+// Size returns the number of bytes the write takes up in an encoded block
+func (w *Write) Size() int {
+	d, err := w.MarshalBinary()
+	if err != nil {
+		panic("failed to encode write: " + err.Error())
 	}
 
-	sort.Slice(wr, func(i, j int) bool {
-		return bytes.Compare(wr[i][:], wr[j][:]) < 0
-	})
+	return 4 + len(d) //length prefix and encoded write
+}
 
-	for _, k := range wr {
-		binary.Write(h, binary.BigEndian, k[:])
-		binary.Write(h, binary.BigEndian, w.WriteRows[k].K)
-		binary.Write(h, binary.BigEndian, w.WriteRows[k].V)
+const writeVersion = 3
+
+//MarshalBinary encodes the write in its canonical format, the signature is
+//always the last part of the encoding
+func (w *Write) MarshalBinary() (d []byte, err error) {
+	txd := w.TxData
+	if txd == nil {
+		txd = &ssi.TxData{}
 	}
 
-	copy(id[:], h.Sum(nil))
-	return
+	txdd, err := txd.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	e := enc.NewWriter(writeVersion)
+	e.Bytes(txdd)
+	e.Fixed(w.PK[:])
+	e.Fixed(w.Nonce[:])
+	e.Uint64(w.ValidUntil)
+	e.Uint64(w.Fee)
+	e.Fixed(w.Signature[:])
+	return e.Data(), nil
+}
+
+//UnmarshalBinary decodes a write that was encoded by MarshalBinary
+func (w *Write) UnmarshalBinary(d []byte) (err error) {
+	r, _ := enc.NewReader(d, writeVersion)
+	txdd := r.Bytes()
+	r.Fixed(w.PK[:])
+	r.Fixed(w.Nonce[:])
+	w.ValidUntil = r.Uint64()
+	w.Fee = r.Uint64()
+
+	r.Fixed(w.Signature[:])
+	if err = r.Done(); err != nil {
+		return err
+	}
+
+	w.TxData = &ssi.TxData{}
+	return w.TxData.UnmarshalBinary(txdd)
+}
+
+//Hash the write, it is taken over the encoded write without the signature
+func (w *Write) Hash() (id WID) {
+	if w.legacy {
+		return w.legacyHash()
+	}
+
+	d, err := w.MarshalBinary()
+	if err != nil {
+		panic("failed to encode write: " + err.Error())
+	}
+
+	return WID(sha256.Sum256(d[:len(d)-ed25519.SignatureSize]))
 }
 
 //VerifySignature will check the block's signature
@@ -11,31 +11,37 @@ import (
 
 func TestTxOpHashing(t *testing.T) {
 	w1 := &onl.Write{TxData: &ssi.TxData{ReadRows: make(ssi.KeySet), WriteRows: make(ssi.KeyChangeSet)}}
-	test.Equals(t, "5b6fb58e", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "5680963c", fmt.Sprintf("%.4x", w1.Hash()))
 
-	w1.TimeCommit = 1
-	test.Equals(t, "c416782a", fmt.Sprintf("%.4x", w1.Hash()))
+	w1.TimeCommit = 1 //local to the committing database, not part of the hash
+	test.Equals(t, "5680963c", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.TimeStart = 1
-	test.Equals(t, "16be14a7", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "b1551d02", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.ReadRows.Add([]byte{0x01})
-	test.Equals(t, "0aaa1111", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "e9fd12b6", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.WriteRows.Add([]byte{0x01}, []byte{0x02})
-	test.Equals(t, "6960f8ef", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "495727d4", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.WriteRows.Add([]byte{0x01}, []byte{0x03})
-	test.Equals(t, "e899f492", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "a2341ed3", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.WriteRows.Add([]byte{0x01}, []byte{0x03}) //shouldn't change anything
-	test.Equals(t, "e899f492", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "a2341ed3", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.Nonce[0] = 0x01
-	test.Equals(t, "69ac6f45", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "ee77ccc7", fmt.Sprintf("%.4x", w1.Hash()))
 
 	w1.PK[0] = 0x01
-	test.Equals(t, "7c5ac829", fmt.Sprintf("%.4x", w1.Hash()))
+	test.Equals(t, "70379c6c", fmt.Sprintf("%.4x", w1.Hash()))
+
+	w1.ValidUntil = 1
+	test.Equals(t, "6748e88e", fmt.Sprintf("%.4x", w1.Hash()))
+
+	w1.Fee = 1
+	test.Equals(t, "f9a53585", fmt.Sprintf("%.4x", w1.Hash()))
 
 	idn1 := onl.NewIdentity([]byte{0x01})
 	t.Run("signature check", func(t *testing.T) {
@@ -52,3 +58,46 @@ func TestTxOpHashing(t *testing.T) {
 		test.Equals(t, false, w1.VerifySignature())
 	})
 }
+
+func TestWriteExpiry(t *testing.T) {
+	w1 := &onl.Write{TxData: &ssi.TxData{}}
+	test.Equals(t, false, w1.Expired(100))
+
+	w1.ValidUntil = 2
+	test.Equals(t, false, w1.Expired(1))
+	test.Equals(t, false, w1.Expired(2))
+	test.Equals(t, true, w1.Expired(3))
+}
+
+func TestWriteLimits(t *testing.T) {
+	w1 := &onl.Write{TxData: &ssi.TxData{ReadRows: make(ssi.KeySet), WriteRows: make(ssi.KeyChangeSet)}}
+	test.Ok(t, w1.CheckLimits())
+
+	w1.WriteRows.Add(make([]byte, onl.MaxKeyLen), make([]byte, onl.MaxValueLen))
+	test.Ok(t, w1.CheckLimits())
+
+	w1.WriteRows.Add(make([]byte, onl.MaxKeyLen), make([]byte, onl.MaxValueLen+1))
+	test.Equals(t, onl.ErrValueTooLong, w1.CheckLimits())
+
+	w1.WriteRows = make(ssi.KeyChangeSet)
+	w1.WriteRows.Add(make([]byte, onl.MaxKeyLen+1), nil)
+	test.Equals(t, onl.ErrKeyTooLong, w1.CheckLimits())
+
+	w1.WriteRows = make(ssi.KeyChangeSet)
+	w1.ReadRanges = []ssi.Range{{Start: make([]byte, onl.MaxKeyLen+1)}}
+	test.Equals(t, onl.ErrKeyTooLong, w1.CheckLimits())
+
+	w1.ReadRanges = nil
+	for i := 0; i <= onl.MaxWriteRows; i++ {
+		w1.WriteRows.Add([]byte(fmt.Sprint(i)), nil)
+	}
+
+	test.Equals(t, onl.ErrTooManyWriteRows, w1.CheckLimits())
+
+	w1.WriteRows = make(ssi.KeyChangeSet)
+	for i := 0; i <= onl.MaxReadRows; i++ {
+		w1.ReadRows.Add([]byte(fmt.Sprint(i)))
+	}
+
+	test.Equals(t, onl.ErrTooManyReadRows, w1.CheckLimits())
+}